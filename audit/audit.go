@@ -0,0 +1,213 @@
+// Package audit records every authentication and query decision of the shim
+package audit
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/spf13/viper"
+)
+
+// decisions of the record
+const (
+	Allow = "allow"
+	Deny  = "deny"
+	Error = "error"
+)
+
+// size of the queue of records waiting to be written into InfluxDB
+const queueSize = 1000
+
+// Record is the single audit entry, passwords are never a part of it
+type Record struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // auth or query
+	Username string    `json:"username,omitempty"`
+	Groups   []string  `json:"groups,omitempty"`
+	SourceIP string    `json:"sourceIP"`
+	Database string    `json:"database,omitempty"`
+	Query    string    `json:"query,omitempty"` // normalized query
+	Decision string    `json:"decision"`
+	Rule     string    `json:"rule,omitempty"` // the rule that caused the decision
+	Latency  float64   `json:"latencyMs"`
+	Rows     int       `json:"rows"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Logger writes records to the rotating file and optionally to InfluxDB
+type Logger struct {
+	mu     sync.Mutex
+	file   *rotatingFile
+	closed bool // records of requests finished after Close are dropped
+
+	influxConf  client.HTTPConfig
+	database    string
+	measurement string
+	queue       chan Record
+	wg          sync.WaitGroup
+}
+
+// New creates audit logger by "audit" section of config
+func New(c viper.Viper) (*Logger, error) {
+	l := &Logger{}
+	if path := c.GetString("audit.path"); path != "" {
+		f, err := openRotatingFile(path, int64(c.GetInt("audit.maxSize"))*1024*1024, c.GetInt("audit.maxBackups"))
+		if err != nil {
+			glog.Errorf("Unable to open audit log file: %s", err.Error())
+			return nil, err
+		}
+		l.file = f
+	}
+
+	if c.GetBool("audit.influxdb.enabled") {
+		l.influxConf = client.HTTPConfig{
+			Addr:      c.GetString("influxdb.addr"),
+			Username:  c.GetString("influxdb.username"),
+			Password:  c.GetString("influxdb.password"),
+			UserAgent: c.GetString("influxdb.userAgent"),
+		}
+		l.database = c.GetString("audit.influxdb.database")
+		l.measurement = c.GetString("audit.influxdb.measurement")
+		if l.measurement == "" {
+			l.measurement = "audit"
+		}
+		l.queue = make(chan Record, queueSize)
+		l.wg.Add(1)
+		go l.writePoints(time.Duration(c.GetInt("audit.influxdb.flushInterval")) * time.Millisecond)
+	}
+	return l, nil
+}
+
+// Log writes the record, time of the record is set if it is empty
+func (l *Logger) Log(r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		glog.Errorf("Audit log is closed, record of %s is dropped", r.Action)
+		return
+	}
+
+	if l.file != nil {
+		b, err := json.Marshal(r)
+		if err != nil {
+			glog.Errorf("Unable to encode audit record: %s", err.Error())
+			return
+		}
+		if _, err = l.file.Write(append(b, '\n')); err != nil {
+			glog.Errorf("Unable to write audit record: %s", err.Error())
+		}
+	}
+
+	if l.queue != nil {
+		select {
+		case l.queue <- r:
+		default:
+			glog.Error("Audit queue is full, record is not written into InfluxDB")
+		}
+	}
+}
+
+// Close flushes pending records and closes the file
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	if l.queue != nil {
+		close(l.queue)
+		l.wg.Wait()
+	}
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+// writePoints writes queued records into InfluxDB measurement in batches
+func (l *Logger) writePoints(interval time.Duration) {
+	defer l.wg.Done()
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var records []Record
+	for {
+		select {
+		case r, ok := <-l.queue:
+			if !ok {
+				l.flush(records)
+				return
+			}
+			records = append(records, r)
+		case <-ticker.C:
+			l.flush(records)
+			records = nil
+		}
+	}
+}
+
+func (l *Logger) flush(records []Record) {
+	if len(records) == 0 {
+		return
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  l.database,
+		Precision: "ns",
+	})
+	if err != nil {
+		glog.Errorf("Unable to create audit batch: %s", err.Error())
+		return
+	}
+	for _, r := range records {
+		tags := map[string]string{"action": r.Action, "decision": r.Decision}
+		if r.Username != "" {
+			tags["username"] = r.Username
+		}
+		if r.Database != "" {
+			tags["database"] = r.Database
+		}
+		fields := map[string]interface{}{
+			"sourceIP": r.SourceIP,
+			"latency":  r.Latency,
+			"rows":     r.Rows,
+		}
+		if r.Query != "" {
+			fields["query"] = r.Query
+		}
+		if r.Rule != "" {
+			fields["rule"] = r.Rule
+		}
+		if r.Error != "" {
+			fields["error"] = r.Error
+		}
+		p, err := client.NewPoint(l.measurement, tags, fields, r.Time)
+		if err != nil {
+			glog.Errorf("Unable to create audit point: %s", err.Error())
+			continue
+		}
+		bp.AddPoint(p)
+	}
+
+	c, err := client.NewHTTPClient(l.influxConf)
+	if err != nil {
+		glog.Errorf("Unable to open connection to InfluxDB: %v", err)
+		return
+	}
+	defer c.Close()
+	if err := c.Write(bp); err != nil {
+		glog.Errorf("Unable to write audit records: %s", err.Error())
+	}
+}
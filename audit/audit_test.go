@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	f, err := openRotatingFile(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Logger{file: f}
+
+	for i := 0; i < 10; i++ {
+		l.Log(Record{
+			Action:   "query",
+			Username: "tesla",
+			SourceIP: "127.0.0.1",
+			Database: "mydb",
+			Query:    "SHOW TAGS",
+			Decision: Allow,
+		})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("want %s to exist: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("want only 2 backups")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Username != "tesla" || r.Decision != Allow || r.Time.IsZero() {
+			t.Errorf("invalid record: %+v", r)
+		}
+	}
+}
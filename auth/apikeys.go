@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	errInvalidAPIKey = errors.New("Invalid API key")
+	errNoSuchAPIKey  = errors.New("API key with such id does not exist")
+	errKeyNetwork    = errors.New("API key is not allowed from this network")
+	errNoService     = errors.New("API key must have a service name")
+)
+
+// APIKey is the long-lived key of the service account,
+// only the hash of the secret part is stored
+type APIKey struct {
+	ID        string    `json:"id"`
+	Service   string    `json:"service"`
+	Hash      string    `json:"hash"`
+	Groups    []string  `json:"groups"`              // group DNs, policies of the key
+	Databases []string  `json:"databases,omitempty"` // allowed databases, all databases if empty
+	CIDR      string    `json:"cidr,omitempty"`      // allowed source network, any if empty
+	Created   time.Time `json:"created"`
+}
+
+// User returns the user of the service account
+func (k APIKey) User() User {
+	return User{
+		Name:       k.Service,
+		Username:   k.Service,
+		GroupNames: k.Groups,
+		Databases:  k.Databases,
+		Source:     "apikey:" + k.ID,
+	}
+}
+
+// KeyStore keeps API keys in JSON file,
+// the file is read again when it is changed by another process, e.g: by the keys command
+type KeyStore struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[string]APIKey
+	modTime time.Time // modification time and size of the file that was read
+	size    int64
+}
+
+// OpenKeyStore reads the keys from the file, missing file is an empty store
+func OpenKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, keys: map[string]APIKey{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the keys again if the file was changed since the last read,
+// must be called with the lock held
+func (s *KeyStore) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		// deleted file revokes all keys
+		s.keys, s.modTime, s.size = map[string]APIKey{}, time.Time{}, 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []APIKey
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	keys := make(map[string]APIKey, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.keys, s.modTime, s.size = keys, info.ModTime(), info.Size()
+	return nil
+}
+
+// Create generates new key, the returned key string is not stored
+// and must be handed to the service once
+func (s *KeyStore) Create(service string, groups, databases []string, cidr string) (string, APIKey, error) {
+	if service == "" {
+		return "", APIKey{}, errNoService
+	}
+	if cidr != "" {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "", APIKey{}, err
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	k := APIKey{
+		ID:        id,
+		Service:   service,
+		Hash:      hashSecret(secret),
+		Groups:    groups,
+		Databases: databases,
+		CIDR:      cidr,
+		Created:   time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// keys created or revoked by another process must not be lost
+	if err := s.load(); err != nil {
+		return "", APIKey{}, err
+	}
+	s.keys[id] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		return "", APIKey{}, err
+	}
+	glog.Infof("API key %s is created for service '%s'", id, service)
+	return id + "." + secret, k, nil
+}
+
+// List returns all keys sorted by service name
+func (s *KeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		glog.Errorf("Unable to read API keys: %s", err.Error())
+	}
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Sort(byService(keys))
+	return keys
+}
+
+// Revoke deletes the key by id
+func (s *KeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	k, ok := s.keys[id]
+	if !ok {
+		return errNoSuchAPIKey
+	}
+	delete(s.keys, id)
+	if err := s.save(); err != nil {
+		s.keys[id] = k
+		return err
+	}
+	glog.Infof("API key %s of service '%s' is revoked", id, k.Service)
+	return nil
+}
+
+// Verify checks the key presented from the ip
+func (s *KeyStore) Verify(key string, ip net.IP) (APIKey, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return APIKey{}, errInvalidAPIKey
+	}
+	s.mu.Lock()
+	if err := s.load(); err != nil {
+		// keys read before are used until the file is readable again
+		glog.Errorf("Unable to read API keys: %s", err.Error())
+	}
+	k, ok := s.keys[parts[0]]
+	s.mu.Unlock()
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(k.Hash)) != 1 {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if k.CIDR != "" {
+		_, ipNet, err := net.ParseCIDR(k.CIDR)
+		if err != nil || ip == nil || !ipNet.Contains(ip) {
+			glog.Errorf("API key %s is used from not allowed address %s", k.ID, ip)
+			return APIKey{}, errKeyNetwork
+		}
+	}
+	return k, nil
+}
+
+// save writes keys to the temp file and renames it, so the store is never half written
+func (s *KeyStore) save() error {
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Sort(byService(keys))
+	b, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".keys")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	// own changes are not read again
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime, s.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+type byService []APIKey
+
+func (k byService) Len() int      { return len(k) }
+func (k byService) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byService) Less(i, j int) bool {
+	if k[i].Service != k[j].Service {
+		return k[i].Service < k[j].Service
+	}
+	return k[i].ID < k[j].ID
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
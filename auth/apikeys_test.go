@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	store, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, k, err := store.Create("grafana", []string{"CN=Readers,DC=White,DC=com"}, []string{"metrics"}, "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys must survive reopening of the store
+	store, err = OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		key  string
+		ip   string
+		want error
+	}{
+		{key, "10.1.2.3", nil},
+		{key, "192.168.1.1", errKeyNetwork},
+		{key + "x", "10.1.2.3", errInvalidAPIKey},
+		{"unknown.secret", "10.1.2.3", errInvalidAPIKey},
+		{"malformed", "10.1.2.3", errInvalidAPIKey},
+	}
+	for _, test := range testData {
+		_, err := store.Verify(test.key, net.ParseIP(test.ip))
+		if err != test.want {
+			t.Errorf("want %v, got %v", test.want, err)
+		}
+	}
+
+	user := k.User()
+	if !user.CanAccess("metrics") || user.CanAccess("billing") {
+		t.Errorf("want access only to metrics, got %v", user.Databases)
+	}
+
+	if err := store.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Verify(key, net.ParseIP("10.1.2.3")); err != errInvalidAPIKey {
+		t.Errorf("want %v, got %v", errInvalidAPIKey, err)
+	}
+	if err := store.Revoke(k.ID); err != errNoSuchAPIKey {
+		t.Errorf("want %v, got %v", errNoSuchAPIKey, err)
+	}
+}
+
+func TestKeyStoreExternalChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	// the running server and the keys command open the same file
+	server, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.1.2.3")
+
+	key, k, err := cli.Create("grafana", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Verify(key, ip); err != nil {
+		t.Errorf("want key created by the command valid, got %v", err)
+	}
+	if err := cli.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Verify(key, ip); err != errInvalidAPIKey {
+		t.Errorf("want %v, got %v", errInvalidAPIKey, err)
+	}
+
+	// changes of the server keep changes of the command
+	other, _, err := cli.Create("telegraf", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.Create("kapacitor", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Verify(other, ip); err != nil {
+		t.Errorf("want key of telegraf valid, got %v", err)
+	}
+	if _, err := cli.Verify(key, ip); err != errInvalidAPIKey {
+		t.Errorf("want revoked key invalid, got %v", err)
+	}
+	if keys := cli.List(); len(keys) != 2 {
+		t.Errorf("want 2 keys, got %d", len(keys))
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+// Authenticator checks user id and password,
+// returns the user info with Source set to the backend that authenticated the user
+type Authenticator interface {
+	Authenticate(uid, password string) (User, bool)
+}
+
+// Lookuper finds the user by user id without the password
+type Lookuper interface {
+	Lookup(uid string) (User, bool)
+}
+
+// Chain tries authenticators in order, the first successful one wins
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(uid, password string) (User, bool) {
+	for _, a := range c {
+		if user, ok := a.Authenticate(uid, password); ok {
+			return user, ok
+		}
+	}
+	return User{}, false
+}
+
+// Lookup implements Lookuper by backends that support it, in order
+func (c Chain) Lookup(uid string) (User, bool) {
+	for _, a := range c {
+		if l, ok := a.(Lookuper); ok {
+			if user, found := l.Lookup(uid); found {
+				return user, found
+			}
+		}
+	}
+	return User{}, false
+}
+
+// Close closes backends of the chain that hold resources
+func (c Chain) Close() error {
+	for _, a := range c {
+		if closer, ok := a.(interface {
+			Close() error
+		}); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// Authenticate implements Authenticator by LDAP login
+func (source *Source) Authenticate(uid, password string) (User, bool) {
+	return source.Login(uid, password)
+}
+
+// Authenticate implements Authenticator by LDAP login of the routed source
+func (s Sources) Authenticate(uid, password string) (User, bool) {
+	return s.Login(uid, password)
+}
+
+// Lookup implements Lookuper by the source of the user's domain
+func (s Sources) Lookup(uid string) (User, bool) {
+	source, name := s.source(uid)
+	return source.Lookup(name)
+}
+
+// Close closes idle pooled connections of the sources
+func (s Sources) Close() error {
+	for _, source := range s {
+		source.Close()
+	}
+	return nil
+}
+
+// NewAuthenticator creates the chain of backends listed in "auth.backends",
+// supported backends are "ldap", "htpasswd" and "apikeys", default is "ldap"
+func NewAuthenticator(c viper.Viper) (Authenticator, error) {
+	backends := c.GetStringSlice("auth.backends")
+	if len(backends) == 0 {
+		backends = []string{"ldap"}
+	}
+
+	chain := Chain{}
+	for _, b := range backends {
+		switch b {
+		case "ldap":
+			sources, err := NewSources(c)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, sources)
+		case "htpasswd":
+			f, err := NewHtpasswd(c)
+			if err != nil {
+				glog.Errorf("Unable to load htpasswd file: %s", err.Error())
+				return nil, err
+			}
+			chain = append(chain, f)
+		case "apikeys":
+			f, err := NewAPIKeyFile(c)
+			if err != nil {
+				glog.Errorf("Unable to load API keys file: %s", err.Error())
+				return nil, err
+			}
+			chain = append(chain, f)
+		default:
+			return nil, fmt.Errorf("unknown auth backend: %s", b)
+		}
+	}
+	return chain, nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+var errCertRule = errors.New("Client certificate rule must have cn or uri pattern")
+
+// CertRule maps client certificates to the user,
+// CN and URI are patterns matched against subject CN and SAN URIs,
+// where '*' matches any characters, e.g: "spiffe://example.com/ns/metrics/*"
+type CertRule struct {
+	CN        string
+	URI       string
+	Username  string   // username of matched certificates, CN or URI itself if empty
+	Groups    []string // group DNs of the user
+	Databases []string // databases the user is restricted to, all databases if empty
+	IsAdmin   bool
+}
+
+// match returns the CN or URI of the certificate matched by the rule
+func (r CertRule) match(cert *x509.Certificate) (string, bool) {
+	if r.CN != "" {
+		if wildcardMatch(r.CN, cert.Subject.CommonName) {
+			return cert.Subject.CommonName, true
+		}
+	}
+	if r.URI != "" {
+		for _, u := range cert.URIs {
+			if wildcardMatch(r.URI, u.String()) {
+				return u.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// CertMapper maps verified client certificates to users by rules checked in order
+type CertMapper []CertRule
+
+// NewCertMapper creates mapper by "web.tls.clientRules" list of config
+func NewCertMapper(c viper.Viper) (CertMapper, error) {
+	var rules []CertRule
+	if err := c.UnmarshalKey("web.tls.clientRules", &rules); err != nil {
+		glog.Error("cannot unmarshal client certificate rules")
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.CN == "" && r.URI == "" {
+			return nil, errCertRule
+		}
+	}
+	return CertMapper(rules), nil
+}
+
+// Map returns the user of the first rule matching the certificate
+func (m CertMapper) Map(cert *x509.Certificate) (User, bool) {
+	for _, r := range m {
+		name, ok := r.match(cert)
+		if !ok {
+			continue
+		}
+		username := r.Username
+		if username == "" {
+			username = name
+		}
+		return User{
+			Name:       username,
+			Username:   username,
+			IsAdmin:    r.IsAdmin,
+			GroupNames: r.Groups,
+			Databases:  r.Databases,
+			Source:     "cert",
+		}, true
+	}
+	return User{}, false
+}
+
+// wildcardMatch reports whether s matches the pattern, '*' matches any characters including '/'
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
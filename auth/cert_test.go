@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestCertMapper(t *testing.T) {
+	mapper := CertMapper{
+		{URI: "spiffe://example.com/ns/metrics/*", Groups: []string{"CN=Readers,DC=White,DC=com"}, Databases: []string{"metrics"}},
+		{CN: "ops-*.example.com", Username: "ops", IsAdmin: true},
+	}
+	spiffe, _ := url.Parse("spiffe://example.com/ns/metrics/sa/collector")
+	other, _ := url.Parse("spiffe://example.com/ns/billing/sa/api")
+
+	testData := []struct {
+		cert     *x509.Certificate
+		mapped   bool
+		username string
+	}{
+		{&x509.Certificate{URIs: []*url.URL{spiffe}}, true, "spiffe://example.com/ns/metrics/sa/collector"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "ops-1.example.com"}}, true, "ops"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "web.example.com"}, URIs: []*url.URL{other}}, false, ""},
+	}
+	for _, test := range testData {
+		user, ok := mapper.Map(test.cert)
+		if ok != test.mapped {
+			t.Errorf("want %v, got %v", test.mapped, ok)
+		}
+		if user.Username != test.username {
+			t.Errorf("want %s, got %s", test.username, user.Username)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentialsLine = errors.New("Credentials file line must be in form of name:hash[:group;group]")
+
+// credential is the single line of the credentials file
+type credential struct {
+	hash   string
+	groups []string
+}
+
+// credentialsFile keeps the lines of "name:hash[:group DN;group DN]" file,
+// the file is read again when its modification time is changed
+type credentialsFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	entries map[string]credential
+}
+
+func newCredentialsFile(path string) (*credentialsFile, error) {
+	f := &credentialsFile{path: path}
+	return f, f.reload()
+}
+
+// reload reads the file if it was changed since the last read
+func (f *credentialsFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := map[string]credential{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return errInvalidCredentialsLine
+		}
+		c := credential{hash: parts[1]}
+		if len(parts) == 3 && parts[2] != "" {
+			c.groups = strings.Split(parts[2], ";")
+		}
+		entries[parts[0]] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.entries = entries
+	f.modTime = info.ModTime()
+	glog.Infof("Loaded %d credentials from %s", len(entries), f.path)
+	return nil
+}
+
+// get returns the credential of the name
+func (f *credentialsFile) get(name string) (credential, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.reload(); err != nil {
+		glog.Errorf("Unable to reload %s, using previous credentials: %s", f.path, err.Error())
+	}
+	c, ok := f.entries[name]
+	return c, ok
+}
+
+// Htpasswd authenticates break-glass users by the htpasswd file with bcrypt hashes
+type Htpasswd struct {
+	file    *credentialsFile
+	isAdmin bool
+}
+
+// NewHtpasswd loads the file of "auth.htpasswd.path" config
+func NewHtpasswd(c viper.Viper) (*Htpasswd, error) {
+	f, err := newCredentialsFile(c.GetString("auth.htpasswd.path"))
+	if err != nil {
+		return nil, err
+	}
+	return &Htpasswd{file: f, isAdmin: c.GetBool("auth.htpasswd.isAdmin")}, nil
+}
+
+// Authenticate implements Authenticator
+func (h *Htpasswd) Authenticate(uid, password string) (User, bool) {
+	c, ok := h.file.get(uid)
+	if !ok {
+		return User{}, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(c.hash), []byte(password)); err != nil {
+		glog.Errorf("htpasswd auth. failed for %s: %s", uid, err.Error())
+		return User{}, false
+	}
+	return User{
+		Name:       uid,
+		Username:   uid,
+		IsAdmin:    h.isAdmin,
+		GroupNames: c.groups,
+		Source:     "htpasswd",
+	}, true
+}
+
+// Lookup implements Lookuper
+func (h *Htpasswd) Lookup(uid string) (User, bool) {
+	c, ok := h.file.get(uid)
+	if !ok {
+		return User{}, false
+	}
+	return User{Name: uid, Username: uid, IsAdmin: h.isAdmin, GroupNames: c.groups, Source: "htpasswd"}, true
+}
+
+// APIKeyFile authenticates service accounts by static keys,
+// the file keeps hex encoded SHA-256 hashes of the keys
+type APIKeyFile struct {
+	file *credentialsFile
+}
+
+// NewAPIKeyFile loads the file of "auth.apikeys.path" config
+func NewAPIKeyFile(c viper.Viper) (*APIKeyFile, error) {
+	f, err := newCredentialsFile(c.GetString("auth.apikeys.path"))
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyFile{file: f}, nil
+}
+
+// Authenticate implements Authenticator, uid is the service name and password is the key
+func (a *APIKeyFile) Authenticate(uid, password string) (User, bool) {
+	c, ok := a.file.get(uid)
+	if !ok {
+		return User{}, false
+	}
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(c.hash))) != 1 {
+		glog.Errorf("API key auth. failed for %s", uid)
+		return User{}, false
+	}
+	return User{
+		Name:       uid,
+		Username:   uid,
+		GroupNames: c.groups,
+		Source:     "apikey",
+	}, true
+}
+
+// Lookup implements Lookuper
+func (a *APIKeyFile) Lookup(uid string) (User, bool) {
+	c, ok := a.file.get(uid)
+	if !ok {
+		return User{}, false
+	}
+	return User{Name: uid, Username: uid, GroupNames: c.groups, Source: "apikey"}, true
+}
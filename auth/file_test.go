@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestChain(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswdPath := writeTempFile(t, fmt.Sprintf("# break-glass admins\nroot:%s\n", hash))
+	defer os.Remove(htpasswdPath)
+
+	sum := sha256.Sum256([]byte("telegraf-key"))
+	keysPath := writeTempFile(t, fmt.Sprintf("telegraf:%s:CN=Agents,OU=Services,DC=White,DC=com\n", hex.EncodeToString(sum[:])))
+	defer os.Remove(keysPath)
+
+	htpasswd, err := newCredentialsFile(htpasswdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newCredentialsFile(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{&Htpasswd{file: htpasswd, isAdmin: true}, &APIKeyFile{file: keys}}
+
+	testData := []struct {
+		uid      string
+		password string
+		logged   bool
+		source   string
+		admin    bool
+		groups   int
+	}{
+		{uid: "root", password: "secret", logged: true, source: "htpasswd", admin: true},
+		{uid: "root", password: "wrong"},
+		{uid: "telegraf", password: "telegraf-key", logged: true, source: "apikey", groups: 1},
+		{uid: "telegraf", password: "secret"},
+		{uid: "nobody", password: "secret"},
+	}
+	for _, d := range testData {
+		user, logged := chain.Authenticate(d.uid, d.password)
+		if logged != d.logged {
+			t.Errorf("%s: want %v, got %v", d.uid, d.logged, logged)
+			continue
+		}
+		if user.Source != d.source || user.IsAdmin != d.admin || len(user.GroupNames) != d.groups {
+			t.Errorf("%s: invalid user %+v", d.uid, user)
+		}
+	}
+}
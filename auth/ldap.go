@@ -8,13 +8,29 @@ package auth
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Maksadbek/influxdb-shim/metrics"
 	"github.com/golang/glog"
 	"gopkg.in/ldap.v2"
 )
 
+var (
+	ldapBindDuration = metrics.NewHistogram("shim_ldap_bind_duration_seconds", "Latency of LDAP binds.", "source", "kind")
+	ldapBindFailures = metrics.NewCounter("shim_ldap_bind_failures_total", "Count of failed LDAP binds.", "source", "kind")
+	ldapGroupCache   = metrics.NewCounter("shim_ldap_group_cache_total", "Count of group membership cache lookups.", "source", "result")
+)
+
+var errNoHosts = errors.New("LDAP source does not have hosts configured")
+
+// pooled connections idle longer than this are checked before reuse
+const poolHealthCheck = 30 * time.Second
+
 // Basic LDAP authentication service
 type Source struct {
 	Name              string // canonical name (ie. corporate.ad)
@@ -35,6 +51,39 @@ type Source struct {
 	AdminFilter       string // Query filter to check if user is admin
 	Enabled           bool   // if this source is disabled
 	UseDBind          bool   // Use Direct Bind to glogin
+
+	Hosts   []string // fallback hosts tried in order if Host is not reachable
+	Domains []string // user domains routed to this source, e.g: "corp" for user@corp or CORP\user
+
+	UseStartTLS   bool   // upgrade plain connection with StartTLS
+	CAFile        string // PEM bundle of CAs to verify the server, system CAs are used if empty
+	ServerName    string // name to verify the server certificate against, host is used if empty
+	MinTLSVersion string // minimum TLS version, e.g: "1.2"
+	CertFile      string // client certificate file
+	KeyFile       string // client certificate key file
+
+	PoolSize        int           // max count of idle service account connections
+	PoolIdleTimeout time.Duration // idle connections are closed after this timeout
+	GroupCacheTTL   time.Duration // lifetime of cached group memberships, 0 disables cache
+
+	mu         sync.Mutex // guards Enabled changed by concurrent logins
+	initOnce   sync.Once
+	initErr    error
+	pool       *connPool
+	groups     *groupCache
+	rootCAs    *x509.CertPool
+	certs      []tls.Certificate
+	minVersion uint16
+}
+
+// entry is the user's record found by SearchEntry
+type entry struct {
+	dn       string
+	username string
+	name     string
+	surname  string
+	mail     string
+	admin    bool
 }
 
 // Attr is the attributes of the search result
@@ -72,17 +121,8 @@ func (ls *Source) sanitizedUserDN(username string) (string, bool) {
 }
 
 func (ls *Source) findUserDN(l *ldap.Conn, name string) (string, bool) {
+	// connection is already bound as BindDN by the pool
 	glog.Errorf("Search for LDAP user: %s", name)
-	if ls.BindDN != "" && ls.BindPassword != "" {
-		err := l.Bind(ls.BindDN, ls.BindPassword)
-		if err != nil {
-			glog.Errorf("Failed to bind as BindDN[%s]: %v", ls.BindDN, err)
-			return "", false
-		}
-		glog.Errorf("Bound as BindDN %s", ls.BindDN)
-	} else {
-		glog.Errorf("Proceeding with anonymous LDAP search.")
-	}
 
 	// A search for the user.
 	userFilter, ok := ls.sanitizedUserQuery(name)
@@ -116,13 +156,11 @@ func (ls *Source) findUserDN(l *ldap.Conn, name string) (string, bool) {
 
 // Search provides searching functionality by given filters and attributes
 func (ls *Source) Search(baseDN string, filter string, attrs []string) ([]Result, error) {
-	l, err := ldapDial(ls)
+	l, err := ls.conn()
 	if err != nil {
-		glog.Error("LDAP Connect error, %s:%v", ls.Host, err)
-		ls.Enabled = false
 		return nil, err
 	}
-	defer l.Close()
+	defer ls.release(l, false)
 	glog.Errorf("Fetching attributes '%+v', with filter %s and base %s", attrs, filter, baseDN)
 	search := ldap.NewSearchRequest(
 		baseDN,
@@ -156,22 +194,33 @@ func (ls *Source) Search(baseDN string, filter string, attrs []string) ([]Result
 
 // SearchEntry : search an LDAP source if an entry (name, passwd) is valid and in the specific filter
 func (ls *Source) SearchEntry(name, passwd string, directBind bool) (string, string, string, string, bool, bool) {
-	l, err := ldapDial(ls)
+	l, err := ls.conn()
 	if err != nil {
-		glog.Error("LDAP Connect error, %s:%v", ls.Host, err)
-		ls.Enabled = false
 		return "", "", "", "", false, false
 	}
-	defer l.Close()
+	defer ls.release(l, true)
+
+	e, ok := ls.searchEntry(l, name, passwd, directBind)
+	if !ok {
+		return "", "", "", "", false, false
+	}
+	return e.username, e.name, e.surname, e.mail, e.admin, true
+}
 
-	var userDN string
+// searchEntry checks the entry (name, passwd) on the given connection,
+// connection is left bound as the user
+func (ls *Source) searchEntry(l *ldap.Conn, name, passwd string, directBind bool) (*entry, bool) {
+	var (
+		userDN string
+		err    error
+	)
 	if directBind {
 		glog.Errorf("LDAP will bind directly via UserDN template: %s", ls.UserDN)
 
 		var ok bool
 		userDN, ok = ls.sanitizedUserDN(name)
 		if !ok {
-			return "", "", "", "", false, false
+			return nil, false
 		}
 	} else {
 		glog.Errorf("LDAP will use BindDN.")
@@ -179,21 +228,21 @@ func (ls *Source) SearchEntry(name, passwd string, directBind bool) (string, str
 		var found bool
 		userDN, found = ls.findUserDN(l, name)
 		if !found {
-			return "", "", "", "", false, false
+			return nil, false
 		}
 	}
 
 	if directBind || !ls.AttributesInBind {
 		// binds user (checking password) before looking-up attributes in user context
-		err = bindUser(l, userDN, passwd)
+		err = ls.bindUser(l, userDN, passwd)
 		if err != nil {
-			return "", "", "", "", false, false
+			return nil, false
 		}
 	}
 
 	userFilter, ok := ls.sanitizedUserQuery(name)
 	if !ok {
-		return "", "", "", "", false, false
+		return nil, false
 	}
 
 	glog.Infof("Fetching attributes '%v', '%v', '%v', '%v' with filter %s and base %s", ls.AttributeUsername, ls.AttributeName, ls.AttributeSurname, ls.AttributeMail, userFilter, userDN)
@@ -204,7 +253,7 @@ func (ls *Source) SearchEntry(name, passwd string, directBind bool) (string, str
 	sr, err := l.Search(search)
 	if err != nil {
 		glog.Errorf("LDAP Search failed unexpectedly! (%v)", err)
-		return "", "", "", "", false, false
+		return nil, false
 	} else if len(sr.Entries) < 1 {
 		if directBind {
 			glog.Error("User filter inhibited user login.")
@@ -212,7 +261,7 @@ func (ls *Source) SearchEntry(name, passwd string, directBind bool) (string, str
 			glog.Error("LDAP Search failed unexpectedly! (0 entries)")
 		}
 
-		return "", "", "", "", false, false
+		return nil, false
 	}
 
 	username_attr := sr.Entries[0].GetAttributeValue(ls.AttributeUsername)
@@ -240,33 +289,165 @@ func (ls *Source) SearchEntry(name, passwd string, directBind bool) (string, str
 
 	if !directBind && ls.AttributesInBind {
 		// binds user (checking password) after looking-up attributes in BindDN context
-		err = bindUser(l, userDN, passwd)
+		err = ls.bindUser(l, userDN, passwd)
 		if err != nil {
-			return "", "", "", "", false, false
+			return nil, false
 		}
 	}
 
-	return username_attr, name_attr, sn_attr, mail_attr, admin_attr, true
+	return &entry{
+		dn:       userDN,
+		username: username_attr,
+		name:     name_attr,
+		surname:  sn_attr,
+		mail:     mail_attr,
+		admin:    admin_attr,
+	}, true
 }
 
-func bindUser(l *ldap.Conn, userDN, passwd string) error {
+func (ls *Source) bindUser(l *ldap.Conn, userDN, passwd string) error {
 	glog.Errorf("Binding with userDN: %s", userDN)
+	start := time.Now()
 	err := l.Bind(userDN, passwd)
+	ldapBindDuration.Since(start, ls.Name, "user")
 	if err != nil {
 		glog.Errorf("LDAP auth. failed for %s, reason: %v", userDN, err)
+		ldapBindFailures.Inc(ls.Name, "user")
 		return err
 	}
 	glog.Errorf("Bound successfully with userDN: %s", userDN)
 	return err
 }
 
+// bindService binds the connection as BindDN,
+// anonymous bind is used if BindDN is not configured
+func (ls *Source) bindService(l *ldap.Conn) error {
+	if ls.BindDN == "" || ls.BindPassword == "" {
+		glog.Errorf("Proceeding with anonymous LDAP search.")
+		return l.Bind("", "")
+	}
+	start := time.Now()
+	err := l.Bind(ls.BindDN, ls.BindPassword)
+	ldapBindDuration.Since(start, ls.Name, "service")
+	if err != nil {
+		glog.Errorf("Failed to bind as BindDN[%s]: %v", ls.BindDN, err)
+		ldapBindFailures.Inc(ls.Name, "service")
+		return err
+	}
+	glog.Errorf("Bound as BindDN %s", ls.BindDN)
+	return nil
+}
+
+// init creates the connection pool and the group cache of the source
+func (ls *Source) init() {
+	ls.initOnce.Do(func() {
+		ls.initErr = ls.loadTLS()
+		ls.pool = newConnPool(ls.PoolSize, ls.PoolIdleTimeout, poolHealthCheck, func() (*ldap.Conn, error) {
+			return ldapDial(ls)
+		}, ls.bindService)
+		if ls.GroupCacheTTL > 0 {
+			ls.groups = newGroupCache(ls.GroupCacheTTL)
+		}
+	})
+}
+
+// Close closes idle pooled connections, e.g: when the source is replaced on config reload
+func (ls *Source) Close() error {
+	ls.init()
+	ls.pool.Close()
+	return nil
+}
+
+// conn returns the connection bound as BindDN from the pool
+func (ls *Source) conn() (*ldap.Conn, error) {
+	ls.init()
+	if ls.initErr != nil {
+		return nil, ls.initErr
+	}
+	l, err := ls.pool.Get()
+	if err != nil {
+		glog.Errorf("LDAP Connect error, %s:%v", ls.Host, err)
+		ls.mu.Lock()
+		ls.Enabled = false
+		ls.mu.Unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// release returns the connection to the pool,
+// connection bound as the user is rebound as BindDN first
+func (ls *Source) release(l *ldap.Conn, userBound bool) {
+	if userBound {
+		if err := ls.bindService(l); err != nil {
+			l.Close()
+			return
+		}
+	}
+	ls.pool.Put(l)
+}
+
+// userGroups returns DNs of the groups that user is a member of
+func (ls *Source) userGroups(l *ldap.Conn, userDN string) ([]string, error) {
+	if ls.groups != nil {
+		if groups, ok := ls.groups.Get(userDN); ok {
+			ldapGroupCache.Inc(ls.Name, "hit")
+			return groups, nil
+		}
+		ldapGroupCache.Inc(ls.Name, "miss")
+	}
+
+	sr, err := l.Search(ldap.NewSearchRequest(
+		userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"memberOf"}, nil))
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	if len(sr.Entries) > 0 {
+		groups = sr.Entries[0].GetAttributeValues("memberOf")
+	}
+	if ls.groups != nil {
+		ls.groups.Set(userDN, groups)
+	}
+	return groups, nil
+}
+
+// ldapDial connects to the first reachable host of the source
 func ldapDial(ls *Source) (*ldap.Conn, error) {
+	var err error
+	for _, host := range append([]string{ls.Host}, ls.Hosts...) {
+		if host == "" {
+			continue
+		}
+		var l *ldap.Conn
+		l, err = dialHost(ls, host)
+		if err == nil {
+			return l, nil
+		}
+		glog.Errorf("Unable to connect to LDAP host %s:%d: %v", host, ls.Port, err)
+	}
+	if err == nil {
+		err = errNoHosts
+	}
+	return nil, err
+}
+
+func dialHost(ls *Source, host string) (*ldap.Conn, error) {
+	addr := fmt.Sprintf("%s:%d", host, ls.Port)
 	if ls.UseSSL {
 		glog.Errorf("Using TLS for LDAP without verifying: %v", ls.SkipVerify)
-		return ldap.DialTLS("tcp", fmt.Sprintf("%s:%d", ls.Host, ls.Port), &tls.Config{
-			InsecureSkipVerify: ls.SkipVerify,
-		})
-	} else {
-		return ldap.Dial("tcp", fmt.Sprintf("%s:%d", ls.Host, ls.Port))
+		return ldap.DialTLS("tcp", addr, ls.newTLSConfig(host))
+	}
+
+	l, err := ldap.Dial("tcp", addr)
+	if err != nil || !ls.UseStartTLS {
+		return l, err
+	}
+	glog.Errorf("Using StartTLS for LDAP without verifying: %v", ls.SkipVerify)
+	if err := l.StartTLS(ls.newTLSConfig(host)); err != nil {
+		l.Close()
+		return nil, err
 	}
+	return l, nil
 }
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+// key prefixes of tracked usernames and source IPs
+const (
+	userKeyPrefix = "user:"
+	ipKeyPrefix   = "ip:"
+)
+
+// LockoutEntry is the failure record of a username or source IP
+type LockoutEntry struct {
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"lastFailure"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+	Locked       bool      `json:"locked"`
+	Pending      int       `json:"pending"` // attempts in progress
+}
+
+// Lockout tracks failed logins per username and per source IP,
+// every failure doubles the delay before the next attempt is allowed,
+// after MaxFailures the key is locked out for LockoutTime
+type Lockout struct {
+	MaxFailures int           // count of failures before lockout
+	BaseDelay   time.Duration // delay after the first failure
+	MaxDelay    time.Duration // upper bound of the backoff delay
+	LockoutTime time.Duration // duration of the lockout
+
+	mu      sync.Mutex
+	entries map[string]*LockoutEntry
+	now     func() time.Time
+}
+
+// NewLockout creates Lockout by "auth.lockout" config
+func NewLockout(c viper.Viper) *Lockout {
+	l := &Lockout{
+		MaxFailures: c.GetInt("auth.lockout.maxFailures"),
+		BaseDelay:   time.Duration(c.GetInt("auth.lockout.baseDelay")) * time.Second,
+		MaxDelay:    time.Duration(c.GetInt("auth.lockout.maxDelay")) * time.Second,
+		LockoutTime: time.Duration(c.GetInt("auth.lockout.duration")) * time.Second,
+		entries:     map[string]*LockoutEntry{},
+		now:         time.Now,
+	}
+	if l.MaxFailures <= 0 {
+		l.MaxFailures = 5
+	}
+	if l.BaseDelay <= 0 {
+		l.BaseDelay = time.Second
+	}
+	if l.MaxDelay <= 0 {
+		l.MaxDelay = time.Minute
+	}
+	if l.LockoutTime <= 0 {
+		l.LockoutTime = 15 * time.Minute
+	}
+	return l
+}
+
+// Check returns how long the caller must wait before trying to login,
+// zero duration means login is allowed and the attempt is reserved until Fail or Succeed.
+// Reserved attempts count as failures, so parallel logins can not exceed the budget,
+// and logins of one username are tried one at a time
+func (l *Lockout) Check(username, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	keys := lockoutKeys(username, ip)
+	var wait time.Duration
+	for i, key := range keys {
+		e, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		if d := e.BlockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+		if e.Pending > 0 && (i == 0 || e.Failures+e.Pending >= l.MaxFailures) && wait < l.BaseDelay {
+			wait = l.BaseDelay
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, key := range keys {
+		l.entry(key, now).Pending++
+	}
+	return 0
+}
+
+// Fail records failed login of the username from the source IP
+func (l *Lockout) Fail(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	for _, key := range lockoutKeys(username, ip) {
+		e := l.entry(key, now)
+		e.release()
+		e.Failures++
+		e.LastFailure = now
+		if e.Failures >= l.MaxFailures {
+			e.Locked = true
+			e.BlockedUntil = now.Add(l.LockoutTime)
+			glog.Errorf("%s is locked out until %s", key, e.BlockedUntil)
+			continue
+		}
+		delay := l.BaseDelay << uint(e.Failures-1)
+		if delay > l.MaxDelay || delay <= 0 {
+			delay = l.MaxDelay
+		}
+		e.BlockedUntil = now.Add(delay)
+	}
+}
+
+// entry returns the entry of the key, counting starts from scratch after the lockout is expired
+func (l *Lockout) entry(key string, now time.Time) *LockoutEntry {
+	e, ok := l.entries[key]
+	if !ok || (e.Locked && now.After(e.BlockedUntil)) {
+		pending := 0
+		if ok {
+			pending = e.Pending
+		}
+		e = &LockoutEntry{Key: key, Pending: pending}
+		l.entries[key] = e
+	}
+	return e
+}
+
+// release ends the reserved attempt
+func (e *LockoutEntry) release() {
+	if e.Pending > 0 {
+		e.Pending--
+	}
+}
+
+// prune forgets entries that are not blocked, have no attempts in progress and did not fail for LockoutTime
+func (l *Lockout) prune(now time.Time) {
+	for k, e := range l.entries {
+		if e.Pending == 0 && now.After(e.BlockedUntil) && now.Sub(e.LastFailure) > l.LockoutTime {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// Succeed resets failures of the username after successful login from the source IP
+func (l *Lockout) Succeed(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := lockoutKeys(username, ip)
+	delete(l.entries, keys[0])
+	if e, ok := l.entries[keys[1]]; ok {
+		e.release()
+	}
+}
+
+// lockoutKeys returns keys of the username and the source IP,
+// usernames are compared case-insensitively without domain like AD does, e.g: CORP\Alice is alice
+func lockoutKeys(username, ip string) []string {
+	name, _ := splitDomain(username)
+	return []string{userKeyPrefix + strings.ToLower(name), ipKeyPrefix + ip}
+}
+
+// List returns all tracked usernames and IPs sorted by key
+func (l *Lockout) List() []LockoutEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]string, 0, len(l.entries))
+	for k := range l.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]LockoutEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, *l.entries[k])
+	}
+	return entries
+}
+
+// Clear removes the entry by its key, e.g: "user:tesla" or "ip:127.0.0.1"
+// returns false if there is no such entry
+func (l *Lockout) Clear(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; !ok {
+		return false
+	}
+	delete(l.entries, key)
+	return true
+}
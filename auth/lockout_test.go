@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Unix(1457000000, 0)
+	l := &Lockout{
+		MaxFailures: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		LockoutTime: time.Hour,
+		entries:     map[string]*LockoutEntry{},
+		now:         func() time.Time { return now },
+	}
+
+	if wait := l.Check("tesla", "10.0.0.1"); wait != 0 {
+		t.Fatalf("want no wait, got %s", wait)
+	}
+
+	testData := []struct {
+		wait   time.Duration
+		locked bool
+	}{
+		{wait: time.Second},
+		{wait: 2 * time.Second},
+		{wait: time.Hour, locked: true},
+	}
+	for _, d := range testData {
+		l.Fail("tesla", "10.0.0.1")
+		if wait := l.Check("tesla", "10.0.0.1"); wait != d.wait {
+			t.Errorf("want %s, got %s", d.wait, wait)
+		}
+	}
+
+	// the other user from the same IP is blocked too
+	if wait := l.Check("edison", "10.0.0.1"); wait != time.Hour {
+		t.Errorf("want %s, got %s", time.Hour, wait)
+	}
+	// the same user from the other IP is blocked too
+	if wait := l.Check("tesla", "10.0.0.2"); wait != time.Hour {
+		t.Errorf("want %s, got %s", time.Hour, wait)
+	}
+
+	entries := l.List()
+	if len(entries) != 2 || !entries[0].Locked || entries[0].Key != "ip:10.0.0.1" {
+		t.Fatalf("invalid entries: %+v", entries)
+	}
+
+	if !l.Clear("ip:10.0.0.1") || !l.Clear("user:tesla") {
+		t.Fatal("want entries to be cleared")
+	}
+	if wait := l.Check("tesla", "10.0.0.1"); wait != 0 {
+		t.Errorf("want no wait after clear, got %s", wait)
+	}
+	l.Succeed("tesla", "10.0.0.1")
+	if l.Clear("user:tesla") {
+		t.Error("want false for unknown entry")
+	}
+}
+
+func TestLockoutReservation(t *testing.T) {
+	now := time.Unix(1457000000, 0)
+	l := &Lockout{
+		MaxFailures: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		LockoutTime: time.Hour,
+		entries:     map[string]*LockoutEntry{},
+		now:         func() time.Time { return now },
+	}
+
+	// parallel logins of one username are tried one at a time
+	if wait := l.Check("tesla", "10.0.0.1"); wait != 0 {
+		t.Fatalf("want no wait, got %s", wait)
+	}
+	if wait := l.Check("tesla", "10.0.0.2"); wait != time.Second {
+		t.Errorf("want %s while the attempt is in progress, got %s", time.Second, wait)
+	}
+	l.Succeed("tesla", "10.0.0.1")
+
+	// parallel logins from one IP do not exceed the budget
+	for _, name := range []string{"a", "b", "c"} {
+		if wait := l.Check(name, "10.0.0.3"); wait != 0 {
+			t.Errorf("%s: want no wait, got %s", name, wait)
+		}
+	}
+	if wait := l.Check("d", "10.0.0.3"); wait == 0 {
+		t.Error("want wait after the budget of the IP is reserved, got 0")
+	}
+	l.Succeed("a", "10.0.0.3")
+	l.Succeed("b", "10.0.0.3")
+	l.Succeed("c", "10.0.0.3")
+	if wait := l.Check("d", "10.0.0.3"); wait != 0 {
+		t.Errorf("want no wait after attempts are done, got %s", wait)
+	}
+	l.Succeed("d", "10.0.0.3")
+
+	// spellings of one AD username share the budget
+	for _, name := range []string{"Edison", `CORP\edison`, "EDISON@corp.example.com"} {
+		now = now.Add(time.Minute)
+		if wait := l.Check(name, "10.0.0.4"); wait != 0 {
+			t.Errorf("%s: want no wait, got %s", name, wait)
+		}
+		l.Fail(name, "10.0.0.4")
+	}
+	if wait := l.Check("edison", "10.0.0.5"); wait != time.Hour {
+		t.Errorf("want %s, got %s", time.Hour, wait)
+	}
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
 )
@@ -13,36 +15,76 @@ type User struct {
 	Surname    string
 	IsAdmin    bool
 	GroupNames []string
+	Source     string   // backend that authenticated the user, e.g: "ldap:corp", "htpasswd"
+	Databases  []string // databases the user is restricted to, all databases if empty
+	Tenant     string   // tenant of the identity provider, tenant of the group is used if empty
+}
+
+// CanAccess checks whether the user is allowed to query the database
+func (u User) CanAccess(database string) bool {
+	if len(u.Databases) == 0 {
+		return true
+	}
+	for _, db := range u.Databases {
+		if db == database {
+			return true
+		}
+	}
+	return false
 }
 
 // Login can be used to check user id and password,
 // returns full user info if succeded
+// the whole login flow uses one pooled connection
 func (source *Source) Login(uid, password string) (User, bool) {
-	name, un, sn, mail, admin, logged := source.SearchEntry(uid, password, source.UseDBind)
+	l, err := source.conn()
+	if err != nil {
+		return User{}, false
+	}
+	defer source.release(l, true)
+
+	e, logged := source.searchEntry(l, uid, password, source.UseDBind)
 	if !logged {
 		return User{}, logged
 	}
 	u := User{
-		Email:    mail,
-		Name:     name,
-		Username: un,
-		Surname:  sn,
-		IsAdmin:  admin,
+		Email:    e.mail,
+		Name:     e.name,
+		Username: e.username,
+		Surname:  e.surname,
+		IsAdmin:  e.admin,
+		Source:   "ldap:" + source.Name,
 	}
 
-	groups, err := source.Search(source.UserBase, source.Filter, []string{"memberOf"})
+	groups, err := source.userGroups(l, e.dn)
 	if err != nil {
 		glog.Errorf("Unable to get user's groups: %s", err.Error())
 		return u, logged
 	}
+	u.GroupNames = groups
 
-	if len(groups) > 0 {
-		for _, dn := range groups[0].Attrs {
-			u.GroupNames = dn.Values
-		}
+	return u, logged
+}
+
+// Lookup finds the user and its groups as BindDN without the password,
+// it is used to explain policy decisions for the user
+func (source *Source) Lookup(uid string) (User, bool) {
+	l, err := source.conn()
+	if err != nil {
+		return User{}, false
 	}
+	defer source.release(l, false)
 
-	return u, logged
+	dn, found := source.findUserDN(l, uid)
+	if !found {
+		return User{}, false
+	}
+	groups, err := source.userGroups(l, dn)
+	if err != nil {
+		glog.Errorf("Unable to get user's groups: %s", err.Error())
+		return User{}, false
+	}
+	return User{Name: uid, Username: uid, GroupNames: groups, Source: "ldap:" + source.Name}, true
 }
 
 // NewSource can be used to create new Source object with the given params
@@ -50,7 +92,13 @@ func NewSource(c viper.Viper) *Source {
 	return &Source{
 		Name:              c.GetString("auth.ldap.name"),
 		Host:              c.GetString("auth.ldap.host"),
+		Hosts:             c.GetStringSlice("auth.ldap.hosts"),
+		Domains:           c.GetStringSlice("auth.ldap.domains"),
 		Port:              c.GetInt("auth.ldap.port"),
+		UseSSL:            c.GetBool("auth.ldap.useTLS"),
+		SkipVerify:        c.GetBool("auth.ldap.skipVerify"),
+		BindDN:            c.GetString("auth.ldap.bindDN"),
+		BindPassword:      c.GetString("auth.ldap.bindPasswd"),
 		UserBase:          c.GetString("auth.ldap.userBase"),
 		Filter:            c.GetString("auth.ldap.userFilter"),
 		UserDN:            c.GetString("auth.ldap.userDN"),
@@ -59,5 +107,14 @@ func NewSource(c viper.Viper) *Source {
 		AttributeSurname:  c.GetString("auth.ldap.attrSurname"),
 		AttributeMail:     c.GetString("auth.ldap.attrMail"),
 		UseDBind:          c.GetBool("auth.ldap.useDirectBind"),
+		UseStartTLS:       c.GetBool("auth.ldap.useStartTLS"),
+		CAFile:            c.GetString("auth.ldap.caFile"),
+		ServerName:        c.GetString("auth.ldap.serverName"),
+		MinTLSVersion:     c.GetString("auth.ldap.minTLSVersion"),
+		CertFile:          c.GetString("auth.ldap.certFile"),
+		KeyFile:           c.GetString("auth.ldap.keyFile"),
+		PoolSize:          c.GetInt("auth.ldap.poolSize"),
+		PoolIdleTimeout:   time.Duration(c.GetInt("auth.ldap.poolIdleTimeout")) * time.Second,
+		GroupCacheTTL:     time.Duration(c.GetInt("auth.ldap.groupCacheTTL")) * time.Second,
 	}
 }
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+var (
+	errInvalidIssuer   = errors.New("Token is issued by unknown issuer")
+	errInvalidAudience = errors.New("Token is issued for another audience")
+	errNoUsername      = errors.New("Token does not contain username claim")
+)
+
+// OIDC verifies ID and access tokens of the external OpenID Connect identity provider
+// by the JWKS of the issuer, loaded from the local file or URL
+type OIDC struct {
+	Issuer        string
+	Audience      string            // expected "aud" claim, not checked if empty
+	UsernameClaim string            // e.g: "preferred_username"
+	GroupsClaim   string            // e.g: "groups"
+	TenantClaim   string            // e.g: "tenant", tenant is not read if empty
+	GroupMap      map[string]string // maps IdP group names to group DNs, unmapped names are used as they are
+	JWKS          string            // URL or file path of the issuer's keys
+	Refresh       time.Duration     // keys are loaded again after this period
+
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	loaded    time.Time     // last successful load
+	attempted time.Time     // last load, successful or not
+	loading   chan struct{} // closed when the running load is finished, nil if keys are not being loaded
+}
+
+// minimal period between key loads caused by unknown kid,
+// so forged tokens can not make the shim flood the issuer
+const oidcMinRefresh = 30 * time.Second
+
+// NewOIDC creates the verifier by "auth.oidc" config, returns nil if issuer is not configured,
+// the verifier is created even if the issuer is not reachable
+func NewOIDC(c viper.Viper) (*OIDC, error) {
+	issuer := c.GetString("auth.oidc.issuer")
+	if issuer == "" {
+		return nil, nil
+	}
+	o := &OIDC{
+		Issuer:        issuer,
+		Audience:      c.GetString("auth.oidc.audience"),
+		UsernameClaim: c.GetString("auth.oidc.usernameClaim"),
+		GroupsClaim:   c.GetString("auth.oidc.groupsClaim"),
+		TenantClaim:   c.GetString("auth.oidc.tenantClaim"),
+		GroupMap:      map[string]string{},
+		JWKS:          c.GetString("auth.oidc.jwks"),
+		Refresh:       time.Duration(c.GetInt("auth.oidc.refresh")) * time.Second,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+	// group names are compared case-insensitively, as viper may lowercase keys of the map
+	for name, dn := range c.GetStringMapString("auth.oidc.groupMap") {
+		o.GroupMap[strings.ToLower(name)] = dn
+	}
+	if o.UsernameClaim == "" {
+		o.UsernameClaim = "preferred_username"
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+	if o.Refresh <= 0 {
+		o.Refresh = time.Hour
+	}
+	if o.JWKS == "" {
+		o.JWKS = strings.TrimRight(issuer, "/") + "/.well-known/jwks.json"
+	}
+	// the shim starts during an outage of the issuer, keys are loaded again on the first token
+	keys, err := o.load()
+	if err != nil {
+		glog.Errorf("Unable to load JWKS of OIDC issuer %s, retrying on tokens: %s", issuer, err.Error())
+		return o, nil
+	}
+	o.keys, o.loaded, o.attempted = keys, time.Now(), time.Now()
+	return o, nil
+}
+
+// load reads the JWKS and returns public keys by kid
+func (o *OIDC) load() (map[string]interface{}, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if strings.HasPrefix(o.JWKS, "http://") || strings.HasPrefix(o.JWKS, "https://") {
+		b, err = o.fetch(o.JWKS)
+	} else {
+		b, err = ioutil.ReadFile(o.JWKS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var set JWKSet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			glog.Errorf("Skipping OIDC key '%s': %s", k.Kid, err.Error())
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	glog.Infof("Loaded %d keys of OIDC issuer %s", len(keys), o.Issuer)
+	return keys, nil
+}
+
+func (o *OIDC) fetch(url string) ([]byte, error) {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// key returns the public key by kid, keys are loaded again if they are stale or the kid is unknown,
+// e.g: after the issuer rotated its keys.
+// Keys are fetched without the lock, requests of known kids use current keys meanwhile
+func (o *OIDC) key(kid string) (interface{}, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	stale := time.Since(o.loaded) > o.Refresh
+	if (!ok || stale) && o.loading == nil && time.Since(o.attempted) > oidcMinRefresh {
+		o.attempted = time.Now()
+		o.loading = make(chan struct{})
+		go o.reload(o.loading)
+	}
+	loading := o.loading
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// unknown kid waits for the running load
+	if loading != nil {
+		<-loading
+		o.mu.Lock()
+		key, ok = o.keys[kid]
+		o.mu.Unlock()
+	}
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+// reload swaps loaded keys into the verifier and closes done
+func (o *OIDC) reload(done chan struct{}) {
+	keys, err := o.load()
+	o.mu.Lock()
+	if err != nil {
+		// previous keys are used until the issuer is reachable again
+		glog.Errorf("Unable to reload JWKS of OIDC issuer %s: %s", o.Issuer, err.Error())
+	} else {
+		o.keys, o.loaded = keys, time.Now()
+	}
+	o.loading = nil
+	o.mu.Unlock()
+	close(done)
+}
+
+// verifyKey returns the issuer's key of the token, only asymmetric methods are accepted
+func (o *OIDC) verifyKey(t *jwt.Token) (interface{}, error) {
+	alg := t.Method.Alg()
+	if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") && !strings.HasPrefix(alg, "ES") {
+		return nil, errInvalidToken
+	}
+	kid, _ := t.Header["kid"].(string)
+	return o.key(kid)
+}
+
+// Parse verifies the token and maps its claims to the user
+func (o *OIDC) Parse(token string) (User, error) {
+	t, err := jwt.Parse(token, o.verifyKey)
+	if err != nil {
+		tokenErrors.Inc("oidc")
+		return User{}, err
+	}
+	if !t.Valid {
+		tokenErrors.Inc("oidc")
+		return User{}, errInvalidToken
+	}
+	if iss, _ := t.Claims["iss"].(string); iss != o.Issuer {
+		tokenErrors.Inc("oidc")
+		return User{}, errInvalidIssuer
+	}
+	if o.Audience != "" && !hasAudience(t.Claims["aud"], o.Audience) {
+		tokenErrors.Inc("oidc")
+		return User{}, errInvalidAudience
+	}
+
+	username, _ := t.Claims[o.UsernameClaim].(string)
+	if username == "" {
+		username, _ = t.Claims["sub"].(string)
+	}
+	if username == "" {
+		return User{}, errNoUsername
+	}
+	u := User{Username: username, Source: "oidc"}
+	u.Email, _ = t.Claims["email"].(string)
+	u.Name, _ = t.Claims["given_name"].(string)
+	u.Surname, _ = t.Claims["family_name"].(string)
+	u.GroupNames = o.groups(t.Claims[o.GroupsClaim])
+	if o.TenantClaim != "" {
+		u.Tenant, _ = t.Claims[o.TenantClaim].(string)
+	}
+	return u, nil
+}
+
+// groups maps the groups claim to group DNs
+func (o *OIDC) groups(claim interface{}) []string {
+	var names []string
+	switch v := claim.(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if name, ok := g.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	groups := make([]string, 0, len(names))
+	for _, name := range names {
+		if dn, ok := o.GroupMap[strings.ToLower(name)]; ok {
+			name = dn
+		}
+		groups = append(groups, name)
+	}
+	return groups
+}
+
+// hasAudience checks "aud" claim which is either a string or a list of strings
+func hasAudience(claim interface{}, audience string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+// testIssuer is the local stand-in of OIDC identity provider
+type testIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, kid: "idp-1"}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwk := SigningKey{ID: issuer.kid, Method: "ES256", verify: &issuer.key.PublicKey}.jwk()
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+	}))
+	return issuer
+}
+
+// token signs claims by the issuer's key
+func (i *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	token := jwt.New(jwt.SigningMethodES256)
+	token.Header["kid"] = i.kid
+	token.Claims["iss"] = i.URL
+	token.Claims["aud"] = "influxdb-shim"
+	token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	s, err := token.SignedString(i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOIDC(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	c := viper.New()
+	c.Set("auth.oidc.issuer", issuer.URL)
+	c.Set("auth.oidc.audience", "influxdb-shim")
+	c.Set("auth.oidc.groupMap", map[string]interface{}{"Wizards": "CN=Wizards,OU=Gryfinndor,DC=White,DC=com"})
+	oidc, err := NewOIDC(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := oidc.Parse(issuer.token(t, map[string]interface{}{
+		"preferred_username": "tesla",
+		"email":              "tesla@example.com",
+		"groups":             []string{"wizards", "muggles"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := User{
+		Username:   "tesla",
+		Email:      "tesla@example.com",
+		GroupNames: []string{"CN=Wizards,OU=Gryfinndor,DC=White,DC=com", "muggles"},
+		Source:     "oidc",
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("want %+v, got %+v", want, user)
+	}
+
+	testData := []struct {
+		claims map[string]interface{}
+		want   error
+	}{
+		{map[string]interface{}{"sub": "tesla", "iss": "https://evil.example.com"}, errInvalidIssuer},
+		{map[string]interface{}{"sub": "tesla", "aud": []string{"grafana"}}, errInvalidAudience},
+		{map[string]interface{}{"iat": time.Now().Unix()}, errNoUsername},
+	}
+	for _, test := range testData {
+		if _, err := oidc.Parse(issuer.token(t, test.claims)); err != test.want {
+			t.Errorf("want %v, got %v", test.want, err)
+		}
+	}
+
+	// expired tokens and tokens of unknown keys are rejected
+	if _, err := oidc.Parse(issuer.token(t, map[string]interface{}{"sub": "tesla", "exp": time.Now().Add(-time.Minute).Unix()})); err == nil {
+		t.Errorf("want error of expired token, got valid token")
+	}
+	other := newTestIssuer(t)
+	defer other.Close()
+	other.URL = issuer.URL
+	if _, err := oidc.Parse(other.token(t, map[string]interface{}{"sub": "tesla"})); err == nil {
+		t.Errorf("want error of token signed by another key, got valid token")
+	}
+}
+
+func TestOIDCUnavailableIssuer(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+	var (
+		mu    sync.Mutex
+		down  = true
+		block chan struct{} // requests wait until it is closed
+	)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		d, b := down, block
+		mu.Unlock()
+		if b != nil {
+			<-b
+		}
+		if d {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		issuer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer jwks.Close()
+
+	c := viper.New()
+	c.Set("auth.oidc.issuer", issuer.URL)
+	c.Set("auth.oidc.jwks", jwks.URL)
+	// the shim starts during an outage of the issuer
+	oidc, err := NewOIDC(*c)
+	if err != nil || oidc == nil {
+		t.Fatalf("want verifier, got %v", err)
+	}
+	token := issuer.token(t, map[string]interface{}{"sub": "tesla"})
+	if _, err := oidc.Parse(token); err == nil {
+		t.Error("want error of unknown key, got valid token")
+	}
+
+	// keys are loaded on tokens when the issuer is reachable again
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	oidc.mu.Lock()
+	oidc.attempted = time.Time{}
+	oidc.mu.Unlock()
+	if _, err := oidc.Parse(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// slow issuer does not block tokens of known keys
+	mu.Lock()
+	block = make(chan struct{})
+	mu.Unlock()
+	defer close(block)
+	oidc.mu.Lock()
+	oidc.loaded, oidc.attempted = time.Time{}, time.Time{}
+	oidc.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := oidc.Parse(token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want the known key used while keys are loaded")
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/ldap.v2"
+)
+
+// pooledConn is the LDAP connection with the time it was returned to the pool
+type pooledConn struct {
+	conn     *ldap.Conn
+	returned time.Time
+}
+
+// connPool keeps idle LDAP connections bound as the service account,
+// connections idle longer than idleTimeout are closed,
+// connections idle longer than healthCheck are checked before reuse
+type connPool struct {
+	dial        func() (*ldap.Conn, error)
+	bind        func(*ldap.Conn) error
+	idle        chan pooledConn
+	idleTimeout time.Duration
+	healthCheck time.Duration
+}
+
+func newConnPool(size int, idleTimeout, healthCheck time.Duration, dial func() (*ldap.Conn, error), bind func(*ldap.Conn) error) *connPool {
+	return &connPool{
+		dial:        dial,
+		bind:        bind,
+		idle:        make(chan pooledConn, size),
+		idleTimeout: idleTimeout,
+		healthCheck: healthCheck,
+	}
+}
+
+// Get returns idle healthy connection or dials the new one
+func (p *connPool) Get() (*ldap.Conn, error) {
+	for {
+		select {
+		case pc := <-p.idle:
+			idle := time.Since(pc.returned)
+			if p.idleTimeout > 0 && idle > p.idleTimeout {
+				pc.conn.Close()
+				continue
+			}
+			if idle > p.healthCheck && !healthy(pc.conn) {
+				glog.Errorf("Pooled LDAP connection is not healthy, closing it")
+				pc.conn.Close()
+				continue
+			}
+			return pc.conn, nil
+		default:
+			conn, err := p.dial()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.bind(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// Put returns the connection to the pool, the connection must be bound as the service account
+// connection is closed if the pool is full
+func (p *connPool) Put(conn *ldap.Conn) {
+	select {
+	case p.idle <- pooledConn{conn: conn, returned: time.Now()}:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes all idle connections
+func (p *connPool) Close() {
+	for {
+		select {
+		case pc := <-p.idle:
+			pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// healthy reads the root DSE to check that connection is alive
+func healthy(conn *ldap.Conn) bool {
+	_, err := conn.Search(ldap.NewSearchRequest(
+		"", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 5, false,
+		"(objectClass=*)", []string{"1.1"}, nil))
+	return err == nil
+}
+
+// groupCache keeps group memberships of users by their DN for a short time
+type groupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+func newGroupCache(ttl time.Duration) *groupCache {
+	return &groupCache{ttl: ttl, entries: map[string]groupCacheEntry{}}
+}
+
+func (c *groupCache) Get(userDN string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[userDN]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, userDN)
+		return nil, false
+	}
+	return e.groups, true
+}
+
+func (c *groupCache) Set(userDN string, groups []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// forget expired entries, so cache does not grow with every new user
+	for dn, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, dn)
+		}
+	}
+	c.entries[userDN] = groupCacheEntry{groups: groups, expires: now.Add(c.ttl)}
+}
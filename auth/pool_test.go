@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// fakeLDAP answers binds and searches with success and counts connections and searches
+type fakeLDAP struct {
+	net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	searches int
+}
+
+func newFakeLDAP(t *testing.T) *fakeLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{Listener: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		op := ldap.ApplicationBindResponse
+		if p.Children[1].Tag == ldap.ApplicationSearchRequest {
+			op = ldap.ApplicationSearchResultDone
+			f.mu.Lock()
+			f.searches++
+			f.mu.Unlock()
+		}
+		response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		response.AppendChild(p.Children[0])
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(op), nil, "Result")
+		result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.LDAPResultSuccess, "resultCode"))
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+		response.AppendChild(result)
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// stats returns counts of accepted connections and searches
+func (f *fakeLDAP) stats() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns), f.searches
+}
+
+// drop closes all accepted connections, e.g: LDAP server restarts
+func (f *fakeLDAP) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeLDAP) pool(size int, idleTimeout, healthCheck time.Duration) *connPool {
+	return newConnPool(size, idleTimeout, healthCheck, func() (*ldap.Conn, error) {
+		return ldap.Dial("tcp", f.Addr().String())
+	}, func(conn *ldap.Conn) error {
+		return conn.Bind("cn=service", "secret")
+	})
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	f := newFakeLDAP(t)
+	defer f.Close()
+	p := f.pool(1, time.Minute, time.Minute)
+	defer p.Close()
+
+	first, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(first)
+	// recently returned connection is reused without the health check
+	second, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Error("want the pooled connection reused, got the new one")
+	}
+	if conns, searches := f.stats(); conns != 1 || searches != 0 {
+		t.Errorf("want 1 connection and 0 health checks, got %d and %d", conns, searches)
+	}
+
+	// connection is closed if the pool is full
+	third, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(second)
+	p.Put(third)
+	if got, _ := p.Get(); got != second {
+		t.Error("want the first returned connection kept in the full pool")
+	}
+}
+
+func TestConnPoolDiscard(t *testing.T) {
+	f := newFakeLDAP(t)
+	defer f.Close()
+
+	testData := []struct {
+		name        string
+		idleTimeout time.Duration
+		drop        bool
+		reused      bool
+		dials       int
+		searches    int
+	}{
+		// healthy connection is checked and reused
+		{"healthy", time.Minute, false, true, 1, 1},
+		// broken connection fails the health check before reaching the server and is replaced by the new one
+		{"broken", time.Minute, true, false, 2, 0},
+		// connection idle longer than the timeout is closed without the health check
+		{"idle", time.Millisecond, false, false, 2, 0},
+	}
+	for _, d := range testData {
+		p := f.pool(1, d.idleTimeout, 0)
+		conns, searches := f.stats()
+		first, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put(first)
+		if d.drop {
+			f.drop()
+		}
+		time.Sleep(10 * time.Millisecond)
+		second, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused := second == first; reused != d.reused {
+			t.Errorf("%s: want connection reused %v, got %v", d.name, d.reused, reused)
+		}
+		dials, checks := f.stats()
+		if dials-conns != d.dials || checks-searches != d.searches {
+			t.Errorf("%s: want %d dials and %d health checks, got %d and %d", d.name, d.dials, d.searches, dials-conns, checks-searches)
+		}
+		second.Close()
+		p.Close()
+	}
+}
+
+func TestSourceConnFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	// concurrent logins to the unreachable source disable it together
+	s := &Source{Host: "127.0.0.1", Port: port, Enabled: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.conn(); err == nil {
+				t.Error("want error of unreachable source, got nil")
+			}
+		}()
+	}
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Enabled {
+		t.Error("want the source disabled, got enabled")
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	c := newGroupCache(20 * time.Millisecond)
+	groups := []string{"CN=Devs,OU=Eng,DC=example,DC=com"}
+	c.Set("uid=tesla", groups)
+	if got, ok := c.Get("uid=tesla"); !ok || !reflect.DeepEqual(got, groups) {
+		t.Errorf("want %v, got %v", groups, got)
+	}
+	if _, ok := c.Get("uid=newton"); ok {
+		t.Error("want miss of unknown user, got hit")
+	}
+
+	// expired entries are not returned
+	time.Sleep(30 * time.Millisecond)
+	if got, ok := c.Get("uid=tesla"); ok {
+		t.Errorf("want miss of expired entry, got %v", got)
+	}
+
+	// expired entries of other users are forgotten by Set, new memberships replace cached ones
+	c.Set("uid=tesla", groups)
+	c.Set("uid=newton", groups)
+	time.Sleep(30 * time.Millisecond)
+	c.Set("uid=newton", nil)
+	if _, ok := c.entries["uid=tesla"]; ok || len(c.entries) != 1 {
+		t.Errorf("want expired entries removed, got %v", c.entries)
+	}
+	if got, ok := c.Get("uid=newton"); !ok || got != nil {
+		t.Errorf("want replaced memberships, got %v", got)
+	}
+}
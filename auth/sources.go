@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+var errNoSources = errors.New("LDAP sources list must not be empty")
+
+// Sources is the ordered list of LDAP sources
+type Sources []*Source
+
+// NewSources creates sources from "auth.sources" list of config,
+// single "auth.ldap" source is used if the list is not configured
+func NewSources(c viper.Viper) (Sources, error) {
+	if !c.IsSet("auth.sources") {
+		return Sources{NewSource(c)}, nil
+	}
+
+	var list []map[string]interface{}
+	if err := c.UnmarshalKey("auth.sources", &list); err != nil {
+		glog.Error("cannot unmarshal LDAP sources")
+		return nil, err
+	}
+	// usernames without known domain go to the first source, so there must be one
+	if len(list) == 0 {
+		return nil, errNoSources
+	}
+	sources := make(Sources, 0, len(list))
+	for _, s := range list {
+		// every source is configured by the same keys as "auth.ldap"
+		sc := viper.New()
+		for k, v := range s {
+			sc.Set("auth.ldap."+k, v)
+		}
+		sources = append(sources, NewSource(*sc))
+	}
+	return sources, nil
+}
+
+// splitDomain splits "user@corp" and "CORP\user" usernames to user and domain
+func splitDomain(username string) (string, string) {
+	if i := strings.LastIndex(username, "@"); i > 0 {
+		return username[:i], username[i+1:]
+	}
+	if i := strings.Index(username, `\`); i > 0 {
+		return username[i+1:], username[:i]
+	}
+	return username, ""
+}
+
+// route returns the source of the domain
+func (s Sources) route(domain string) (*Source, bool) {
+	for _, source := range s {
+		for _, d := range source.Domains {
+			if strings.EqualFold(d, domain) {
+				return source, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// source returns the source of the user and the username to send to it,
+// usernames without known domain go to the default source only,
+// so a wrong password is never tried against every directory and does not lock accounts in other domains
+func (s Sources) source(uid string) (*Source, string) {
+	name, domain := splitDomain(uid)
+	if domain != "" {
+		if source, ok := s.route(domain); ok {
+			return source, name
+		}
+	}
+	return s.defaultSource(), uid
+}
+
+// defaultSource returns the first source without routed domains, or the first source if every source has them
+func (s Sources) defaultSource() *Source {
+	for _, source := range s {
+		if len(source.Domains) == 0 {
+			return source
+		}
+	}
+	return s[0]
+}
+
+// Login authenticates the user by the source of the user's domain
+func (s Sources) Login(uid, password string) (User, bool) {
+	source, name := s.source(uid)
+	glog.Infof("User '%s' is routed to LDAP source '%s'", uid, source.Name)
+	return source.Login(name, password)
+}
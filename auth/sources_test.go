@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSplitDomain(t *testing.T) {
+	testData := []struct {
+		uid    string
+		name   string
+		domain string
+	}{
+		{uid: "tesla@corp", name: "tesla", domain: "corp"},
+		{uid: `CORP\tesla`, name: "tesla", domain: "CORP"},
+		{uid: "tesla", name: "tesla", domain: ""},
+	}
+	for _, d := range testData {
+		name, domain := splitDomain(d.uid)
+		if name != d.name || domain != d.domain {
+			t.Errorf("want %s and %s, got %s and %s", d.name, d.domain, name, domain)
+		}
+	}
+}
+
+func TestNewSources(t *testing.T) {
+	testData := []struct {
+		config  string
+		sources int
+		err     error
+	}{
+		{"", 1, nil},
+		{"[[auth.sources]]\nname = \"corp\"\nhosts = [\"corp:389\"]\n[[auth.sources]]\nname = \"lab\"\nhosts = [\"lab:389\"]\n", 2, nil},
+		{"[auth]\nsources = []\n", 0, errNoSources},
+	}
+	for _, d := range testData {
+		c := viper.New()
+		c.SetConfigType("toml")
+		if err := c.ReadConfig(bytes.NewBufferString(d.config)); err != nil {
+			t.Fatal(err)
+		}
+		sources, err := NewSources(*c)
+		if err != d.err || len(sources) != d.sources {
+			t.Errorf("%q: want %d sources and %v, got %d and %v", d.config, d.sources, d.err, len(sources), err)
+		}
+		for _, s := range sources {
+			s.Close()
+		}
+	}
+}
+
+func TestSourcesRouting(t *testing.T) {
+	corp := &Source{Name: "corp", Domains: []string{"corp"}}
+	lab := &Source{Name: "lab", Domains: []string{"lab", "research"}}
+	main := &Source{Name: "main"}
+
+	testData := []struct {
+		sources Sources
+		uid     string
+		source  string
+		name    string
+	}{
+		{Sources{corp, lab, main}, "tesla@corp", "corp", "tesla"},
+		{Sources{corp, lab, main}, `RESEARCH\tesla`, "lab", "tesla"},
+		// usernames without known domain go only to the default source
+		{Sources{corp, lab, main}, "tesla", "main", "tesla"},
+		{Sources{corp, lab, main}, "tesla@unknown", "main", "tesla@unknown"},
+		{Sources{corp, lab}, "tesla", "corp", "tesla"},
+		{Sources{main}, "tesla@corp", "main", "tesla@corp"},
+	}
+	for _, d := range testData {
+		source, name := d.sources.source(d.uid)
+		if source.Name != d.source || name != d.name {
+			t.Errorf("%s: want %s of %s, got %s of %s", d.uid, d.name, d.source, name, source.Name)
+		}
+	}
+}
+
+func TestLDAPDialFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	testData := []struct {
+		host  string
+		hosts []string
+		err   bool
+	}{
+		{"127.0.0.1", nil, false},
+		// fallback hosts are tried in order when the host is not reachable
+		{"127.0.0.2", []string{"127.0.0.3", "127.0.0.1"}, false},
+		{"", []string{"127.0.0.1"}, false},
+		{"127.0.0.2", []string{"127.0.0.3"}, true},
+		{"", nil, true},
+	}
+	for _, d := range testData {
+		l, err := ldapDial(&Source{Host: d.host, Hosts: d.hosts, Port: port})
+		if (err != nil) != d.err {
+			t.Errorf("%s %v: want error %v, got %v", d.host, d.hosts, d.err, err)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+}
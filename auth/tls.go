@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/tls"
+
+	"github.com/Maksadbek/influxdb-shim/util"
+	"github.com/golang/glog"
+)
+
+// loadTLS reads CA bundle and client certificate of the source,
+// it is called once when the source is initialized
+func (ls *Source) loadTLS() error {
+	if ls.CAFile != "" {
+		pool, err := util.LoadCertPool(ls.CAFile)
+		if err != nil {
+			glog.Errorf("Unable to load LDAP CA file %s: %v", ls.CAFile, err)
+			return err
+		}
+		ls.rootCAs = pool
+	}
+	if ls.CertFile != "" || ls.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(ls.CertFile, ls.KeyFile)
+		if err != nil {
+			glog.Errorf("Unable to load LDAP client certificate: %v", err)
+			return err
+		}
+		ls.certs = []tls.Certificate{cert}
+	}
+	version, err := util.TLSVersion(ls.MinTLSVersion)
+	if err != nil {
+		return err
+	}
+	ls.minVersion = version
+	return nil
+}
+
+// newTLSConfig returns TLS config to connect to the host,
+// host is verified by ServerName if it is set
+func (ls *Source) newTLSConfig(host string) *tls.Config {
+	serverName := ls.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            ls.rootCAs,
+		Certificates:       ls.certs,
+		MinVersion:         ls.minVersion,
+		InsecureSkipVerify: ls.SkipVerify,
+	}
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes the self-signed certificate and its key into the dir
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldap-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeKeyPair(t, dir)
+	missing := filepath.Join(dir, "missing.pem")
+
+	testData := []struct {
+		source *Source
+		err    bool
+	}{
+		{&Source{}, false},
+		{&Source{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinTLSVersion: "1.2"}, false},
+		{&Source{CAFile: missing}, true},
+		{&Source{CAFile: keyFile}, true},
+		{&Source{CertFile: certFile}, true},
+		{&Source{CertFile: certFile, KeyFile: missing}, true},
+		{&Source{MinTLSVersion: "1.9"}, true},
+	}
+	for i, d := range testData {
+		if err := d.source.loadTLS(); (err != nil) != d.err {
+			t.Errorf("%d: want error %v, got %v", i, d.err, err)
+		}
+	}
+
+	s := &Source{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinTLSVersion: "1.2"}
+	if err := s.loadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	config := s.newTLSConfig("10.0.0.1")
+	if config.ServerName != "10.0.0.1" || config.MinVersion != tls.VersionTLS12 || len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("want config of 10.0.0.1 with TLS 1.2, client certificate and CAs, got %+v", config)
+	}
+	// the host is verified by ServerName if it is set
+	s.ServerName = "ldap.example.com"
+	if config := s.newTLSConfig("10.0.0.1"); config.ServerName != "ldap.example.com" {
+		t.Errorf("want ldap.example.com, got %s", config.ServerName)
+	}
+}
@@ -1,55 +1,387 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Maksadbek/influxdb-shim/metrics"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
 )
 
+// kid of the key configured by "auth.token.privKeyPath" and "auth.token.pubKeyPath"
+const defaultKeyID = "default"
+
 var (
-	errInvalidToken = errors.New("Invalid Token")
+	errInvalidToken   = errors.New("Invalid Token")
+	errUnknownKey     = errors.New("Token is signed by unknown or retired key")
+	errNoSigningKey   = errors.New("Signing key with such kid does not exist")
+	errNoPrivateKey   = errors.New("Signing key does not have a private key")
+	errActiveRetiring = errors.New("Active signing key can not be retired")
+	errNoKeyState     = errors.New("Signing keys are rotated in config, auth.token.statePath is not set")
 )
 
+var tokenErrors = metrics.NewCounter("shim_token_errors_total", "Count of token signing and parsing errors.", "op")
+
+// SigningKey is the key of the keyset identified by kid header of tokens
+type SigningKey struct {
+	ID      string      `json:"kid"`
+	Method  string      `json:"alg"`
+	Active  bool        `json:"active"`  // new tokens are signed by this key
+	Retired bool        `json:"retired"` // tokens of the key are not accepted anymore
+	priv    []byte      // PEM encoded private key or HMAC secret
+	pub     []byte      // PEM encoded public key or HMAC secret
+	sign    interface{} // parsed private key of the method
+	verify  interface{} // parsed public key of the method
+}
+
+// parse parses PEM keys of RSA and ECDSA methods, ECDSA methods do not accept PEM bytes
+func (k *SigningKey) parse() error {
+	var err error
+	switch {
+	case strings.HasPrefix(k.Method, "RS"), strings.HasPrefix(k.Method, "PS"):
+		if k.priv != nil {
+			if k.sign, err = jwt.ParseRSAPrivateKeyFromPEM(k.priv); err != nil {
+				return err
+			}
+		}
+		k.verify, err = jwt.ParseRSAPublicKeyFromPEM(k.pub)
+	case strings.HasPrefix(k.Method, "ES"):
+		if k.priv != nil {
+			if k.sign, err = jwt.ParseECPrivateKeyFromPEM(k.priv); err != nil {
+				return err
+			}
+		}
+		k.verify, err = jwt.ParseECPublicKeyFromPEM(k.pub)
+	default:
+		if k.priv != nil {
+			k.sign = k.priv
+		}
+		k.verify = k.pub
+	}
+	return err
+}
+
+// Signer signs tokens by the active key and verifies them by any non-retired key
 type Signer struct {
-	PrivKey []byte // private key to sign in
-	PubKey  []byte // public key to verify
-	TTL     int    // time to live of the token(expiration period), in minutes
-	Method  string
+	TTL    int    // time to live of the token(expiration period), in minutes
+	Method string // default method of keys
+
+	mu        sync.RWMutex
+	keys      map[string]*SigningKey
+	active    string
+	statePath string // keys activated and retired by admin API, they are not changed if empty
+}
+
+// keyState is the state of keys changed by admin API,
+// it is saved to "auth.token.statePath" file, so it survives reloads and restarts
+type keyState struct {
+	Active  string   `json:"active"`
+	Retired []string `json:"retired"`
 }
 
+// keyConfig is the item of "auth.token.keys" config
+type keyConfig struct {
+	Kid         string
+	Method      string // "auth.token.method" if empty
+	PrivKeyPath string
+	PubKeyPath  string
+	Retired     bool
+}
+
+// NewSigner creates the signer with the single key
 func NewSigner(privKey, pubKey []byte, method string, ttl int) *Signer {
+	key := &SigningKey{ID: defaultKeyID, Method: method, Active: true, priv: privKey, pub: pubKey}
+	if err := key.parse(); err != nil {
+		glog.Errorf("Unable to parse signing key: %s", err.Error())
+	}
 	return &Signer{
-		PrivKey: privKey,
-		PubKey:  pubKey,
-		Method:  method,
-		TTL:     ttl,
+		Method: method,
+		TTL:    ttl,
+		keys:   map[string]*SigningKey{defaultKeyID: key},
+		active: defaultKeyID,
+	}
+}
+
+// NewSignerFromConfig creates the signer by "auth.token" config
+func NewSignerFromConfig(c viper.Viper) (*Signer, error) {
+	s := &Signer{
+		Method: c.GetString("auth.token.method"),
+		TTL:    c.GetInt("auth.token.ttl"),
+	}
+	return s, s.Reload(c)
+}
+
+// Reload reads the keyset again, e.g: after the new key is added to the config
+// the keyset is configured by "auth.token.privKeyPath" and "auth.token.pubKeyPath" key with "default" kid
+// and "auth.token.keys" list, the key used for signing is selected by "auth.token.activeKey"
+func (s *Signer) Reload(c viper.Viper) error {
+	commit, err := s.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload loads the keyset of the config without swapping it in,
+// the returned function swaps it, so keys are changed together with the rest of the config
+func (s *Signer) PrepareReload(c viper.Viper) (func(), error) {
+	var list []keyConfig
+	if err := c.UnmarshalKey("auth.token.keys", &list); err != nil {
+		glog.Error("cannot unmarshal signing keys")
+		return nil, err
+	}
+	if c.GetString("auth.token.pubKeyPath") != "" {
+		list = append(list, keyConfig{
+			Kid:         defaultKeyID,
+			PrivKeyPath: c.GetString("auth.token.privKeyPath"),
+			PubKeyPath:  c.GetString("auth.token.pubKeyPath"),
+		})
+	}
+
+	keys := map[string]*SigningKey{}
+	for _, k := range list {
+		key := &SigningKey{ID: k.Kid, Method: k.Method, Retired: k.Retired}
+		if key.Method == "" {
+			key.Method = s.Method
+		}
+		if jwt.GetSigningMethod(key.Method) == nil {
+			return nil, fmt.Errorf("unknown signing method of key %s: %s", k.Kid, key.Method)
+		}
+		var err error
+		// keys without private key are used only to verify tokens issued before rotation
+		if k.PrivKeyPath != "" {
+			if key.priv, err = ioutil.ReadFile(k.PrivKeyPath); err != nil {
+				return nil, err
+			}
+		}
+		if key.pub, err = ioutil.ReadFile(k.PubKeyPath); err != nil {
+			return nil, err
+		}
+		if err := key.parse(); err != nil {
+			return nil, fmt.Errorf("unable to parse signing key %s: %s", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	active := c.GetString("auth.token.activeKey")
+	if active == "" {
+		active = defaultKeyID
+	}
+	// keys activated and retired by admin API override the config
+	statePath := c.GetString("auth.token.statePath")
+	state, err := readKeyState(statePath)
+	if err != nil {
+		glog.Errorf("Unable to read signing keys state: %s", err.Error())
+		return nil, err
+	}
+	if state != nil {
+		if key, ok := keys[state.Active]; ok && key.sign != nil {
+			active = state.Active
+		}
+		for _, kid := range state.Retired {
+			if key, ok := keys[kid]; ok {
+				key.Retired = true
+			}
+		}
+	}
+	key, ok := keys[active]
+	if !ok {
+		return nil, errNoSigningKey
+	}
+	if key.sign == nil {
+		return nil, errNoPrivateKey
+	}
+	key.Active, key.Retired = true, false
+
+	return func() {
+		s.mu.Lock()
+		s.keys, s.active, s.statePath = keys, active, statePath
+		s.mu.Unlock()
+		glog.Infof("Loaded %d signing keys, active key is '%s'", len(keys), active)
+	}, nil
+}
+
+// Activate makes the key active, new tokens are signed by it
+func (s *Signer) Activate(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[kid]
+	if !ok {
+		return errNoSigningKey
+	}
+	if key.sign == nil {
+		return errNoPrivateKey
 	}
+	if err := s.save(kid, ""); err != nil {
+		return err
+	}
+	s.keys[s.active].Active = false
+	key.Active, key.Retired = true, false
+	s.active = kid
+	glog.Infof("Signing key '%s' is activated", kid)
+	return nil
+}
+
+// Retire stops accepting tokens signed by the key
+func (s *Signer) Retire(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[kid]
+	if !ok {
+		return errNoSigningKey
+	}
+	if key.Active {
+		return errActiveRetiring
+	}
+	if err := s.save(s.active, kid); err != nil {
+		return err
+	}
+	key.Retired = true
+	glog.Infof("Signing key '%s' is retired", kid)
+	return nil
+}
+
+// save writes the state of keys with the active key and one more retired key,
+// must be called with the lock held
+func (s *Signer) save(active, retired string) error {
+	if s.statePath == "" {
+		return errNoKeyState
+	}
+	state := keyState{Active: active, Retired: []string{}}
+	for kid, key := range s.keys {
+		if kid != active && (key.Retired || kid == retired) {
+			state.Retired = append(state.Retired, kid)
+		}
+	}
+	sort.Strings(state.Retired)
+	b, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.statePath), ".signing-keys")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.statePath)
+}
+
+// readKeyState reads the state of keys, returns nil if the path is empty or the file does not exist
+func readKeyState(path string) (*keyState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state keyState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Keys returns the keyset sorted by kid
+func (s *Signer) Keys() []SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]SigningKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Sort(byKeyID(keys))
+	return keys
 }
 
+type byKeyID []SigningKey
+
+func (k byKeyID) Len() int           { return len(k) }
+func (k byKeyID) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byKeyID) Less(i, j int) bool { return k[i].ID < k[j].ID }
+
 // Sign can be used to get signed token of user
 func (s *Signer) Sign(user User) (string, error) {
+	s.mu.RLock()
+	key := *s.keys[s.active]
+	s.mu.RUnlock()
 
-	t := jwt.New(jwt.GetSigningMethod(s.Method))
+	t := jwt.New(jwt.GetSigningMethod(key.Method))
+	t.Header["kid"] = key.ID
 	t.Claims["email"] = user.Email
 	t.Claims["name"] = user.Name
 	t.Claims["username"] = user.Username
 	t.Claims["surname"] = user.Surname
 	t.Claims["isAdmin"] = user.IsAdmin
+	t.Claims["groups"] = user.GroupNames
+	t.Claims["source"] = user.Source
+	if user.Tenant != "" {
+		t.Claims["tenant"] = user.Tenant
+	}
+	if s.TTL > 0 {
+		t.Claims["exp"] = time.Now().Add(time.Duration(s.TTL) * time.Minute).Unix()
+	}
 
-	return t.SignedString(s.PrivKey)
+	tokenString, err := t.SignedString(key.sign)
+	if err != nil {
+		tokenErrors.Inc("sign")
+	}
+	return tokenString, err
+}
+
+// verifyKey returns the public key of the token's kid,
+// tokens without kid were issued before keyset and are verified by the default key
+func (s *Signer) verifyKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyID
+	}
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	s.mu.RUnlock()
+	if !ok || key.Retired {
+		return nil, errUnknownKey
+	}
+	// the method must be the method of the key, e.g: RSA public key must not be used as HMAC secret
+	if t.Method.Alg() != key.Method {
+		return nil, errInvalidToken
+	}
+	return key.verify, nil
 }
 
 func (s *Signer) Parse(token string) (User, error) {
 	var u User
-	t, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		return s.PubKey, nil
-	})
+	t, err := jwt.Parse(token, s.verifyKey)
 
 	if err != nil {
+		tokenErrors.Inc("parse")
 		return u, err
 	}
 
 	if !t.Valid {
+		tokenErrors.Inc("parse")
 		return u, errInvalidToken
 	}
 
@@ -60,5 +392,15 @@ func (s *Signer) Parse(token string) (User, error) {
 		Surname:  t.Claims["surname"].(string),
 		IsAdmin:  t.Claims["isAdmin"].(bool),
 	}
+	// claims added later are optional, so older tokens are still valid
+	u.Source, _ = t.Claims["source"].(string)
+	u.Tenant, _ = t.Claims["tenant"].(string)
+	if groups, ok := t.Claims["groups"].([]interface{}); ok {
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				u.GroupNames = append(u.GroupNames, name)
+			}
+		}
+	}
 	return u, nil
 }
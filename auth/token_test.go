@@ -1,8 +1,20 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
 )
 
 // test public key
@@ -38,6 +50,11 @@ var testUser User = User{
 	Username: "testUsername",
 	Surname:  "testSurname",
 	IsAdmin:  false,
+	GroupNames: []string{
+		"CN=Wizards,OU=Gryfinndor,DC=White,DC=com",
+	},
+	Source: "forumsys",
+	Tenant: "acme",
 }
 
 func BenchmarkSign(b *testing.B) {
@@ -96,3 +113,154 @@ func TestToken(t *testing.T) {
 		t.Errorf("want %+v, got %+v", testUser, user)
 	}
 }
+
+func TestKeyRotation(t *testing.T) {
+	signer := NewSigner(
+		[]byte(privKey),
+		[]byte(pubKey),
+		method,
+		10,
+	)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.keys["2016-03"] = &SigningKey{
+		ID:     "2016-03",
+		Method: method,
+		priv:   pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		pub:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}),
+	}
+	if err := signer.keys["2016-03"].parse(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer.statePath = filepath.Join(dir, "signing-keys.json")
+
+	oldToken, err := signer.Sign(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Retire(defaultKeyID); err != errActiveRetiring {
+		t.Errorf("want %v, got %v", errActiveRetiring, err)
+	}
+	if err := signer.Activate("2016-03"); err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := signer.Sign(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(signer.JWKS().Keys); got != 2 {
+		t.Errorf("want 2 published keys, got %d", got)
+	}
+
+	// tokens of the previous key are valid until it is retired
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := signer.Parse(token); err != nil {
+			t.Errorf("want valid token, got %v", err)
+		}
+	}
+	if err := signer.Retire(defaultKeyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Parse(oldToken); err == nil {
+		t.Errorf("want error of retired key, got valid token")
+	}
+	if _, err := signer.Parse(newToken); err != nil {
+		t.Errorf("want valid token, got %v", err)
+	}
+	jwks := signer.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "2016-03" || jwks.Keys[0].Kty != "RSA" {
+		t.Errorf("want only 2016-03 RSA key, got %+v", jwks.Keys)
+	}
+
+	// public key must not be accepted as HMAC secret
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Header["kid"] = "2016-03"
+	forged.Claims["username"] = "mallory"
+	forgedString, err := forged.SignedString(signer.keys["2016-03"].pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Parse(forgedString); err == nil {
+		t.Errorf("want error of forged token, got valid token")
+	}
+}
+
+func TestKeyStatePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	priv, pub := filepath.Join(dir, "priv.pem"), filepath.Join(dir, "pub.pem")
+	if err := ioutil.WriteFile(priv, []byte(privKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pub, []byte(pubKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := func(statePath string) viper.Viper {
+		c := viper.New()
+		c.SetConfigType("toml")
+		err := c.ReadConfig(bytes.NewBufferString(fmt.Sprintf(`
+[auth.token]
+    method = "RS256"
+    privKeyPath = %q
+    pubKeyPath = %q
+    statePath = %q
+[[auth.token.keys]]
+    kid = "2016-03"
+    privKeyPath = %q
+    pubKeyPath = %q
+`, priv, pub, statePath, priv, pub)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *c
+	}
+
+	// keys are rotated only in config without the state file
+	signer, err := NewSignerFromConfig(config(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Activate("2016-03"); err != errNoKeyState {
+		t.Errorf("want %v, got %v", errNoKeyState, err)
+	}
+
+	// keys changed by admin API survive reloads and restarts
+	c := config(filepath.Join(dir, "signing-keys.json"))
+	signer, err = NewSignerFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Activate("2016-03"); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Retire(defaultKeyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewSignerFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Signer{signer, restarted} {
+		keys := s.Keys()
+		if len(keys) != 2 || !keys[0].Active || keys[0].ID != "2016-03" || !keys[1].Retired {
+			t.Errorf("want active 2016-03 and retired default key, got %+v", keys)
+		}
+	}
+}
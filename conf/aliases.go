@@ -0,0 +1,92 @@
+package conf
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// Alias maps the virtual name that users see to the physical name of InfluxDB
+type Alias struct {
+	Virtual  string `toml:"virtual" json:"virtual"`
+	Physical string `toml:"physical" json:"physical"`
+}
+
+// Aliases keep virtual database and measurement names,
+// names without aliases are the same in both directions
+type Aliases struct {
+	databases           map[string]string // virtual to physical
+	measurements        map[string]string
+	virtualDatabases    map[string]string // physical to virtual
+	virtualMeasurements map[string]string
+}
+
+// NewAliases reads [[aliases.databases]] and [[aliases.measurements]] of the config,
+// every physical name can have only one virtual name, so results can be mapped back
+func NewAliases(c viper.Viper) (*Aliases, error) {
+	var databases, measurements []Alias
+	if err := c.UnmarshalKey("aliases.databases", &databases); err != nil {
+		return nil, err
+	}
+	if err := c.UnmarshalKey("aliases.measurements", &measurements); err != nil {
+		return nil, err
+	}
+	a := &Aliases{}
+	var err error
+	if a.databases, a.virtualDatabases, err = aliasMaps("database", databases); err != nil {
+		return nil, err
+	}
+	if a.measurements, a.virtualMeasurements, err = aliasMaps("measurement", measurements); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func aliasMaps(kind string, aliases []Alias) (map[string]string, map[string]string, error) {
+	physical, virtual := map[string]string{}, map[string]string{}
+	for _, a := range aliases {
+		if a.Virtual == "" || a.Physical == "" {
+			return nil, nil, fmt.Errorf("%s alias must have virtual and physical names", kind)
+		}
+		if _, ok := physical[a.Virtual]; ok {
+			return nil, nil, fmt.Errorf("duplicate virtual %s: %s", kind, a.Virtual)
+		}
+		if _, ok := virtual[a.Physical]; ok {
+			return nil, nil, fmt.Errorf("physical %s %s has more than one virtual name", kind, a.Physical)
+		}
+		physical[a.Virtual], virtual[a.Physical] = a.Physical, a.Virtual
+	}
+	return physical, virtual, nil
+}
+
+// Empty checks whether there are no aliases
+func (a *Aliases) Empty() bool {
+	return len(a.databases) == 0 && len(a.measurements) == 0
+}
+
+// Database returns the physical name of the database
+func (a *Aliases) Database(name string) string {
+	return lookupAlias(a.databases, name)
+}
+
+// Measurement returns the physical name of the measurement
+func (a *Aliases) Measurement(name string) string {
+	return lookupAlias(a.measurements, name)
+}
+
+// VirtualDatabase returns the virtual name of the physical database
+func (a *Aliases) VirtualDatabase(name string) string {
+	return lookupAlias(a.virtualDatabases, name)
+}
+
+// VirtualMeasurement returns the virtual name of the physical measurement
+func (a *Aliases) VirtualMeasurement(name string) string {
+	return lookupAlias(a.virtualMeasurements, name)
+}
+
+func lookupAlias(m map[string]string, name string) string {
+	if alias, ok := m[name]; ok {
+		return alias
+	}
+	return name
+}
@@ -2,7 +2,9 @@ package conf
 
 import (
 	"fmt"
+	"regexp"
 
+	"github.com/Maksadbek/influxdb-shim/query"
 	"github.com/Maksadbek/influxdb-shim/util"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
@@ -11,14 +13,56 @@ import (
 // Groups type is the slice of Group
 type Groups map[string]Group
 
+// modes of group queries
+const (
+	ModeDeny  = "deny"  // queries are denied, others are allowed
+	ModeAllow = "allow" // only queries matching templates are allowed
+)
+
 // Group contains the group infos, include CN(common name) and OU(org unit)
+// Queries are denied by default, in allow mode they are the only allowed query templates
 type Group struct {
-	OU      string   `toml:"ou"`
-	DC      string   `soml:"dc"`
-	CN      string   `toml:"cn"`
-	Queries []string `toml:"queries"`
+	OU      string   `toml:"ou" json:"ou"`
+	DC      string   `toml:"dc" json:"dc"`
+	CN      string   `toml:"cn" json:"cn"`
+	Mode    string   `toml:"mode" json:"mode,omitempty"`
+	Queries []string `toml:"queries" json:"queries"`
+	// classes of statements the group can run, DefaultPrivileges if empty
+	Privileges []string `toml:"privileges" json:"privileges,omitempty"`
+	// databases of the group members are prefixed with the tenant id
+	Tenant string `toml:"tenant" json:"tenant,omitempty"`
+	// tag and field values hidden from the group members in results
+	Redactions []Redaction `toml:"redactions" json:"redactions,omitempty"`
+
+	templates []*query.Template // compiled queries of the allowlist group
+	compiled  bool
+}
+
+// actions of redaction rules
+const (
+	RedactDrop = "drop" // column or tag is removed
+	RedactHash = "hash" // value is replaced by its keyed HMAC, equal values have equal hashes
+	RedactMask = "mask" // matches of the pattern are replaced by the mask
+)
+
+// Redaction is the rule hiding values of the tag or field key
+type Redaction struct {
+	Measurement string `toml:"measurement" json:"measurement,omitempty"` // all measurements if empty
+	Key         string `toml:"key" json:"key"`                           // tag or field key
+	Action      string `toml:"action" json:"action"`                     // drop, hash or mask
+	Pattern     string `toml:"pattern" json:"pattern,omitempty"`         // regex of masked parts, whole value if empty
+	Mask        string `toml:"mask" json:"mask,omitempty"`               // "***" if empty
+}
+
+// Matches checks whether the rule is applied to the key of the measurement
+func (r Redaction) Matches(measurement, key string) bool {
+	return r.Key == key && (r.Measurement == "" || r.Measurement == measurement)
 }
 
+// DefaultPrivileges are granted to groups without privileges,
+// destructive statements are denied unless they are granted explicitly
+var DefaultPrivileges = []string{string(query.Read), string(query.SchemaRead)}
+
 // GetFullname receives domain component and retuns full LDAP name of the group,
 // e.g: CN=Global group,OU:Linux Foundation,DC=awk,DC=sed,DC=com
 func (g Group) GetFullname() string {
@@ -39,6 +83,103 @@ func (g Group) HasQuery(query string) bool {
 	return false
 }
 
+// IsAllowlist checks whether queries of the group are the allowlist
+func (g Group) IsAllowlist() bool {
+	return g.Mode == ModeAllow
+}
+
+// Allows matches the query with query templates of the group,
+// returns the template that is matched
+func (g Group) Allows(q string) (string, bool) {
+	if !g.compiled {
+		// the group is not created by NewGroups or Add, e.g: the literal
+		g.compile()
+	}
+	for _, t := range g.templates {
+		if _, ok := t.Match(q); ok {
+			return t.Text, true
+		}
+	}
+	return "", false
+}
+
+// compile compiles query templates of the allowlist group once, so queries are not tokenized on every request
+func (g *Group) compile() {
+	g.templates, g.compiled = nil, true
+	if !g.IsAllowlist() {
+		return
+	}
+	for _, text := range g.Queries {
+		t, err := query.Compile(text)
+		if err != nil {
+			glog.Errorf("Invalid query template '%s': %s", text, err.Error())
+			continue
+		}
+		g.templates = append(g.templates, t)
+	}
+}
+
+// Grants checks whether the group has the privilege
+func (g Group) Grants(p query.Privilege) bool {
+	privileges := g.Privileges
+	if len(privileges) == 0 {
+		privileges = DefaultPrivileges
+	}
+	for _, name := range privileges {
+		if name == string(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the mode and query templates of the group
+func (g Group) validate() error {
+	switch g.Mode {
+	case "", ModeDeny:
+	case ModeAllow:
+		for _, text := range g.Queries {
+			if _, err := query.Compile(text); err != nil {
+				return fmt.Errorf("group %s: invalid query template '%s': %s", g.GetFullname(), text, err)
+			}
+		}
+	default:
+		return fmt.Errorf("group %s: unknown mode %s", g.GetFullname(), g.Mode)
+	}
+	for _, name := range g.Privileges {
+		if !knownPrivilege(name) {
+			return fmt.Errorf("group %s: unknown privilege %s", g.GetFullname(), name)
+		}
+	}
+	if err := ValidateTenant(g.Tenant); err != nil {
+		return fmt.Errorf("group %s: %s", g.GetFullname(), err)
+	}
+	for _, r := range g.Redactions {
+		if r.Key == "" {
+			return fmt.Errorf("group %s: redaction must have key", g.GetFullname())
+		}
+		switch r.Action {
+		case RedactDrop, RedactHash:
+		case RedactMask:
+			if _, err := regexp.Compile(r.Pattern); err != nil {
+				return fmt.Errorf("group %s: invalid redaction pattern '%s': %s", g.GetFullname(), r.Pattern, err)
+			}
+		default:
+			return fmt.Errorf("group %s: unknown redaction action %s", g.GetFullname(), r.Action)
+		}
+	}
+	return nil
+}
+
+func knownPrivilege(name string) bool {
+	for _, p := range query.Privileges {
+		if name == string(p) {
+			return true
+		}
+	}
+	return false
+}
+
 // NewGroups creates Groups by given configs in viper.Viper instance
 // returns pointer to created groups instance
 func NewGroups(c viper.Viper) (*Groups, error) {
@@ -55,6 +196,11 @@ func NewGroups(c viper.Viper) (*Groups, error) {
 	// range over groups from configuration
 	// fill groups map with fullname(DN) as a key and group as a value
 	for _, group := range g {
+		if err := group.validate(); err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		group.compile()
 		groups[group.GetFullname()] = group
 	}
 	return &groups, nil
@@ -76,12 +222,12 @@ func (g Groups) Search(groupNames ...string) (Group, bool) {
 		group Group
 		found bool
 	)
-	// range over given group names
+	// range over given group names, the first configured group is returned
 	for _, name := range groupNames {
 		glog.Infof("Searching for a group %s", name)
 		group, found = g.get(name)
-		if !found {
-			continue
+		if found {
+			break
 		}
 	}
 	if !found {
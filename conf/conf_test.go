@@ -3,10 +3,37 @@ package conf
 import (
 	"bytes"
 	"testing"
+	"time"
 
+	"github.com/Maksadbek/influxdb-shim/query"
 	"github.com/spf13/viper"
 )
 
+func TestSearch(t *testing.T) {
+	groups := Groups{
+		"CN=Devs,OU=Eng,DC=example,DC=com":   Group{CN: "Devs"},
+		"CN=Admins,OU=Eng,DC=example,DC=com": Group{CN: "Admins"},
+	}
+	testData := []struct {
+		names []string
+		cn    string
+		found bool
+	}{
+		{[]string{"CN=Devs,OU=Eng,DC=example,DC=com"}, "Devs", true},
+		// names of groups without policies follow the configured one, e.g: memberOf of AD users and groups of API keys
+		{[]string{"CN=Devs,OU=Eng,DC=example,DC=com", "CN=Everyone,DC=example,DC=com"}, "Devs", true},
+		{[]string{"CN=Everyone,DC=example,DC=com", "CN=Admins,OU=Eng,DC=example,DC=com"}, "Admins", true},
+		{[]string{"CN=Everyone,DC=example,DC=com"}, "", false},
+		{nil, "", false},
+	}
+	for _, d := range testData {
+		g, found := groups.Search(d.names...)
+		if found != d.found || g.CN != d.cn {
+			t.Errorf("%v: want %s %v, got %s %v", d.names, d.cn, d.found, g.CN, found)
+		}
+	}
+}
+
 func TestNewGroup(t *testing.T) {
 	testConf := []byte(`
     [blacklist]
@@ -82,3 +109,223 @@ func TestNewGroup(t *testing.T) {
 		}
 	}
 }
+
+func TestAllowlistGroup(t *testing.T) {
+	g := Group{
+		CN:   "Contractors",
+		OU:   "External",
+		DC:   "DC=White,DC=com",
+		Mode: ModeAllow,
+		Queries: []string{
+			"SHOW MEASUREMENTS",
+			"SELECT mean(value) FROM cpu WHERE host = $host AND time > $t GROUP BY time($interval)",
+		},
+	}
+	if err := g.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// templates are compiled once, not on every query
+	g.compile()
+	if len(g.templates) != len(g.Queries) {
+		t.Fatalf("want %d compiled templates, got %d", len(g.Queries), len(g.templates))
+	}
+
+	testData := []struct {
+		q       string
+		allowed bool
+	}{
+		{"show measurements", true},
+		{"SELECT mean(value) FROM cpu WHERE host = 'web' AND time > now() - 1h GROUP BY time(10m)", true},
+		{"SELECT * FROM cpu", false},
+		{"DROP DATABASE metrics", false},
+		{"SELECT mean(value) FROM cpu WHERE host = host AND time > now() - 1h GROUP BY time(10m)", false},
+	}
+	for _, d := range testData {
+		if _, ok := g.Allows(d.q); ok != d.allowed {
+			t.Errorf("%s: want %v, got %v", d.q, d.allowed, ok)
+		}
+	}
+
+	g.Mode = "permit"
+	if err := g.validate(); err == nil {
+		t.Error("want error of unknown mode, got nil")
+	}
+}
+
+func TestGrants(t *testing.T) {
+	g := Group{CN: "Wizards", OU: "Gryfinndor", DC: "DC=White,DC=com"}
+	if !g.Grants(query.Read) || !g.Grants(query.SchemaRead) || g.Grants(query.Delete) {
+		t.Errorf("want default privileges %v", DefaultPrivileges)
+	}
+	g.Privileges = []string{"read", "delete"}
+	if !g.Grants(query.Delete) || g.Grants(query.SchemaRead) {
+		t.Errorf("want privileges %v", g.Privileges)
+	}
+	g.Privileges = []string{"drop"}
+	if err := g.validate(); err == nil {
+		t.Error("want error of unknown privilege, got nil")
+	}
+}
+
+func TestRedactions(t *testing.T) {
+	testData := []struct {
+		r     Redaction
+		valid bool
+	}{
+		{Redaction{Key: "email", Action: RedactHash}, true},
+		{Redaction{Measurement: "logins", Key: "ip", Action: RedactMask, Pattern: `\.\d+$`, Mask: ".x"}, true},
+		{Redaction{Key: "ip", Action: RedactMask, Pattern: "("}, false},
+		{Redaction{Key: "email", Action: "encrypt"}, false},
+		{Redaction{Action: RedactDrop}, false},
+	}
+	for _, d := range testData {
+		g := Group{CN: "Wizards", OU: "Gryfinndor", DC: "DC=White,DC=com", Redactions: []Redaction{d.r}}
+		if err := g.validate(); (err == nil) != d.valid {
+			t.Errorf("%+v: want valid %v, got %v", d.r, d.valid, err)
+		}
+	}
+
+	r := Redaction{Measurement: "logins", Key: "ip"}
+	if !r.Matches("logins", "ip") || r.Matches("cpu", "ip") || r.Matches("logins", "host") {
+		t.Errorf("rule %+v matches wrong keys", r)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	testConf := []byte(`
+    [[aliases.databases]]
+        virtual = "payments"
+        physical = "payments_prod"
+    [[aliases.measurements]]
+        virtual = "CPU"
+        physical = "cpu_v2"`)
+
+	// nested keys need the key delimiter of viper.New
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBuffer(testConf)); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := NewAliases(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		name string
+		want string
+		got  string
+	}{
+		{"database", "payments_prod", aliases.Database("payments")},
+		{"unaliased database", "metrics", aliases.Database("metrics")},
+		{"virtual database", "payments", aliases.VirtualDatabase("payments_prod")},
+		{"measurement", "cpu_v2", aliases.Measurement("CPU")},
+		{"virtual measurement", "CPU", aliases.VirtualMeasurement("cpu_v2")},
+	}
+	for _, d := range testData {
+		if d.got != d.want {
+			t.Errorf("%s: want %s, got %s", d.name, d.want, d.got)
+		}
+	}
+
+	if _, _, err := aliasMaps("database", []Alias{{"a", "db"}, {"b", "db"}}); err == nil {
+		t.Error("want error of ambiguous physical name, got nil")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenants := &Tenants{Separator: "_"}
+	if db := tenants.Database("acme", "metrics"); db != "acme_metrics" {
+		t.Errorf("want acme_metrics, got %s", db)
+	}
+
+	testData := []struct {
+		tenant string
+		name   string
+		want   string
+		ok     bool
+	}{
+		{"acme", "acme_metrics", "metrics", true},
+		{"acme", "acme-corp_metrics", "acme-corp_metrics", false},
+		{"acme", "metrics", "metrics", false},
+		{"acme", "acme_", "acme_", false},
+		{"", "metrics", "metrics", true},
+	}
+	for _, d := range testData {
+		name, ok := tenants.Strip(d.tenant, d.name)
+		if name != d.want || ok != d.ok {
+			t.Errorf("want %s %v, got %s %v", d.want, d.ok, name, ok)
+		}
+	}
+
+	if err := ValidateTenant("acme_corp"); err == nil {
+		t.Error("want error of the separator in tenant id, got nil")
+	}
+}
+
+func TestDownsampling(t *testing.T) {
+	testConf := []byte(`
+    [downsampling]
+        enabled = true
+        [[downsampling.policies]]
+            database = "metrics"
+            name = "hourly"
+            resolution = "1h"
+            duration = "30d"
+            functions = ["mean(value)", "max(peak)"]
+        [[downsampling.policies]]
+            database = "metrics"
+            name = "daily"
+            resolution = "1d"
+            measurements = ["cpu"]
+            functions = ["mean(value)"]`)
+
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBuffer(testConf)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDownsampling(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	mean := []query.Aggregate{{Function: "mean", Field: "value"}}
+	testData := []struct {
+		shape query.Shape
+		want  string
+	}{
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 7 * 24 * time.Hour, Aggregates: mean}, "daily"},
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 2 * time.Hour, Start: now.AddDate(0, 0, -7), Aggregates: mean}, "hourly"},
+		{query.Shape{Database: "metrics", Measurements: []string{"mem"}, Interval: 24 * time.Hour, Start: now.AddDate(0, 0, -7), Aggregates: mean}, "hourly"},
+		{query.Shape{Database: "metrics", Regex: true, Interval: 24 * time.Hour, Aggregates: mean}, ""},
+		{query.Shape{Database: "metrics", Measurements: []string{"mem"}, Interval: time.Hour, Start: now.AddDate(0, 0, -90), Aggregates: mean}, ""},
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 90 * time.Minute, Start: now.AddDate(0, 0, -1), Aggregates: mean}, ""},
+		{query.Shape{Database: "other", Measurements: []string{"cpu"}, Interval: 24 * time.Hour, Aggregates: mean}, ""},
+		// fields must be downsampled by the function of the query
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 24 * time.Hour, Start: now.AddDate(0, 0, -7),
+			Aggregates: []query.Aggregate{{Function: "max", Field: "peak"}}}, "hourly"},
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 24 * time.Hour, Start: now.AddDate(0, 0, -7),
+			Aggregates: []query.Aggregate{{Function: "max", Field: "value"}}}, ""},
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 24 * time.Hour, Start: now.AddDate(0, 0, -7),
+			Aggregates: []query.Aggregate{{Function: "mean", Field: "value"}, {Function: "max", Field: "peak"}}}, "hourly"},
+		{query.Shape{Database: "metrics", Measurements: []string{"cpu"}, Interval: 24 * time.Hour}, ""},
+	}
+	for _, data := range testData {
+		p, _ := d.Policies.Choose(data.shape, now)
+		if p.Name != data.want {
+			t.Errorf("%+v: want %q, got %q", data.shape, data.want, p.Name)
+		}
+	}
+
+	if _, err := NewRetentionPolicy("metrics", "hourly", "1y", "", nil, []string{"mean(value)"}); err == nil {
+		t.Error("want error of invalid resolution, got nil")
+	}
+	if _, err := NewRetentionPolicy("metrics", "hourly", "1h", "", nil, nil); err == nil {
+		t.Error("want error of missing functions, got nil")
+	}
+	if _, err := NewRetentionPolicy("metrics", "hourly", "1h", "", nil, []string{"percentile(value, 95)"}); err == nil {
+		t.Error("want error of invalid function, got nil")
+	}
+}
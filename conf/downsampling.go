@@ -0,0 +1,139 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/spf13/viper"
+)
+
+// RetentionPolicy is the retention policy holding points downsampled to the resolution,
+// e.g: written by the continuous query grouped by time(1h)
+type RetentionPolicy struct {
+	Database     string   `toml:"database" json:"database"` // physical database name
+	Name         string   `toml:"name" json:"name"`
+	Resolution   string   `toml:"resolution" json:"resolution"`     // interval of points, e.g: 1h
+	Duration     string   `toml:"duration" json:"duration"`         // retention duration, e.g: 52w, infinite if empty or "0"
+	Measurements []string `toml:"measurements" json:"measurements"` // downsampled measurements, all if empty
+	Functions    []string `toml:"functions" json:"functions"`       // functions of downsampled fields, e.g: mean(value) of mean(value) AS value
+
+	resolution time.Duration
+	duration   time.Duration
+	functions  map[string]string // function by field
+}
+
+// NewRetentionPolicy parses resolution, duration and functions of the policy
+func NewRetentionPolicy(database, name, resolution, duration string, measurements, functions []string) (RetentionPolicy, error) {
+	p := RetentionPolicy{Database: database, Name: name, Resolution: resolution, Duration: duration, Measurements: measurements, Functions: functions}
+	if database == "" || name == "" {
+		return p, fmt.Errorf("retention policy %s.%s must have database and name", database, name)
+	}
+	if len(functions) == 0 {
+		return p, fmt.Errorf("retention policy %s.%s must have functions of downsampled fields", database, name)
+	}
+	p.functions = map[string]string{}
+	for _, f := range functions {
+		a, err := query.ParseAggregate(f)
+		if err != nil {
+			return p, fmt.Errorf("invalid function of retention policy %s.%s: %s", database, name, f)
+		}
+		p.functions[a.Field] = a.Function
+	}
+	var err error
+	if p.resolution, err = query.ParseDuration(resolution); err != nil || p.resolution <= 0 {
+		return p, fmt.Errorf("invalid resolution of retention policy %s.%s: %s", database, name, resolution)
+	}
+	if duration != "" {
+		if p.duration, err = query.ParseDuration(duration); err != nil {
+			return p, fmt.Errorf("invalid duration of retention policy %s.%s: %s", database, name, duration)
+		}
+	}
+	return p, nil
+}
+
+// Serves checks whether the policy keeps all points the query needs:
+// the interval is a multiple of the resolution, the time range is retained, measurements are downsampled
+// and fields are downsampled by the same composable functions the query applies
+func (p RetentionPolicy) Serves(s query.Shape, now time.Time) bool {
+	if p.Database != s.Database || p.resolution > s.Interval || s.Interval%p.resolution != 0 {
+		return false
+	}
+	if len(s.Aggregates) == 0 {
+		return false
+	}
+	for _, a := range s.Aggregates {
+		if !query.Composable(a.Function) || p.functions[a.Field] != a.Function {
+			return false
+		}
+	}
+	if p.duration > 0 && (s.Start.IsZero() || s.Start.Before(now.Add(-p.duration))) {
+		return false
+	}
+	if len(p.Measurements) == 0 {
+		return true
+	}
+	if s.Regex {
+		return false
+	}
+	for _, m := range s.Measurements {
+		found := false
+		for _, name := range p.Measurements {
+			if name == m {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RetentionPolicies are policies of downsampled data
+type RetentionPolicies []RetentionPolicy
+
+// Choose returns the coarsest policy serving the query, the first one of equal resolutions
+func (policies RetentionPolicies) Choose(s query.Shape, now time.Time) (RetentionPolicy, bool) {
+	var chosen RetentionPolicy
+	found := false
+	for _, p := range policies {
+		if p.Serves(s, now) && (!found || p.resolution > chosen.resolution) {
+			chosen, found = p, true
+		}
+	}
+	return chosen, found
+}
+
+// Downsampling routes queries grouped by time to retention policies of downsampled data
+type Downsampling struct {
+	Enabled  bool
+	Discover bool              // policies are also discovered by continuous queries of InfluxDB
+	Refresh  time.Duration     // discovered policies are loaded again after this period
+	Policies RetentionPolicies // policies of the config
+}
+
+// NewDownsampling reads [downsampling] of the config
+func NewDownsampling(c viper.Viper) (*Downsampling, error) {
+	d := &Downsampling{
+		Enabled:  c.GetBool("downsampling.enabled"),
+		Discover: c.GetBool("downsampling.discover"),
+		Refresh:  time.Duration(c.GetInt("downsampling.refresh")) * time.Second,
+	}
+	if d.Refresh <= 0 {
+		d.Refresh = 5 * time.Minute
+	}
+	var policies []RetentionPolicy
+	if err := c.UnmarshalKey("downsampling.policies", &policies); err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		p, err := NewRetentionPolicy(p.Database, p.Name, p.Resolution, p.Duration, p.Measurements, p.Functions)
+		if err != nil {
+			return nil, err
+		}
+		d.Policies = append(d.Policies, p)
+	}
+	return d, nil
+}
@@ -0,0 +1,266 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	errGroupExists    = errors.New("Group with such name already exists")
+	errNoGroup        = errors.New("Group with such name does not exist")
+	errNoVersion      = errors.New("Policy version does not exist")
+	errGroupCN        = errors.New("Group must have cn and ou")
+	errEmptyQuery     = errors.New("Group queries must not be empty")
+	errVersionChanged = errors.New("Policy is changed by someone else, reload it and try again")
+)
+
+// default count of policy versions kept in the file
+const defaultMaxVersions = 50
+
+// PolicyVersion is the snapshot of groups saved on every change
+type PolicyVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Author  string    `json:"author"`
+	Comment string    `json:"comment,omitempty"`
+	Groups  []Group   `json:"groups"`
+}
+
+// PolicyStore keeps versions of groups in the local JSON file,
+// the latest version overrides [[groups]] of the config
+type PolicyStore struct {
+	path        string
+	maxVersions int
+
+	mu       sync.Mutex
+	versions []PolicyVersion // ordered by version, the last one is current
+}
+
+// OpenPolicyStore reads versions from the file, missing file is an empty store
+func OpenPolicyStore(path string, maxVersions int) (*PolicyStore, error) {
+	if maxVersions <= 0 {
+		maxVersions = defaultMaxVersions
+	}
+	s := &PolicyStore{path: path, maxVersions: maxVersions}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.versions); err != nil {
+		return nil, err
+	}
+	if len(s.versions) > 0 {
+		if err := ValidateGroups(s.current().Groups); err != nil {
+			return nil, fmt.Errorf("policy file %s is not valid: %s", path, err)
+		}
+	}
+	glog.Infof("Loaded %d policy versions from %s", len(s.versions), path)
+	return s, nil
+}
+
+func (s *PolicyStore) current() PolicyVersion {
+	if len(s.versions) == 0 {
+		return PolicyVersion{}
+	}
+	return s.versions[len(s.versions)-1]
+}
+
+// Current returns the latest version, zero version means the policy was never changed
+func (s *PolicyStore) Current() PolicyVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current()
+}
+
+// Versions returns saved versions without their groups, the latest first
+func (s *PolicyStore) Versions() []PolicyVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make([]PolicyVersion, 0, len(s.versions))
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		v := s.versions[i]
+		v.Groups = nil
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// Groups returns groups of the current version as the map by full names,
+// initial groups are returned if the policy was never changed
+func (s *PolicyStore) Groups(initial Groups) Groups {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.versions) == 0 {
+		return initial
+	}
+	return groupsMap(s.current().Groups)
+}
+
+// Update applies the change to the groups of the current version and saves the result as the new version,
+// base is the version the change was made on, so concurrent edits are not lost silently,
+// initial groups are the base of the first version
+func (s *PolicyStore) Update(base int, initial Groups, author, comment string, change func(Groups) error) (PolicyVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.current()
+	if base != cur.Version {
+		return PolicyVersion{}, errVersionChanged
+	}
+	groups := initial
+	if len(s.versions) > 0 {
+		groups = groupsMap(cur.Groups)
+	}
+	// the change is applied to the copy, so the current version is kept if it fails
+	next := Groups{}
+	for name, g := range groups {
+		next[name] = g
+	}
+	if err := change(next); err != nil {
+		return PolicyVersion{}, err
+	}
+	return s.save(next.List(), author, comment)
+}
+
+// Rollback saves groups of the previous version as the new version
+func (s *PolicyStore) Rollback(version int, author string) (PolicyVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.versions {
+		if v.Version == version {
+			return s.save(v.Groups, author, fmt.Sprintf("rollback to version %d", version))
+		}
+	}
+	return PolicyVersion{}, errNoVersion
+}
+
+// save validates groups and writes them as the new version, must be called with the lock held
+func (s *PolicyStore) save(groups []Group, author, comment string) (PolicyVersion, error) {
+	if err := ValidateGroups(groups); err != nil {
+		return PolicyVersion{}, err
+	}
+	v := PolicyVersion{
+		Version: s.current().Version + 1,
+		Time:    time.Now().UTC(),
+		Author:  author,
+		Comment: comment,
+		Groups:  groups,
+	}
+	versions := append(append([]PolicyVersion{}, s.versions...), v)
+	if len(versions) > s.maxVersions {
+		versions = versions[len(versions)-s.maxVersions:]
+	}
+	if err := writeFileAtomic(s.path, versions); err != nil {
+		return PolicyVersion{}, err
+	}
+	s.versions = versions
+	glog.Infof("Policy version %d is saved by %s", v.Version, author)
+	return v, nil
+}
+
+// ValidateGroups checks groups before they are applied
+func ValidateGroups(groups []Group) error {
+	names := map[string]bool{}
+	for _, g := range groups {
+		if strings.TrimSpace(g.CN) == "" || strings.TrimSpace(g.OU) == "" {
+			return errGroupCN
+		}
+		for _, q := range g.Queries {
+			if strings.TrimSpace(q) == "" {
+				return errEmptyQuery
+			}
+		}
+		if err := g.validate(); err != nil {
+			return err
+		}
+		if names[g.GetFullname()] {
+			return fmt.Errorf("duplicate group: %s", g.GetFullname())
+		}
+		names[g.GetFullname()] = true
+	}
+	return nil
+}
+
+// Add adds the new group
+func (g Groups) Add(group Group) error {
+	if _, ok := g[group.GetFullname()]; ok {
+		return errGroupExists
+	}
+	group.compile()
+	g[group.GetFullname()] = group
+	return nil
+}
+
+// Replace replaces the group by its full name, the group may be renamed
+func (g Groups) Replace(name string, group Group) error {
+	if _, ok := g[name]; !ok {
+		return errNoGroup
+	}
+	delete(g, name)
+	return g.Add(group)
+}
+
+// Delete deletes the group by its full name
+func (g Groups) Delete(name string) error {
+	if _, ok := g[name]; !ok {
+		return errNoGroup
+	}
+	delete(g, name)
+	return nil
+}
+
+// List returns groups sorted by full names
+func (g Groups) List() []Group {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]Group, 0, len(names))
+	for _, name := range names {
+		groups = append(groups, g[name])
+	}
+	return groups
+}
+
+func groupsMap(list []Group) Groups {
+	groups := Groups{}
+	for _, g := range list {
+		g.compile()
+		groups[g.GetFullname()] = g
+	}
+	return groups
+}
+
+// writeFileAtomic writes JSON to the temp file and renames it, so the file is never half written
+func writeFileAtomic(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".policy")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
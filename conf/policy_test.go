@@ -0,0 +1,80 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+
+	initial := groupsMap([]Group{{OU: "Gryfinndor", CN: "Wizards", DC: "DC=White,DC=com", Queries: []string{"Avada kedavra"}}})
+	store, err := OpenPolicyStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := store.Groups(initial); !reflect.DeepEqual(groups, initial) {
+		t.Errorf("want %+v, got %+v", initial, groups)
+	}
+
+	witchs := Group{OU: "Slizeren", CN: "Witchs", DC: "DC=Black,DC=com", Queries: []string{"Crucio"}}
+	v1, err := store.Update(0, initial, "admin", "", func(g Groups) error { return g.Add(witchs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Version != 1 || len(v1.Groups) != 2 {
+		t.Errorf("want version 1 with 2 groups, got %+v", v1)
+	}
+
+	testData := []struct {
+		base   int
+		change func(Groups) error
+		want   error
+	}{
+		{0, func(g Groups) error { return nil }, errVersionChanged},
+		{1, func(g Groups) error { return g.Add(witchs) }, errGroupExists},
+		{1, func(g Groups) error { return g.Delete("CN=Muggles,OU=London,DC=com") }, errNoGroup},
+		{1, func(g Groups) error { return g.Add(Group{OU: "London"}) }, errGroupCN},
+		{1, func(g Groups) error { return g.Add(Group{OU: "London", CN: "Muggles", Queries: []string{" "}}) }, errEmptyQuery},
+	}
+	for _, test := range testData {
+		if _, err := store.Update(test.base, initial, "admin", "", test.change); err != test.want {
+			t.Errorf("want %v, got %v", test.want, err)
+		}
+	}
+
+	if _, err := store.Update(1, initial, "admin", "", func(g Groups) error { return g.Delete(witchs.GetFullname()) }); err != nil {
+		t.Fatal(err)
+	}
+	v3, err := store.Rollback(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v3.Groups, v1.Groups) {
+		t.Errorf("want %+v, got %+v", v1.Groups, v3.Groups)
+	}
+
+	// versions must survive reopening, only the last 2 are kept
+	store, err = OpenPolicyStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := store.Versions()
+	if len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 2 {
+		t.Errorf("want versions 3 and 2, got %+v", versions)
+	}
+	if _, ok := store.Groups(initial).Search(witchs.GetFullname()); !ok {
+		t.Errorf("want group %s after rollback", witchs.GetFullname())
+	}
+	if _, err := store.Rollback(1, "admin"); err != errNoVersion {
+		t.Errorf("want %v, got %v", errNoVersion, err)
+	}
+}
@@ -0,0 +1,71 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+var errTenantSeparator = errors.New("Tenant separator must not contain letters, digits or '-'")
+
+// Tenants prefix database names of tenants, e.g: acme_metrics,
+// so tenants sharing one InfluxDB see only their databases
+type Tenants struct {
+	Separator string
+}
+
+// NewTenants reads [tenants] of the config, the default separator is "_"
+func NewTenants(c viper.Viper) (*Tenants, error) {
+	t := &Tenants{Separator: c.GetString("tenants.separator")}
+	if t.Separator == "" {
+		t.Separator = "_"
+	}
+	// tenant ids can not contain the separator, so prefixes of tenants never overlap
+	for _, r := range t.Separator {
+		if validTenantRune(r) {
+			return nil, errTenantSeparator
+		}
+	}
+	return t, nil
+}
+
+// Database returns the database name of the tenant
+func (t *Tenants) Database(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + t.Separator + name
+}
+
+// Strip returns the database name without the tenant prefix,
+// false if the database does not belong to the tenant
+func (t *Tenants) Strip(tenant, name string) (string, bool) {
+	if tenant == "" {
+		return name, true
+	}
+	prefix := tenant + t.Separator
+	if !strings.HasPrefix(name, prefix) || name == prefix {
+		return name, false
+	}
+	return strings.TrimPrefix(name, prefix), true
+}
+
+// ValidateTenant checks that tenant id contains only letters, digits and '-'
+func ValidateTenant(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	for _, r := range tenant {
+		if !validTenantRune(r) {
+			return fmt.Errorf("invalid tenant id: %s", tenant)
+		}
+	}
+	return nil
+}
+
+func validTenantRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-'
+}
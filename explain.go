@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/Maksadbek/influxdb-shim/httpd"
+	"github.com/spf13/viper"
+)
+
+// runExplain prints the policy decision for the query without running it:
+//
+//	explain -db name -q query (-user uid | -token token) [-groups dn;dn]
+func runExplain(c viper.Viper, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	user := fs.String("user", "", "username looked up by auth backends")
+	token := fs.String("token", "", "token issued by the shim or by the OIDC identity provider")
+	groups := fs.String("groups", "", "group DNs separated by ';', replace groups of the user")
+	db := fs.String("db", "", "database")
+	q := fs.String("q", "", "query string")
+	fs.Parse(args)
+
+	e, err := httpd.Explain(c, httpd.ExplainRequest{
+		Username: *user,
+		Token:    *token,
+		Groups:   splitNonEmpty(*groups, ";"),
+		Database: *db,
+		Query:    *q,
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(e)
+}
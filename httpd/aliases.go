@@ -0,0 +1,118 @@
+package httpd
+
+import (
+	"strings"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// renameResponse replaces physical database and measurement names in results of the query by virtual ones,
+// databases of other tenants are removed and the prefix of the tenant is stripped.
+// Results are in the same order as statements of the query
+func renameResponse(response *client.Response, q string, aliases *conf.Aliases, tenants *conf.Tenants, tenant string) {
+	if response == nil || aliases.Empty() && tenant == "" {
+		return
+	}
+	statements, err := query.Parse(q)
+	if err != nil {
+		return
+	}
+	for i := range response.Results {
+		command := ""
+		if i < len(statements) {
+			command = statements[i].Command
+		}
+		if tenant != "" && response.Results[i].Err != "" {
+			// errors name physical databases, e.g: database not found: acme_metrics
+			response.Results[i].Err = strings.Replace(response.Results[i].Err, tenants.Database(tenant, ""), "", -1)
+		}
+		if command == "SHOW CONTINUOUS" {
+			response.Results[i].Series = tenantQueries(response.Results[i].Series, tenants, tenant)
+		}
+		series := response.Results[i].Series
+		for j := range series {
+			switch command {
+			case "SHOW DATABASES":
+				series[j].Values = tenantDatabases(series[j].Columns, series[j].Values, tenants, tenant)
+				renameColumn(series[j].Columns, series[j].Values, "name", aliases.VirtualDatabase)
+			case "SHOW MEASUREMENTS":
+				renameColumn(series[j].Columns, series[j].Values, "name", aliases.VirtualMeasurement)
+			case "SHOW SERIES":
+				// series keys start with the measurement, e.g: cpu,host=web-1
+				renameColumn(series[j].Columns, series[j].Values, "key", func(key string) string {
+					if n := strings.Index(key, ","); n >= 0 {
+						return aliases.VirtualMeasurement(key[:n]) + key[n:]
+					}
+					return aliases.VirtualMeasurement(key)
+				})
+			case "SHOW CONTINUOUS":
+				// continuous queries are grouped by databases
+				series[j].Name = aliases.VirtualDatabase(series[j].Name)
+			default:
+				series[j].Name = aliases.VirtualMeasurement(series[j].Name)
+			}
+		}
+	}
+}
+
+// renameColumn replaces string values of the column
+func renameColumn(columns []string, values [][]interface{}, column string, rename func(string) string) {
+	index := columnIndex(columns, column)
+	if index < 0 {
+		return
+	}
+	for _, row := range values {
+		if index < len(row) {
+			if s, ok := row[index].(string); ok {
+				row[index] = rename(s)
+			}
+		}
+	}
+}
+
+// tenantDatabases keeps rows of databases of the tenant and strips the prefix of the tenant
+func tenantDatabases(columns []string, values [][]interface{}, tenants *conf.Tenants, tenant string) [][]interface{} {
+	if tenant == "" {
+		return values
+	}
+	index := columnIndex(columns, "name")
+	kept := [][]interface{}{}
+	for _, row := range values {
+		if index < 0 || index >= len(row) {
+			continue
+		}
+		name, ok := row[index].(string)
+		if !ok {
+			continue
+		}
+		if name, ok = tenants.Strip(tenant, name); ok {
+			row[index] = name
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+// tenantQueries keeps continuous queries of databases of the tenant,
+// the prefix of the tenant is stripped from database names and texts of queries
+func tenantQueries(series []models.Row, tenants *conf.Tenants, tenant string) []models.Row {
+	if tenant == "" {
+		return series
+	}
+	kept := []models.Row{}
+	for _, row := range series {
+		name, ok := tenants.Strip(tenant, row.Name)
+		if !ok {
+			continue
+		}
+		row.Name = name
+		renameColumn(row.Columns, row.Values, "query", func(q string) string {
+			return strings.Replace(q, tenants.Database(tenant, ""), "", -1)
+		})
+		kept = append(kept, row)
+	}
+	return kept
+}
@@ -0,0 +1,77 @@
+package httpd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/spf13/viper"
+)
+
+// newTestAliases reads aliases and tenants of the config
+func newTestAliases(t *testing.T, config string) (*conf.Aliases, *conf.Tenants) {
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBufferString(config)); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := conf.NewAliases(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := conf.NewTenants(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aliases, tenants
+}
+
+func TestRenameResponse(t *testing.T) {
+	aliases, tenants := newTestAliases(t, `
+[[aliases.databases]]
+    virtual = "cpu"
+    physical = "cpu_prod"
+[[aliases.measurements]]
+    virtual = "cpu"
+    physical = "cpu_v2"
+`)
+	response := &client.Response{Results: []client.Result{
+		{Series: []models.Row{{Name: "cpu_prod", Columns: []string{"name", "query"}, Values: [][]interface{}{{"cq", "CREATE CONTINUOUS QUERY cq ON cpu_prod"}}}}},
+		{Series: []models.Row{{Name: "cpu_v2", Columns: []string{"time", "value"}}}},
+	}}
+	renameResponse(response, "SHOW CONTINUOUS QUERIES; SELECT * FROM cpu_v2", aliases, tenants, "")
+
+	// continuous queries are grouped by databases, not measurements
+	if got := response.Results[0].Series[0].Name; got != "cpu" {
+		t.Errorf("want database cpu, got %s", got)
+	}
+	if got := response.Results[1].Series[0].Name; got != "cpu" {
+		t.Errorf("want measurement cpu, got %s", got)
+	}
+}
+
+func TestRenameResponseTenant(t *testing.T) {
+	aliases, tenants := newTestAliases(t, "")
+	response := &client.Response{Results: []client.Result{{Series: []models.Row{
+		{Name: "acme_metrics", Columns: []string{"name", "query"}, Values: [][]interface{}{
+			{"cq", "CREATE CONTINUOUS QUERY cq ON acme_metrics BEGIN SELECT mean(value) INTO acme_metrics.hourly.cpu FROM cpu GROUP BY time(1h) END"},
+		}},
+		{Name: "globex_metrics", Columns: []string{"name", "query"}, Values: [][]interface{}{
+			{"secret_cq", "CREATE CONTINUOUS QUERY secret_cq ON globex_metrics BEGIN SELECT count(value) INTO globex_metrics.hourly.logins FROM logins GROUP BY time(1h) END"},
+		}},
+		{Name: "_internal", Columns: []string{"name", "query"}},
+	}}}}
+	renameResponse(response, "SHOW CONTINUOUS QUERIES", aliases, tenants, "acme")
+
+	// databases and queries of other tenants are not returned
+	series := response.Results[0].Series
+	if len(series) != 1 || series[0].Name != "metrics" {
+		t.Fatalf("want continuous queries of metrics only, got %+v", series)
+	}
+	want := "CREATE CONTINUOUS QUERY cq ON metrics BEGIN SELECT mean(value) INTO metrics.hourly.cpu FROM cpu GROUP BY time(1h) END"
+	if got := series[0].Values[0][1]; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,278 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/Maksadbek/influxdb-shim/util"
+)
+
+// results of evaluated rules
+const (
+	rulePass = "pass"
+	ruleDeny = "deny"
+	ruleSkip = "skip"
+)
+
+// step is the single rule evaluated for the query
+type step struct {
+	Rule   string `json:"rule"`
+	Result string `json:"result"` // pass, deny or skip
+	Detail string `json:"detail,omitempty"`
+}
+
+// decision is the result of the policy evaluation of the query,
+// the same evaluation is used to serve queries and to explain them
+type decision struct {
+	Allowed  bool     `json:"allowed"`
+	Rule     string   `json:"rule"`             // the rule that made the decision, as in audit log
+	Reason   string   `json:"reason,omitempty"` // error returned to the user if the query is denied
+	Group    string   `json:"group,omitempty"`  // full name of the effective group
+	Tenant   string   `json:"tenant,omitempty"` // tenant whose databases the query is scoped to
+	Database string   `json:"database"`         // database the query is sent to
+	Query    string   `json:"query"`            // query sent to InfluxDB after rewrites
+	Rewrites []string `json:"rewrites"`
+	Steps    []step   `json:"steps"`
+
+	RetentionPolicies []string `json:"retentionPolicies,omitempty"` // downsampled policies chosen for statements
+
+	group    conf.Group
+	status   int       // HTTP status of the denied query
+	redactor *redactor // redaction rules of the group applied to results, nil if there are none
+}
+
+func (d *decision) step(rule, result, format string, args ...interface{}) {
+	d.Steps = append(d.Steps, step{Rule: rule, Result: result, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *decision) deny(rule string, status int, err error) decision {
+	d.Allowed, d.Rule, d.Reason, d.status = false, rule, err.Error(), status
+	return *d
+}
+
+// decide evaluates rules of the settings for the query of the user in order,
+// the first denying rule makes the decision
+func (s *settings) decide(user auth.User, db, q string) decision {
+	d := decision{Database: db, Query: q, Rewrites: []string{}, Steps: []step{}}
+
+	// databases the user is restricted to, e.g: by API key
+	if !user.CanAccess(db) {
+		d.step("databases", ruleDeny, "database %s is not in %s", db, strings.Join(user.Databases, ", "))
+		return d.deny("databases", http.StatusForbidden, errDatabaseDenied)
+	}
+	// databases named in the query, e.g: "billing".."invoices" or ON billing, are restricted too
+	if len(user.Databases) > 0 {
+		databases, err := query.Databases(q)
+		if err != nil {
+			d.step("databases", ruleDeny, "unable to read databases of the query: %s", err.Error())
+			return d.deny("databases", http.StatusBadRequest, fmt.Errorf("Unable to parse query: %s", err))
+		}
+		for _, name := range databases {
+			if !user.CanAccess(name) {
+				d.step("databases", ruleDeny, "query references database %s, it is not in %s", name, strings.Join(user.Databases, ", "))
+				return d.deny("databases", http.StatusForbidden, errDatabaseDenied)
+			}
+		}
+		d.step("databases", rulePass, "database %s and databases of the query are allowed", db)
+	}
+
+	// the first configured group of the user is effective
+	group, found := s.groups.Search(user.GroupNames...)
+	if !found {
+		d.step("group", ruleDeny, "none of user's groups is configured")
+		return d.deny("group", http.StatusBadRequest, errNoSuchGroup)
+	}
+	d.group, d.Group = group, group.GetFullname()
+	d.step("group", rulePass, "effective group is %s", d.Group)
+
+	// tenant users are scoped to databases of their tenant
+	if err := s.scope(&d, user); err != nil {
+		return d.deny("tenant", http.StatusForbidden, err)
+	}
+
+	// admin group members can run everything
+	if d.Group == s.adminGroupName {
+		d.step("admin", rulePass, "%s is admin group, privileges, blacklist and group queries are skipped", d.Group)
+		return s.allow(&d)
+	}
+
+	// every statement of the query needs privileges granted to the group
+	statements, err := query.Parse(q)
+	if err != nil {
+		d.step("privileges", ruleDeny, "unable to parse query: %s", err.Error())
+		return d.deny("privileges", http.StatusBadRequest, fmt.Errorf("Unable to parse query: %s", err))
+	}
+	for _, stmt := range statements {
+		for _, p := range stmt.Privileges {
+			if !group.Grants(p) {
+				d.step("privileges", ruleDeny, "statement '%s' requires %s privilege", stmt.Text, p)
+				return d.deny("privileges", http.StatusForbidden, fmt.Errorf("%s privilege is required to run: %s", p, stmt.Text))
+			}
+		}
+	}
+	d.step("privileges", rulePass, "%d statement(s) are granted to the group", len(statements))
+
+	cleanedQuery := util.CleanQuery(q)
+	if s.blacklist.Has(cleanedQuery) {
+		d.step("blacklist", ruleDeny, "query is in global blacklist")
+		return d.deny("blacklist", http.StatusForbidden, errProhibitedQuery)
+	}
+	d.step("blacklist", rulePass, "query is not in global blacklist")
+
+	// allowlist groups run only queries that match their templates
+	if group.IsAllowlist() {
+		template, ok := group.Allows(q)
+		if !ok {
+			d.step("group:"+d.Group, ruleDeny, "query does not match any allowed query of the group")
+			return d.deny("group:"+d.Group, http.StatusForbidden, errProhibitedQuery)
+		}
+		d.step("group:"+d.Group, rulePass, "query matches allowed query '%s'", template)
+	} else {
+		if group.HasQuery(q) {
+			d.step("group:"+d.Group, ruleDeny, "query is denied for the group")
+			return d.deny("group:"+d.Group, http.StatusForbidden, errProhibitedQuery)
+		}
+		d.step("group:"+d.Group, rulePass, "query is not denied for the group")
+	}
+
+	return s.allow(&d)
+}
+
+// scope sets the tenant of the user, the tenant of the identity provider must be the tenant of the group,
+// statements that can not be scoped to databases of the tenant are denied
+func (s *settings) scope(d *decision, user auth.User) error {
+	tenant := user.Tenant
+	if tenant == "" {
+		tenant = d.group.Tenant
+	}
+	if tenant == "" {
+		return nil
+	}
+	if d.group.Tenant != "" && d.group.Tenant != tenant {
+		d.step("tenant", ruleDeny, "tenant %s of the user is not tenant %s of the group", tenant, d.group.Tenant)
+		return errTenantMismatch
+	}
+	if err := conf.ValidateTenant(tenant); err != nil {
+		d.step("tenant", ruleDeny, "%s", err.Error())
+		return err
+	}
+	statements, err := query.Parse(d.Query)
+	if err != nil {
+		d.step("tenant", ruleDeny, "unable to parse query: %s", err.Error())
+		return err
+	}
+	for _, stmt := range statements {
+		for _, p := range stmt.Privileges {
+			if p == query.Admin {
+				d.step("tenant", ruleDeny, "statement '%s' is not scoped to databases", stmt.Text)
+				return errTenantStatement
+			}
+		}
+	}
+	d.Tenant = tenant
+	d.step("tenant", rulePass, "databases are prefixed with tenant %s", tenant)
+	return nil
+}
+
+// redaction prepares redaction rules of the group, queries that hide redacted keys
+// from the rules by AS or functions are denied
+func (s *settings) redaction(d *decision) error {
+	if len(d.group.Redactions) == 0 {
+		return nil
+	}
+	r, err := newRedactor(d.group.Redactions, s.redactKey, s.hashes)
+	if err != nil {
+		d.step("redaction", ruleDeny, "%s", err.Error())
+		d.deny("redaction", http.StatusInternalServerError, err)
+		return err
+	}
+	if key, hidden := query.Hidden(d.Query, r.keys()); hidden {
+		d.step("redaction", ruleDeny, "redacted key %s is renamed or passed to a function", key)
+		d.deny("redaction", http.StatusForbidden, errHiddenRedacted)
+		return errHiddenRedacted
+	}
+	// hashed values are resolved when the query is sent, so explain does not show raw values
+	if _, err := r.conditions(d.Query); err != nil {
+		d.step("redaction", ruleDeny, "%s", err.Error())
+		d.deny("redaction", http.StatusForbidden, err)
+		return err
+	}
+	d.redactor = r
+	for _, rule := range d.group.Redactions {
+		measurement := rule.Measurement
+		if measurement == "" {
+			measurement = "all measurements"
+		}
+		d.step("redaction", rulePass, "%s of %s is redacted by %s", rule.Key, measurement, rule.Action)
+	}
+	return nil
+}
+
+// allow renames databases and measurements of the allowed query and routes it to downsampled data,
+// the query is denied if names can not be scoped to the tenant
+func (s *settings) allow(d *decision) decision {
+	if err := s.redaction(d); err != nil {
+		return *d
+	}
+	d.Allowed, d.Rule = true, "group:"+d.Group
+	if err := s.rename(d); err != nil {
+		status := http.StatusBadRequest
+		if err == errTenantDatabase {
+			status = http.StatusForbidden
+		}
+		return d.deny("tenant", status, err)
+	}
+	s.downsample(d, time.Now())
+	return *d
+}
+
+// rename replaces virtual database and measurement names of the query by physical ones
+// and prefixes databases with the tenant, rules are evaluated with virtual names
+func (s *settings) rename(d *decision) error {
+	if s.aliases.Empty() && d.Tenant == "" {
+		return nil
+	}
+	database := func(name string) string {
+		return s.tenants.Database(d.Tenant, s.aliases.Database(name))
+	}
+	if db := database(d.Database); db != d.Database {
+		d.Rewrites = append(d.Rewrites, fmt.Sprintf("database %s -> %s", d.Database, db))
+		d.Database = db
+	}
+	q, rewrites, err := query.Rename(d.Query, database, s.aliases.Measurement)
+	if err != nil {
+		if d.Tenant != "" {
+			d.step("rewrite", ruleDeny, "unable to parse query: %s", err.Error())
+			return err
+		}
+		d.step("rewrite", ruleSkip, "unable to parse query: %s", err.Error())
+		return nil
+	}
+	d.Query = q
+	d.Rewrites = append(d.Rewrites, rewrites...)
+	// names that are not rewritten to databases of the tenant are denied rather than sent to InfluxDB
+	if d.Tenant != "" {
+		databases, err := query.Databases(q)
+		if err != nil {
+			d.step("rewrite", ruleDeny, "unable to read databases of the query: %s", err.Error())
+			return err
+		}
+		for _, db := range databases {
+			if _, ok := s.tenants.Strip(d.Tenant, db); !ok {
+				d.step("rewrite", ruleDeny, "database %s is not a database of tenant %s", db, d.Tenant)
+				return errTenantDatabase
+			}
+		}
+	}
+	if len(d.Rewrites) == 0 {
+		d.step("rewrite", ruleSkip, "query does not have aliased names")
+		return nil
+	}
+	d.step("rewrite", rulePass, "databases and measurements are replaced by physical names")
+	return nil
+}
@@ -0,0 +1,203 @@
+package httpd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/url"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/spf13/viper"
+)
+
+const testConf = `
+[auth.ldap]
+    host = "127.0.0.1"
+    port = "389"
+[blacklist]
+    queries = ["SHOW USERS"]
+    adminGroup = "CN=Admin,OU=Global,DC=example,DC=com"
+[[groups]]
+    cn = "Admin"
+    ou = "Global"
+    dc = "DC=example,DC=com"
+[[groups]]
+    cn = "Devs"
+    ou = "Eng"
+    dc = "DC=example,DC=com"
+    queries = ["DROP MEASUREMENT cpu"]
+`
+
+// newTestSettings builds settings of testConf and the extra config
+func newTestSettings(t *testing.T, extra string) *settings {
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBufferString(testConf + extra)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSettings(*c, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDecideDatabases(t *testing.T) {
+	s := newTestSettings(t, "")
+	// e.g: API key or client certificate restricted to metrics
+	user := auth.User{Username: "svc", GroupNames: []string{"CN=Devs,OU=Eng,DC=example,DC=com"}, Databases: []string{"metrics"}}
+
+	testData := []struct {
+		db      string
+		q       string
+		allowed bool
+	}{
+		{"metrics", "SELECT * FROM cpu", true},
+		{"metrics", "SELECT * FROM metrics..cpu", true},
+		{"billing", "SELECT * FROM cpu", false},
+		{"metrics", `SELECT * FROM "billing".."invoices"`, false},
+		{"metrics", "SHOW MEASUREMENTS ON billing", false},
+		{"metrics", `DROP SERIES FROM "billing"..x`, false},
+		{"metrics", "SELECT * FROM /cpu/ billing..cpu", false},
+	}
+	for _, d := range testData {
+		decision := s.decide(user, d.db, d.q)
+		if decision.Allowed != d.allowed {
+			t.Errorf("%s on %s: want allowed %v, got %v (%s)", d.q, d.db, d.allowed, decision.Allowed, decision.Reason)
+		}
+		if !d.allowed && decision.Rule != "databases" {
+			t.Errorf("%s: want rule databases, got %s", d.q, decision.Rule)
+		}
+	}
+}
+
+func TestDecideCertificateDatabases(t *testing.T) {
+	s := newTestSettings(t, "")
+	mapper := auth.CertMapper{
+		{URI: "spiffe://example.com/ns/metrics/*", Groups: []string{"CN=Devs,OU=Eng,DC=example,DC=com"}, Databases: []string{"metrics"}},
+	}
+	uri, _ := url.Parse("spiffe://example.com/ns/metrics/sa/collector")
+	user, ok := mapper.Map(&x509.Certificate{URIs: []*url.URL{uri}})
+	if !ok {
+		t.Fatal("want certificate to be mapped")
+	}
+
+	if d := s.decide(user, "metrics", "SELECT mean(value) FROM cpu GROUP BY time(1h)"); !d.Allowed {
+		t.Errorf("want query of own database allowed, got %s", d.Reason)
+	}
+	// the qualified source names the database outside of the certificate rule
+	if d := s.decide(user, "metrics", `SELECT * FROM "billing"."autogen"."invoices"`); d.Allowed || d.Rule != "databases" {
+		t.Errorf("want query of billing denied by databases, got allowed %v by %s", d.Allowed, d.Rule)
+	}
+}
+
+// groups of rules evaluated by decide
+const decideConf = `
+[[groups]]
+    cn = "Writers"
+    ou = "Eng"
+    dc = "DC=example,DC=com"
+    privileges = ["read", "write", "delete", "admin"]
+    queries = ["DROP MEASUREMENT cpu"]
+[[groups]]
+    cn = "Contractors"
+    ou = "External"
+    dc = "DC=example,DC=com"
+    mode = "allow"
+    queries = ["SELECT mean(value) FROM cpu WHERE host = $host GROUP BY time($interval)"]
+[[groups]]
+    cn = "Acme"
+    ou = "Tenants"
+    dc = "DC=example,DC=com"
+    tenant = "acme"
+    privileges = ["read", "schema-read", "delete"]
+[[groups]]
+    cn = "Support"
+    ou = "Eng"
+    dc = "DC=example,DC=com"
+    [[groups.redactions]]
+        key = "email"
+        action = "drop"
+[tenants]
+    separator = "_"
+[[aliases.databases]]
+    virtual = "payments"
+    physical = "payments_prod"
+`
+
+const (
+	adminDN       = "CN=Admin,OU=Global,DC=example,DC=com"
+	devsDN        = "CN=Devs,OU=Eng,DC=example,DC=com"
+	writersDN     = "CN=Writers,OU=Eng,DC=example,DC=com"
+	contractorsDN = "CN=Contractors,OU=External,DC=example,DC=com"
+	acmeDN        = "CN=Acme,OU=Tenants,DC=example,DC=com"
+	supportDN     = "CN=Support,OU=Eng,DC=example,DC=com"
+)
+
+func TestDecide(t *testing.T) {
+	s := newTestSettings(t, decideConf)
+
+	testData := []struct {
+		group    string
+		tenant   string
+		db       string
+		q        string
+		allowed  bool
+		rule     string
+		database string // database sent to InfluxDB, db if empty
+		query    string // query sent to InfluxDB, q if empty
+	}{
+		{group: devsDN, db: "metrics", q: "SELECT * FROM cpu", allowed: true, rule: "group:" + devsDN},
+		{group: "CN=Unknown,DC=example,DC=com", db: "metrics", q: "SELECT * FROM cpu", rule: "group"},
+		{group: adminDN, db: "metrics", q: "SHOW USERS", allowed: true, rule: "group:" + adminDN},
+		// privileges, blacklist and denied queries of the group in order
+		{group: devsDN, db: "metrics", q: "DROP MEASUREMENT cpu", rule: "privileges"},
+		{group: writersDN, db: "metrics", q: "SHOW USERS", rule: "blacklist"},
+		{group: writersDN, db: "metrics", q: "DROP MEASUREMENT cpu", rule: "group:" + writersDN},
+		{group: writersDN, db: "metrics", q: "DROP MEASUREMENT mem", allowed: true, rule: "group:" + writersDN},
+		// allowlist
+		{group: contractorsDN, db: "metrics", q: "SELECT mean(value) FROM cpu WHERE host = 'web-1' GROUP BY time(5m)", allowed: true, rule: "group:" + contractorsDN},
+		{group: contractorsDN, db: "metrics", q: "SELECT * FROM cpu", rule: "group:" + contractorsDN},
+		// tenants
+		{group: acmeDN, db: "metrics", q: "SELECT * FROM cpu", allowed: true, rule: "group:" + acmeDN, database: "acme_metrics"},
+		{group: acmeDN, db: "metrics", q: "SELECT * FROM other..cpu", allowed: true, rule: "group:" + acmeDN,
+			database: "acme_metrics", query: "SELECT * FROM acme_other..cpu"},
+		{group: acmeDN, tenant: "acme", db: "metrics", q: "SELECT * FROM cpu", allowed: true, rule: "group:" + acmeDN, database: "acme_metrics"},
+		{group: acmeDN, tenant: "globex", db: "metrics", q: "SELECT * FROM cpu", rule: "tenant"},
+		{group: acmeDN, db: "metrics", q: "SHOW USERS", rule: "tenant"},
+		// shards are not scoped to databases, so tenants can not drop them even with delete privilege
+		{group: acmeDN, db: "metrics", q: "DROP SHARD 1", rule: "tenant"},
+		{group: acmeDN, db: "metrics", q: "DROP MEASUREMENT cpu", allowed: true, rule: "group:" + acmeDN, database: "acme_metrics"},
+		{group: acmeDN, db: "metrics", q: `SELECT * FROM /* x */ "globex"."autogen"."cpu"`, rule: "tenant"},
+		// aliases
+		{group: devsDN, db: "payments", q: "SELECT * FROM payments..cpu", allowed: true, rule: "group:" + devsDN,
+			database: "payments_prod", query: "SELECT * FROM payments_prod..cpu"},
+		// redaction
+		{group: supportDN, db: "metrics", q: "SELECT email FROM logins", allowed: true, rule: "group:" + supportDN},
+		{group: supportDN, db: "metrics", q: "SELECT count(email) FROM logins", rule: "redaction"},
+		{group: supportDN, db: "metrics", q: "SELECT count(value) FROM logins WHERE email =~ /^a/", rule: "redaction"},
+	}
+	for _, d := range testData {
+		user := auth.User{Username: "john", GroupNames: []string{d.group}, Tenant: d.tenant}
+		decision := s.decide(user, d.db, d.q)
+		if decision.Allowed != d.allowed || decision.Rule != d.rule {
+			t.Errorf("%s: want allowed %v by %s, got %v by %s (%s)", d.q, d.allowed, d.rule, decision.Allowed, decision.Rule, decision.Reason)
+			continue
+		}
+		if !d.allowed {
+			if decision.status == 0 || decision.Reason == "" {
+				t.Errorf("%s: want status and reason of the denial, got %d %q", d.q, decision.status, decision.Reason)
+			}
+			continue
+		}
+		if d.database == "" {
+			d.database = d.db
+		}
+		if d.query == "" {
+			d.query = d.q
+		}
+		if decision.Database != d.database || decision.Query != d.query {
+			t.Errorf("want %s on %s, got %s on %s", d.query, d.database, decision.Query, decision.Database)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package httpd
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// header of the response with retention policies chosen for the query
+const retentionPolicyHeader = "X-Retention-Policy"
+
+// downsampler chooses retention policies of downsampled data for queries,
+// policies of the config are preferred to discovered ones of the same resolution
+type downsampler struct {
+	conf.Downsampling
+	influxConf client.HTTPConfig
+
+	discovered atomic.Value  // conf.RetentionPolicies of the last successful discovery
+	stop       chan struct{} // stops discovery, nil if it is not started
+}
+
+// timeout of discovery queries
+const discoveryTimeout = 10 * time.Second
+
+func newDownsampler(d *conf.Downsampling, influxConf client.HTTPConfig) *downsampler {
+	influxConf.Timeout = discoveryTimeout
+	return &downsampler{Downsampling: *d, influxConf: influxConf}
+}
+
+// start discovers policies in the background every Refresh period until close,
+// policies discovered by prev are used until the first discovery.
+// Queries and explanations never wait for InfluxDB, the command line explain does not discover at all
+func (ds *downsampler) start(prev *downsampler) {
+	if !ds.Enabled || !ds.Discover {
+		return
+	}
+	if prev != nil {
+		if discovered, ok := prev.discovered.Load().(conf.RetentionPolicies); ok {
+			ds.discovered.Store(discovered)
+		}
+	}
+	ds.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(ds.Refresh)
+		defer ticker.Stop()
+		for {
+			ds.refresh()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(ds.stop)
+}
+
+// close stops discovery, the running discovery is finished in the background
+func (ds *downsampler) close() {
+	if ds.stop != nil {
+		close(ds.stop)
+		ds.stop = nil
+	}
+}
+
+// refresh discovers policies, previous policies are used until InfluxDB is reachable again
+func (ds *downsampler) refresh() {
+	discovered, err := ds.discover()
+	if err != nil {
+		glog.Errorf("Unable to discover retention policies: %s", err.Error())
+		return
+	}
+	ds.discovered.Store(discovered)
+}
+
+// policies returns policies of the config and the last discovered ones
+func (ds *downsampler) policies() conf.RetentionPolicies {
+	discovered, _ := ds.discovered.Load().(conf.RetentionPolicies)
+	if len(discovered) == 0 {
+		return ds.Policies
+	}
+	return append(append(conf.RetentionPolicies{}, ds.Policies...), discovered...)
+}
+
+// discover reads continuous queries of InfluxDB and durations of retention policies they write into
+func (ds *downsampler) discover() (conf.RetentionPolicies, error) {
+	c, err := client.NewHTTPClient(ds.influxConf)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	cqs, err := showQuery(c, "SHOW CONTINUOUS QUERIES", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var policies conf.RetentionPolicies
+	durations := map[string]map[string]string{} // durations of retention policies by database
+	for _, series := range cqs {
+		column := columnIndex(series.Columns, "query")
+		for _, values := range series.Values {
+			if column < 0 || column >= len(values) {
+				continue
+			}
+			text, _ := values[column].(string)
+			cq, err := query.ParseContinuousQuery(text)
+			if err != nil {
+				glog.V(2).Infof("Skipping continuous query '%s': %s", text, err.Error())
+				continue
+			}
+			// series of SHOW CONTINUOUS QUERIES are named by databases
+			if cq.Database == "" {
+				cq.Database = series.Name
+			}
+			if _, ok := durations[cq.Database]; !ok {
+				if durations[cq.Database], err = retentionDurations(c, cq.Database); err != nil {
+					return nil, err
+				}
+			}
+			duration, ok := durations[cq.Database][cq.RetentionPolicy]
+			if !ok {
+				continue
+			}
+			functions := make([]string, len(cq.Aggregates))
+			for i, a := range cq.Aggregates {
+				functions[i] = a.String()
+			}
+			p, err := conf.NewRetentionPolicy(cq.Database, cq.RetentionPolicy, cq.Interval.String(), duration, cq.Measurements, functions)
+			if err != nil {
+				return nil, err
+			}
+			policies = append(policies, p)
+		}
+	}
+	glog.Infof("Discovered %d downsampled retention policies", len(policies))
+	return policies, nil
+}
+
+// retentionDurations returns durations of retention policies of the database
+func retentionDurations(c client.Client, database string) (map[string]string, error) {
+	rps, err := showQuery(c, "SHOW RETENTION POLICIES ON "+quoteIdent(database), database)
+	if err != nil {
+		return nil, err
+	}
+	durations := map[string]string{}
+	for _, series := range rps {
+		name, duration := columnIndex(series.Columns, "name"), columnIndex(series.Columns, "duration")
+		for _, values := range series.Values {
+			if name < 0 || duration < 0 || name >= len(values) || duration >= len(values) {
+				continue
+			}
+			n, _ := values[name].(string)
+			d, _ := values[duration].(string)
+			durations[n] = d
+		}
+	}
+	return durations, nil
+}
+
+// showQuery runs the query and returns series of its only result
+func showQuery(c client.Client, q, database string) ([]models.Row, error) {
+	response, err := c.Query(client.NewQuery(q, database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+	if len(response.Results) == 0 {
+		return nil, nil
+	}
+	return response.Results[0].Series, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `\"`, -1) + `"`
+}
+
+// downsample reads SELECT statements grouped by time from the coarsest retention policy that serves them
+func (s *settings) downsample(d *decision, now time.Time) {
+	if !s.downsampler.Enabled {
+		return
+	}
+	policies := s.downsampler.policies()
+	if len(policies) == 0 {
+		d.step("downsampling", ruleSkip, "there are no downsampled retention policies")
+		return
+	}
+	choose := func(shape query.Shape) string {
+		p, _ := policies.Choose(shape, now)
+		return p.Name
+	}
+	q, chosen, err := query.Route(d.Query, d.Database, now, choose)
+	if err != nil {
+		d.step("downsampling", ruleSkip, "unable to parse query: %s", err.Error())
+		return
+	}
+	if len(chosen) == 0 {
+		d.step("downsampling", ruleSkip, "no statement is served by downsampled retention policies")
+		return
+	}
+	d.Query = q
+	for _, rp := range chosen {
+		if !contains(d.RetentionPolicies, rp) {
+			d.RetentionPolicies = append(d.RetentionPolicies, rp)
+			d.Rewrites = append(d.Rewrites, fmt.Sprintf("retention policy -> %s", rp))
+		}
+	}
+	d.step("downsampling", rulePass, "%d statement(s) read retention policies %s", len(chosen), strings.Join(d.RetentionPolicies, ", "))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// fakeDiscovery answers SHOW CONTINUOUS QUERIES and SHOW RETENTION POLICIES of metrics database
+func fakeDiscovery(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.FormValue("q") {
+		case "SHOW CONTINUOUS QUERIES":
+			fmt.Fprint(w, `{"results":[{"series":[{"name":"metrics","columns":["name","query"],"values":[`+
+				`["cq_1h","CREATE CONTINUOUS QUERY cq_1h ON metrics BEGIN SELECT mean(value) AS value INTO metrics.hourly.:MEASUREMENT FROM metrics.autogen./.*/ GROUP BY time(1h), * END"]]}]}]}`)
+		default:
+			fmt.Fprint(w, `{"results":[{"series":[{"columns":["name","duration","shardGroupDuration","replicaN","default"],"values":[`+
+				`["autogen","0s","168h0m0s",1,true],["hourly","720h0m0s","24h0m0s",1,false]]}]}]}`)
+		}
+	}))
+}
+
+func TestDownsamplerDiscovery(t *testing.T) {
+	var requests int32
+	server := fakeDiscovery(&requests)
+	defer server.Close()
+
+	ds := newDownsampler(&conf.Downsampling{Enabled: true, Discover: true, Refresh: time.Hour}, client.HTTPConfig{Addr: server.URL})
+	// queries and explanations never discover policies themselves
+	if p := ds.policies(); len(p) != 0 || atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("want no policies and requests before discovery, got %d policies and %d requests", len(p), requests)
+	}
+
+	ds.start(nil)
+	defer ds.close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ds.policies()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	policies := ds.policies()
+	if len(policies) != 1 {
+		t.Fatalf("want 1 discovered policy, got %d", len(policies))
+	}
+	if p := policies[0]; p.Database != "metrics" || p.Name != "hourly" || len(p.Functions) != 1 || p.Functions[0] != "mean(value)" {
+		t.Errorf("want metrics.hourly of mean(value), got %+v", p)
+	}
+
+	// the next downsampler uses discovered policies until its own discovery
+	next := newDownsampler(&conf.Downsampling{Enabled: true, Discover: true, Refresh: time.Hour}, client.HTTPConfig{Addr: server.URL})
+	next.start(ds)
+	defer next.close()
+	if len(next.policies()) != 1 {
+		t.Errorf("want policies of the previous downsampler, got %d", len(next.policies()))
+	}
+}
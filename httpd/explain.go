@@ -0,0 +1,215 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+)
+
+var (
+	errNoLookup      = errors.New("Auth backends can not look up users")
+	errNoSuchUser    = errors.New("User with such uid not found")
+	errExplainParams = errors.New("Query string and database are required")
+)
+
+// ExplainRequest is the user, the query and the database to explain,
+// the user is given by username or by token, groups override groups of the user
+type ExplainRequest struct {
+	Username string
+	Token    string
+	Groups   []string
+	Database string
+	Query    string
+}
+
+// explainedUser is the user the policy is evaluated for
+type explainedUser struct {
+	Username  string   `json:"username"`
+	Source    string   `json:"source,omitempty"`
+	IsAdmin   bool     `json:"isAdmin"`
+	Groups    []string `json:"groups"`
+	Databases []string `json:"databases,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+}
+
+// explanation is the dry-run result of the query, InfluxDB is not contacted
+type explanation struct {
+	User     explainedUser `json:"user"`
+	Policy   *conf.Group   `json:"policy"` // effective group with its queries
+	Decision decision      `json:"decision"`
+}
+
+// explain evaluates the query of the user by settings
+func (s *settings) explain(user auth.User, db, q string) explanation {
+	groups := user.GroupNames
+	if groups == nil {
+		groups = []string{}
+	}
+	e := explanation{
+		User: explainedUser{
+			Username:  user.Username,
+			Source:    user.Source,
+			IsAdmin:   user.IsAdmin,
+			Groups:    groups,
+			Databases: user.Databases,
+			Tenant:    user.Tenant,
+		},
+		Decision: s.decide(user, db, q),
+	}
+	if e.Decision.Group != "" {
+		group := e.Decision.group
+		e.Policy = &group
+	}
+	return e
+}
+
+// lookup finds the user by auth backends that support lookup without the password
+func (s *settings) lookup(username string) (auth.User, error) {
+	l, ok := s.authenticator.(auth.Lookuper)
+	if !ok {
+		return auth.User{}, errNoLookup
+	}
+	user, found := l.Lookup(username)
+	if !found {
+		return user, errNoSuchUser
+	}
+	return user, nil
+}
+
+// parseToken parses the token issued by the shim or by the OIDC identity provider
+func parseToken(signer *auth.Signer, oidc *auth.OIDC, token string) (auth.User, error) {
+	user, err := signer.Parse(token)
+	if err != nil && oidc != nil {
+		if u, oidcErr := oidc.Parse(token); oidcErr == nil {
+			return u, nil
+		}
+	}
+	return user, err
+}
+
+// serveExplain explains the policy decision for the query without running it,
+// users can explain their own queries, admins can explain queries of any user or token
+func (h *handler) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := ExplainRequest{
+		Username: r.Form.Get("user"),
+		Token:    r.Form.Get("token"),
+		Groups:   splitGroups(r.Form.Get("groups")),
+		Database: r.Form.Get("db"),
+		Query:    r.Form.Get("q"),
+	}
+	if req.Query == "" || req.Database == "" {
+		http.Error(w, errExplainParams.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings := h.settings()
+	var user auth.User
+	var err error
+	if req.Username != "" || req.Token != "" || req.Groups != nil {
+		caller, adminErr := h.requireAdmin(r)
+		if adminErr != nil {
+			http.Error(w, adminErr.Error(), http.StatusForbidden)
+			return
+		}
+		glog.Infof("User '%s' explains query '%s' for '%s'", caller.Username, query.RedactPasswords(req.Query), req.Username)
+		user, err = resolveUser(settings, h.signer, h.oidc, req)
+	} else {
+		user, err = h.validate(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(settings.explain(user, req.Database, req.Query)); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// resolveUser returns the user of the token or looks up the user by username,
+// groups of the request replace groups of the user
+func resolveUser(s *settings, signer *auth.Signer, oidc *auth.OIDC, req ExplainRequest) (auth.User, error) {
+	var user auth.User
+	var err error
+	switch {
+	case req.Token != "":
+		user, err = parseToken(signer, oidc, req.Token)
+	case req.Username != "" && req.Groups != nil:
+		// nothing to look up, groups are given
+		user = auth.User{Name: req.Username, Username: req.Username}
+	case req.Username != "":
+		user, err = s.lookup(req.Username)
+	}
+	if err != nil {
+		return user, err
+	}
+	if req.Groups != nil {
+		user.GroupNames = req.Groups
+	}
+	return user, nil
+}
+
+// Explain evaluates the policy of the config for the request without running the query,
+// it is the dry-run of the command line
+func Explain(c viper.Viper, req ExplainRequest) (*explanation, error) {
+	if req.Query == "" || req.Database == "" {
+		return nil, errExplainParams
+	}
+	var policy *conf.PolicyStore
+	if path := c.GetString("policy.path"); path != "" {
+		var err error
+		policy, err = conf.OpenPolicyStore(path, c.GetInt("policy.maxVersions"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSettings(c, nil, policy)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := s.authenticator.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var signer *auth.Signer
+	var oidc *auth.OIDC
+	if req.Token != "" {
+		if signer, err = auth.NewSignerFromConfig(c); err != nil {
+			return nil, err
+		}
+		if oidc, err = auth.NewOIDC(c); err != nil {
+			return nil, err
+		}
+	}
+	user, err := resolveUser(s, signer, oidc, req)
+	if err != nil {
+		return nil, err
+	}
+	e := s.explain(user, req.Database, req.Query)
+	return &e, nil
+}
+
+// splitGroups splits group DNs separated by ';', nil if there are none
+func splitGroups(s string) []string {
+	var groups []string
+	for _, g := range strings.Split(s, ";") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
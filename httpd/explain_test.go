@@ -0,0 +1,138 @@
+package httpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/spf13/viper"
+)
+
+func TestExplain(t *testing.T) {
+	s := newTestSettings(t, decideConf)
+
+	testData := []struct {
+		user    auth.User
+		db      string
+		q       string
+		allowed bool
+		policy  string // cn of the effective group, empty if there is none
+		steps   []string
+	}{
+		{
+			user: auth.User{Username: "john", GroupNames: []string{devsDN}}, db: "metrics", q: "SELECT * FROM cpu",
+			allowed: true, policy: "Devs", steps: []string{"group", "privileges", "blacklist", "group:" + devsDN, "rewrite"},
+		},
+		{
+			user: auth.User{Username: "root", GroupNames: []string{adminDN}}, db: "metrics", q: "DROP DATABASE metrics",
+			allowed: true, policy: "Admin", steps: []string{"group", "admin", "rewrite"},
+		},
+		{
+			user: auth.User{Username: "svc", GroupNames: []string{devsDN}, Databases: []string{"metrics"}}, db: "billing", q: "SELECT * FROM cpu",
+			steps: []string{"databases"},
+		},
+		{
+			user: auth.User{Username: "john", GroupNames: []string{"CN=Unknown"}}, db: "metrics", q: "SELECT * FROM cpu",
+			steps: []string{"group"},
+		},
+		{
+			user: auth.User{Username: "wile", GroupNames: []string{acmeDN}, Tenant: "globex"}, db: "metrics", q: "SELECT * FROM cpu",
+			policy: "Acme", steps: []string{"group", "tenant"},
+		},
+		{
+			user: auth.User{Username: "wile", GroupNames: []string{acmeDN}}, db: "metrics", q: "SELECT * FROM cpu",
+			allowed: true, policy: "Acme", steps: []string{"group", "tenant", "privileges", "blacklist", "group:" + acmeDN, "rewrite"},
+		},
+	}
+	for _, d := range testData {
+		e := s.explain(d.user, d.db, d.q)
+		if e.Decision.Allowed != d.allowed {
+			t.Errorf("%s: want allowed %v, got %v (%s)", d.q, d.allowed, e.Decision.Allowed, e.Decision.Reason)
+		}
+		switch {
+		case d.policy == "" && e.Policy != nil:
+			t.Errorf("%s: want no policy, got %s", d.q, e.Policy.CN)
+		case d.policy != "" && (e.Policy == nil || e.Policy.CN != d.policy):
+			t.Errorf("%s: want policy %s, got %+v", d.q, d.policy, e.Policy)
+		}
+		var steps []string
+		for _, step := range e.Decision.Steps {
+			steps = append(steps, step.Rule)
+		}
+		if strings.Join(steps, ",") != strings.Join(d.steps, ",") {
+			t.Errorf("%s: want steps %v, got %v", d.q, d.steps, steps)
+		}
+		if e.User.Username != d.user.Username || e.User.Groups == nil {
+			t.Errorf("want user %s with groups, got %+v", d.user.Username, e.User)
+		}
+	}
+}
+
+func TestExplainCommand(t *testing.T) {
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBufferString(testConf + decideConf)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Explain(*c, ExplainRequest{Username: "john", Groups: []string{devsDN}}); err != errExplainParams {
+		t.Errorf("want %v, got %v", errExplainParams, err)
+	}
+	e, err := Explain(*c, ExplainRequest{Username: "john", Groups: []string{writersDN}, Database: "metrics", Query: "DROP MEASUREMENT cpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Decision.Allowed || e.Decision.Rule != "group:"+writersDN {
+		t.Errorf("want denied by group:%s, got allowed %v by %s", writersDN, e.Decision.Allowed, e.Decision.Rule)
+	}
+}
+
+func TestServeExplain(t *testing.T) {
+	h, cleanup := newTestHandler(t, decideConf)
+	defer cleanup()
+	dev, admin := token(t, h, "john", devsDN), token(t, h, "root", adminDN)
+
+	testData := []struct {
+		token   string
+		params  url.Values
+		status  int
+		allowed bool
+	}{
+		// users explain their own queries
+		{dev, url.Values{"db": {"metrics"}, "q": {"SELECT * FROM cpu"}}, http.StatusOK, true},
+		{dev, url.Values{"db": {"metrics"}, "q": {"DROP MEASUREMENT cpu"}}, http.StatusOK, false},
+		{dev, url.Values{"db": {"metrics"}}, http.StatusBadRequest, false},
+		// only admins explain queries of other users
+		{dev, url.Values{"db": {"metrics"}, "q": {"SELECT * FROM cpu"}, "user": {"jane"}, "groups": {adminDN}}, http.StatusForbidden, false},
+		{admin, url.Values{"db": {"metrics"}, "q": {"SHOW USERS"}, "user": {"jane"}, "groups": {writersDN}}, http.StatusOK, false},
+		{admin, url.Values{"db": {"metrics"}, "q": {"SELECT * FROM cpu"}, "token": {dev}}, http.StatusOK, true},
+	}
+	for _, d := range testData {
+		r := httptest.NewRequest("GET", "/policy/explain?"+d.params.Encode(), nil)
+		r.Header.Set("AccessToken", d.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != d.status {
+			t.Errorf("%v: want %d, got %d", d.params, d.status, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var e struct {
+			Decision struct {
+				Allowed bool
+			}
+		}
+		if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Decision.Allowed != d.allowed {
+			t.Errorf("%v: want allowed %v, got %v", d.params, d.allowed, e.Decision.Allowed)
+		}
+	}
+}
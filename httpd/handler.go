@@ -4,19 +4,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"gopkg.in/fatih/set.v0"
-
+	"github.com/Maksadbek/influxdb-shim/audit"
 	"github.com/Maksadbek/influxdb-shim/auth"
 	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/metrics"
+	"github.com/Maksadbek/influxdb-shim/query"
 	"github.com/Maksadbek/influxdb-shim/util"
 	"github.com/bmizerany/pat"
 	"github.com/didip/tollbooth"
-	tollboothConfig "github.com/didip/tollbooth/config"
 	"github.com/golang/glog"
 	"github.com/influxdata/influxdb/client/v2"
 	"github.com/spf13/viper"
@@ -27,6 +30,25 @@ var (
 	errProhibitedQuery = errors.New("This query is prohibited")
 	errUserNotFound    = errors.New("User with such uid and password not found")
 	errNoSuchGroup     = errors.New("This group is not configured")
+	errLockedOut       = errors.New("Too many failed login attempts, try again later")
+	errNotAdmin        = errors.New("Only admin group members can access this resource")
+	errNoSuchLockout   = errors.New("Such lockout does not exist")
+	errDatabaseDenied  = errors.New("Access to this database is not allowed")
+	errNoKeyStore      = errors.New("API keys are not configured")
+	errNoPolicyStore   = errors.New("Policy file is not configured")
+	errUnknownCert     = errors.New("Client certificate is not mapped to any user")
+	errTenantMismatch  = errors.New("Tenant of the user is not tenant of the group")
+	errTenantStatement = errors.New("This statement is not allowed for tenants")
+	errTenantDatabase  = errors.New("Query references databases of other tenants")
+)
+
+var (
+	requestsTotal        = metrics.NewCounter("shim_http_requests_total", "Count of HTTP requests.", "route", "status", "group")
+	requestDuration      = metrics.NewHistogram("shim_http_request_duration_seconds", "Latency of HTTP requests.", "route", "status", "group")
+	rateLimited          = metrics.NewCounter("shim_rate_limit_rejections_total", "Count of requests rejected by rate limiter.")
+	loginLockouts        = metrics.NewCounter("shim_login_lockout_rejections_total", "Count of logins rejected by lockout.")
+	blacklistDenials     = metrics.NewCounter("shim_blacklist_denials_total", "Count of queries denied by blacklist.", "group")
+	backendQueryDuration = metrics.NewHistogram("shim_backend_query_duration_seconds", "Latency of queries to InfluxDB.", "database")
 )
 
 type route struct {
@@ -38,69 +60,87 @@ type route struct {
 
 // HTTP handler to InfluxDB
 type handler struct {
-	mux            *pat.PatternServeMux
-	influxConf     client.HTTPConfig
-	blacklist      *set.Set
-	source         *auth.Source
-	signer         *auth.Signer
-	limiter        *tollboothConfig.Limiter
-	groups         conf.Groups
-	useBindDN      bool
-	adminGroupName string
+	mux         *pat.PatternServeMux
+	current     atomic.Value // *settings, swapped on reload
+	reloadMu    sync.Mutex   // serializes reloads
+	lockout     *auth.Lockout
+	keys        *auth.KeyStore
+	policy      *conf.PolicyStore // versioned groups, optional
+	certs       auth.CertMapper
+	oidc        *auth.OIDC // external identity provider, optional
+	requireCert bool       // every caller presents client certificate, JWT is not accepted
+	signer      *auth.Signer
+	conf        viper.Viper // config is read again on reload
+	reloaders   []Reloader  // reloaded after the handler settings are built
+	useBindDN   bool
+	audit       *audit.Logger
 }
 
 // NewHandler create new handler object
 func NewHandler(c viper.Viper) *handler {
-	//	client.HTTPConfig, b *set.Set, source *auth.Source, signer *auth.Signer, groups conf.Groups
-	influxConfig := client.HTTPConfig{
-		Addr:      c.GetString("influxdb.addr"),
-		Username:  c.GetString("influxdb.username"),
-		Password:  c.GetString("influxdb.password"),
-		UserAgent: c.GetString("influxdb.userAgent"),
-	}
-	// blacklist of queries
-	blacklist := set.New()
-	for _, v := range c.GetStringSlice("blacklist.queries") {
-		blacklist.Add(strings.ToLower(strings.Replace(v, " ", "", -1)))
-	}
-	// new LDAP source
-	source := auth.NewSource(c)
-	// get public & priv keys for token signing
-	pubKey, err := ioutil.ReadFile(c.GetString("auth.token.pubKeyPath"))
-	if err != nil {
-		glog.Errorf("Unable to get public key path from config: %s", err.Error())
+	// groups managed by admin API, they override groups of the config
+	var policy *conf.PolicyStore
+	if path := c.GetString("policy.path"); path != "" {
+		var err error
+		policy, err = conf.OpenPolicyStore(path, c.GetInt("policy.maxVersions"))
+		if err != nil {
+			glog.Errorf("Unable to open policy file: %s", err.Error())
+			return nil
+		}
+	}
+	// groups, blacklist, rate limits and auth backends
+	current, err := newSettings(c, nil, policy)
+	if err != nil {
+		glog.Errorf("Unable to create handler settings: %s", err.Error())
 		return nil
 	}
-
-	privKey, err := ioutil.ReadFile(c.GetString("auth.token.privKeyPath"))
+	// keyset for token signing
+	signer, err := auth.NewSignerFromConfig(c)
+	if err != nil {
+		glog.Errorf("Unable to load token signing keys: %s", err.Error())
+		return nil
+	}
+	// managed API keys of service accounts, static keys are the "apikeys" auth backend
+	var keys *auth.KeyStore
+	if path := c.GetString("auth.managedKeys.path"); path != "" {
+		keys, err = auth.OpenKeyStore(path)
+		if err != nil {
+			glog.Errorf("Unable to open API keys store: %s", err.Error())
+			return nil
+		}
+	}
+	// client certificate to user mapping
+	certs, err := auth.NewCertMapper(c)
 	if err != nil {
-		glog.Errorf("Unable to get private key path from config: %s", err.Error())
+		glog.Errorf("Unable to create client certificate rules: %s", err.Error())
 		return nil
 	}
-	// create new token signer
-	signer := auth.NewSigner(
-		privKey,
-		pubKey,
-		c.GetString("auth.token.method"),
-		c.GetInt("auth.token.ttl"),
-	)
-	// get groups list from config
-	groups, err := conf.NewGroups(c)
-	if err != nil {
-		glog.Errorf("Unable to unmarshal list of groups: %s", err.Error())
+	// tokens of the external OIDC identity provider
+	oidc, err := auth.NewOIDC(c)
+	if err != nil {
+		glog.Errorf("Unable to create OIDC verifier: %s", err.Error())
+		return nil
+	}
+	// audit log of auth and query decisions
+	auditLogger, err := audit.New(c)
+	if err != nil {
 		return nil
 	}
 
 	h := &handler{
-		mux:            pat.New(),
-		influxConf:     influxConfig,
-		blacklist:      blacklist,
-		source:         source,
-		signer:         signer,
-		groups:         *groups,
-		adminGroupName: c.GetString("blacklist.adminGroup"),
-		limiter:        tollbooth.NewLimiter(int64(c.GetInt("qos.limit")), time.Duration(c.GetInt("qos.ttl"))*time.Second),
+		mux:         pat.New(),
+		lockout:     auth.NewLockout(c),
+		keys:        keys,
+		policy:      policy,
+		certs:       certs,
+		oidc:        oidc,
+		requireCert: c.GetString("web.tls.clientAuth") == "require",
+		signer:      signer,
+		conf:        c,
+		audit:       auditLogger,
 	}
+	h.current.Store(current)
+	current.downsampler.start(nil)
 
 	h.SetRoutes([]route{
 		route{
@@ -111,17 +151,110 @@ func NewHandler(c viper.Viper) *handler {
 			"auth",
 			"POST", "/auth", h.serveAuth,
 		},
+		route{
+			"lockouts",
+			"GET", "/admin/lockouts", h.serveLockouts,
+		},
+		route{
+			"lockouts",
+			"DELETE", "/admin/lockouts/:key", h.serveClearLockout,
+		},
+		route{
+			"jwks",
+			"GET", "/.well-known/jwks.json", h.serveJWKS,
+		},
+		route{
+			"signing-keys",
+			"GET", "/admin/signing-keys", h.serveSigningKeys,
+		},
+		route{
+			"reload",
+			"POST", "/admin/reload", h.serveReload,
+		},
+		route{
+			"signing-keys",
+			"POST", "/admin/signing-keys/:kid/activate", h.serveActivateSigningKey,
+		},
+		route{
+			"signing-keys",
+			"POST", "/admin/signing-keys/:kid/retire", h.serveRetireSigningKey,
+		},
+		route{
+			"groups",
+			"GET", "/admin/groups", h.serveGroups,
+		},
+		route{
+			"groups",
+			"POST", "/admin/groups", h.serveCreateGroup,
+		},
+		route{
+			"groups",
+			"PUT", "/admin/groups/:name", h.serveUpdateGroup,
+		},
+		route{
+			"groups",
+			"DELETE", "/admin/groups/:name", h.serveDeleteGroup,
+		},
+		route{
+			"policy",
+			"GET", "/admin/policy/versions", h.servePolicyVersions,
+		},
+		route{
+			"policy",
+			"POST", "/admin/policy/versions/:version/rollback", h.serveRollbackPolicy,
+		},
+		route{
+			"explain",
+			"GET", "/policy/explain", h.serveExplain,
+		},
+		route{
+			"explain",
+			"POST", "/policy/explain", h.serveExplain,
+		},
+		route{
+			"keys",
+			"GET", "/admin/keys", h.serveKeys,
+		},
+		route{
+			"keys",
+			"POST", "/admin/keys", h.serveCreateKey,
+		},
+		route{
+			"keys",
+			"DELETE", "/admin/keys/:id", h.serveRevokeKey,
+		},
 	})
+	// serve metrics to admins here if separate admin listener is not configured
+	if c.GetString("admin.addr") == "" {
+		h.SetRoutes([]route{
+			route{
+				"metrics",
+				"GET", "/metrics", h.serveMetrics,
+			},
+		})
+	}
 	return h
 }
 
+// Close stops discovery of retention policies and flushes the audit log,
+// it must be called after requests are served
+func (h *handler) Close() error {
+	h.reloadMu.Lock()
+	h.settings().downsampler.close()
+	h.reloadMu.Unlock()
+	return h.audit.Close()
+}
+
 func (h *handler) SetRoutes(routes []route) {
 	for _, r := range routes {
 		var handler http.Handler
-		if hf, ok := r.handleFunc.(func(http.ResponseWriter, *http.Request)); ok {
+		switch hf := r.handleFunc.(type) {
+		case func(http.ResponseWriter, *http.Request):
 			handler = http.HandlerFunc(hf)
+		case http.Handler:
+			handler = hf
 		}
-		h.mux.Add(r.method, r.pattern, handler)
+		h.mux.Add(r.method, r.pattern, instrument(r.name, handler))
 	}
 }
 
@@ -130,44 +263,74 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handler) serveAuth(w http.ResponseWriter, r *http.Request) {
+	rec := audit.Record{Action: "auth", SourceIP: sourceIP(r), Decision: audit.Error}
+	defer h.logAudit(&rec, time.Now())
+
 	err := r.ParseForm()
 	if err != nil {
 		glog.Errorf("Unable to parse form: %v", err)
+		rec.Error = err.Error()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	uid, p := r.Form.Get("uid"), r.Form.Get("p")
-	user, logged := h.source.Login(uid, p)
+	rec.Username = uid
+	// reject before contacting LDAP if user or source IP is blocked
+	if wait := h.lockout.Check(uid, rec.SourceIP); wait > 0 {
+		glog.Errorf("Login of uid '%s' from %s is blocked for %s", uid, rec.SourceIP, wait)
+		loginLockouts.Inc()
+		rec.Decision, rec.Rule = audit.Deny, "lockout"
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, errLockedOut.Error(), http.StatusTooManyRequests)
+		return
+	}
+	user, logged := h.settings().authenticator.Authenticate(uid, p)
 	if !logged {
-		glog.Errorf("Invalid user credentials: uid: '%s', password: '%s'", uid, p)
+		glog.Errorf("Invalid user credentials: uid: '%s'", uid)
+		h.lockout.Fail(uid, rec.SourceIP)
+		rec.Decision, rec.Rule = audit.Deny, "credentials"
 		http.Error(w, errUserNotFound.Error(), http.StatusUnauthorized)
 		return
 	}
+	h.lockout.Succeed(uid, rec.SourceIP)
+	rec.Groups = user.GroupNames
 
 	tokenString, err := h.signer.Sign(user)
 	if err != nil {
 		glog.Errorf("Unable to sign the token: %s", err.Error())
+		rec.Error = err.Error()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rec.Decision, rec.Rule = audit.Allow, user.Source
+	// report the backend that authenticated the user
+	w.Header().Set("X-Auth-Backend", user.Source)
 	// send token back
-	fmt.Fprintf(w, tokenString)
+	fmt.Fprint(w, tokenString)
 }
 
 // serveQuery is the query handler that receives InfluxDB queries and send results back
 // it checks access through access token that is passed on query header
 func (h *handler) serveQuery(w http.ResponseWriter, r *http.Request) {
+	rec := audit.Record{Action: "query", SourceIP: sourceIP(r), Decision: audit.Error}
+	defer h.logAudit(&rec, time.Now())
+
 	err := r.ParseForm()
 	if err != nil {
 		glog.Errorf("Unable to parse form: %v", err)
+		rec.Error = err.Error()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	q := r.Form.Get("q")   // user
 	db := r.Form.Get("db") // database
+	// passwords of CREATE USER and SET PASSWORD are never logged
+	logged := query.RedactPasswords(q)
+	rec.Query, rec.Database = util.NormalizeQuery(logged), db
 
 	if q == "" || db == "" {
 		glog.Errorf("Query does not contain query string or database")
+		rec.Error = "missing query or database"
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
@@ -176,30 +339,45 @@ func (h *handler) serveQuery(w http.ResponseWriter, r *http.Request) {
 	// check token key and rate limit
 	user, err := h.validate(r)
 	if err != nil {
+		rec.Decision, rec.Rule, rec.Error = audit.Deny, "token", err.Error()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// search for group names
-	group, found := h.groups.Search(user.GroupNames...)
-	// if groups was not found, then fail
-	if !found {
-		http.Error(w, errNoSuchGroup.Error(), http.StatusBadRequest)
-		return
+	rec.Username, rec.Groups = user.Username, user.GroupNames
+	// settings are loaded once, so reload does not change them in the middle of the request
+	settings := h.settings()
+	d := settings.decide(user, db, q)
+	if d.Group != "" {
+		setGroup(w, d.Group)
 	}
-
-	cleanedQuery := util.CleanQuery(q)
-	// check if the query in global blacklist or denied for user's group
-	// also check if user in admin group, if yes, then proceed
-	if (h.blacklist.Has(cleanedQuery) || group.HasQuery(q)) && group.GetFullname() != h.adminGroupName {
-		glog.Infof("The query('%s') in blacklist", q)
-		http.Error(w, errProhibitedQuery.Error(), http.StatusForbidden)
+	rec.Rule = d.Rule
+	if !d.Allowed {
+		glog.Infof("The query('%s') is denied by %s", logged, d.Rule)
+		if d.Rule == "blacklist" || strings.HasPrefix(d.Rule, "group:") {
+			blacklistDenials.Inc(d.Group)
+		}
+		rec.Decision = audit.Deny
+		http.Error(w, d.Reason, d.status)
 		return
 	}
+	q, db = d.Query, d.Database
+	if d.redactor != nil {
+		// hashed values of conditions are replaced by raw values known from previous results
+		if q, err = d.redactor.conditions(q); err != nil {
+			rec.Decision, rec.Rule, rec.Error = audit.Deny, "redaction", err.Error()
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	rec.Decision = audit.Allow
+	if len(d.RetentionPolicies) > 0 {
+		w.Header().Set(retentionPolicyHeader, strings.Join(d.RetentionPolicies, ", "))
+	}
 
-	glog.Infof("Query '%s' to database: '%s'", q, db)
+	glog.Infof("Query '%s' to database: '%s'", query.RedactPasswords(d.Query), db)
 
 	// create new InfluxDB client
-	c, err := client.NewHTTPClient(h.influxConf)
+	c, err := client.NewHTTPClient(settings.influxConf)
 	if err != nil {
 		glog.Errorf("Unable to open connection to InfluxDB: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -207,13 +385,22 @@ func (h *handler) serveQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// send query to InfluxDB
-	query := client.NewQuery(q, db, "ns")
-	response, err := c.Query(query)
+	influxQuery := client.NewQuery(q, db, "ns")
+	start := time.Now()
+	response, err := c.Query(influxQuery)
+	backendQueryDuration.Since(start, db)
 	if err != nil {
 		glog.Errorf("Unable to run query to InfluxDB: %v", err)
+		rec.Error = err.Error()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rec.Rows = countRows(response)
+	// users see virtual names only
+	renameResponse(response, q, settings.aliases, settings.tenants, d.Tenant)
+	if d.redactor != nil {
+		d.redactor.redact(response, q)
+	}
 
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(response); err != nil {
@@ -222,11 +409,253 @@ func (h *handler) serveQuery(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveLockouts lists failed logins of usernames and source IPs
+func (h *handler) serveLockouts(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.requireAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.lockout.List()); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveClearLockout removes the lockout by key, e.g: "user:tesla" or "ip:127.0.0.1"
+func (h *handler) serveClearLockout(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key := r.URL.Query().Get(":key")
+	if !h.lockout.Clear(key) {
+		http.Error(w, errNoSuchLockout.Error(), http.StatusNotFound)
+		return
+	}
+	glog.Infof("Lockout '%s' is cleared by %s", key, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveJWKS publishes public keys of the token signer,
+// so other services can validate tokens issued by the shim
+func (h *handler) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	if err := json.NewEncoder(w).Encode(h.signer.JWKS()); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveSigningKeys lists token signing keys
+func (h *handler) serveSigningKeys(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.requireAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.signer.Keys()); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveReload reads the config file again and applies it, the same as SIGHUP does
+func (h *handler) serveReload(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	glog.Infof("Config reload is requested by %s", user.Username)
+	if err := h.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveActivateSigningKey makes the key active, new tokens are signed by it
+func (h *handler) serveActivateSigningKey(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	kid := r.URL.Query().Get(":kid")
+	if err := h.signer.Activate(kid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("Signing key %s is activated by %s", kid, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRetireSigningKey stops accepting tokens signed by the key
+func (h *handler) serveRetireSigningKey(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	kid := r.URL.Query().Get(":kid")
+	if err := h.signer.Retire(kid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("Signing key %s is retired by %s", kid, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveKeys lists API keys of service accounts
+func (h *handler) serveKeys(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.requireAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if h.keys == nil {
+		http.Error(w, errNoKeyStore.Error(), http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.keys.List()); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveCreateKey creates API key by form params:
+// service, group(multiple), db(multiple) and cidr
+// the key is returned only once in the response
+func (h *handler) serveCreateKey(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if h.keys == nil {
+		http.Error(w, errNoKeyStore.Error(), http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		glog.Errorf("Unable to parse form: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, g := range r.Form["group"] {
+		if _, found := h.settings().groups.Search(g); !found {
+			http.Error(w, errNoSuchGroup.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	key, k, err := h.keys.Create(r.Form.Get("service"), r.Form["group"], r.Form["db"], r.Form.Get("cidr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("API key %s is created by %s", k.ID, user.Username)
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(struct {
+		Key string `json:"key"`
+		auth.APIKey
+	}{key, k})
+	if err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+	}
+}
+
+// serveRevokeKey deletes API key by id
+func (h *handler) serveRevokeKey(w http.ResponseWriter, r *http.Request) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if h.keys == nil {
+		http.Error(w, errNoKeyStore.Error(), http.StatusNotFound)
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	if err := h.keys.Revoke(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	glog.Infof("API key %s is revoked by %s", id, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAdmin validates the request and checks that user is the admin
+func (h *handler) requireAdmin(r *http.Request) (auth.User, error) {
+	user, err := h.validate(r)
+	if err != nil {
+		return user, err
+	}
+	if user.IsAdmin {
+		return user, nil
+	}
+	settings := h.settings()
+	if group, found := settings.groups.Search(user.GroupNames...); found && group.GetFullname() == settings.adminGroupName {
+		return user, nil
+	}
+	glog.Errorf("User '%s' is not an admin", user.Username)
+	return user, errNotAdmin
+}
+
+// serveMetrics exports metrics on the web listener, they name users and groups, so only admins can read them
+func (h *handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.requireAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// logAudit writes the audit record with the latency since start
+func (h *handler) logAudit(rec *audit.Record, start time.Time) {
+	rec.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	h.audit.Log(*rec)
+}
+
+// sourceIP returns the IP address of the client
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// countRows returns count of rows in all series of the response
+func countRows(response *client.Response) int {
+	rows := 0
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			rows += len(series.Values)
+		}
+	}
+	return rows
+}
+
 // validate gets http.Request and validates token key
 // gets AccessToken from request header and parses with the token signer
 // returns user object and error value
 func (h *handler) validate(r *http.Request) (auth.User, error) {
 	var user auth.User
+	// callers with verified client certificate skip JWT
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return h.validateCert(r)
+	}
+	if h.requireCert {
+		return user, errUnknownCert
+	}
+	// service accounts present API key in form of "Authorization: Token <key>"
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Token ") {
+		return h.validateKey(r, strings.TrimPrefix(authorization, "Token "))
+	}
+	// tokens of the OIDC identity provider are sent as "Authorization: Bearer <token>"
+	if strings.HasPrefix(authorization, "Bearer ") && h.oidc != nil {
+		return h.validateOIDC(strings.TrimPrefix(authorization, "Bearer "))
+	}
 	// get access token and verify
 	tokenString := r.Header.Get("AccessToken")
 	if tokenString == "" {
@@ -234,12 +663,65 @@ func (h *handler) validate(r *http.Request) (auth.User, error) {
 		return user, errNoTokenKey
 	}
 	// check the limit
-	httpErr := tollbooth.LimitByKeys(h.limiter, []string{tokenString})
+	httpErr := tollbooth.LimitByKeys(h.settings().limiter, []string{tokenString})
 	if httpErr != nil {
 		glog.Errorf("Rate limit reached: %s", httpErr.Message)
+		rateLimited.Inc()
 		return user, errors.New(httpErr.Error())
 	}
 	// try to parse token key payload to user struct
 	user, err := h.signer.Parse(tokenString)
 	return user, err
 }
+
+// validateCert maps the verified client certificate to the user and checks the rate limit
+func (h *handler) validateCert(r *http.Request) (auth.User, error) {
+	cert := r.TLS.VerifiedChains[0][0]
+	user, ok := h.certs.Map(cert)
+	if !ok {
+		glog.Errorf("Client certificate '%s' does not match any rule", cert.Subject.CommonName)
+		return user, errUnknownCert
+	}
+	httpErr := tollbooth.LimitByKeys(h.settings().limiter, []string{"cert:" + user.Username})
+	if httpErr != nil {
+		glog.Errorf("Rate limit reached: %s", httpErr.Message)
+		rateLimited.Inc()
+		return auth.User{}, errors.New(httpErr.Error())
+	}
+	return user, nil
+}
+
+// validateOIDC verifies the token of the identity provider and checks the rate limit
+func (h *handler) validateOIDC(token string) (auth.User, error) {
+	user, err := h.oidc.Parse(token)
+	if err != nil {
+		glog.Errorf("Invalid OIDC token: %s", err.Error())
+		return user, err
+	}
+	httpErr := tollbooth.LimitByKeys(h.settings().limiter, []string{"oidc:" + user.Username})
+	if httpErr != nil {
+		glog.Errorf("Rate limit reached: %s", httpErr.Message)
+		rateLimited.Inc()
+		return auth.User{}, errors.New(httpErr.Error())
+	}
+	return user, nil
+}
+
+// validateKey verifies API key of the service account and checks the rate limit
+func (h *handler) validateKey(r *http.Request, key string) (auth.User, error) {
+	if h.keys == nil {
+		return auth.User{}, errNoKeyStore
+	}
+	k, err := h.keys.Verify(key, net.ParseIP(sourceIP(r)))
+	if err != nil {
+		glog.Errorf("Invalid API key: %s", err.Error())
+		return auth.User{}, err
+	}
+	httpErr := tollbooth.LimitByKeys(h.settings().limiter, []string{k.ID})
+	if httpErr != nil {
+		glog.Errorf("Rate limit reached: %s", httpErr.Message)
+		rateLimited.Inc()
+		return auth.User{}, errors.New(httpErr.Error())
+	}
+	return k.User(), nil
+}
@@ -0,0 +1,179 @@
+package httpd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/spf13/viper"
+)
+
+// newTestHandler creates the handler of testConf and the extra config with HMAC signing key,
+// the returned function removes its files
+func newTestHandler(t *testing.T, extra string) (*handler, func()) {
+	dir, err := ioutil.TempDir("", "httpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("test secret"), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	c := viper.New()
+	c.SetConfigType("toml")
+	config := testConf + fmt.Sprintf(`
+[auth.token]
+    method = "HS256"
+    ttl = 10
+    privKeyPath = %q
+    pubKeyPath = %q
+[qos]
+    limit = 1000
+    ttl = 1
+`, secret, secret) + extra
+	if err := c.ReadConfig(bytes.NewBufferString(config)); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	h := NewHandler(*c)
+	if h == nil {
+		os.RemoveAll(dir)
+		t.Fatal("unable to create handler")
+	}
+	return h, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// token signs the token of the user of groups
+func token(t *testing.T, h *handler, username string, groups ...string) string {
+	s, err := h.signer.Sign(auth.User{Name: username, Username: username, GroupNames: groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMetricsRequireAdmin(t *testing.T) {
+	h, cleanup := newTestHandler(t, "")
+	defer cleanup()
+
+	testData := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusForbidden},
+		{token(t, h, "dev", "CN=Devs,OU=Eng,DC=example,DC=com"), http.StatusForbidden},
+		{token(t, h, "root", "CN=Admin,OU=Global,DC=example,DC=com"), http.StatusOK},
+	}
+	for _, d := range testData {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if d.token != "" {
+			r.Header.Set("AccessToken", d.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != d.want {
+			t.Errorf("want %d, got %d", d.want, w.Code)
+		}
+	}
+}
+
+// fakeInfluxDB records queries and returns one series of logins to every query
+type fakeInfluxDB struct {
+	*httptest.Server
+	queries []string // db and q params of received queries
+}
+
+func newFakeInfluxDB() *fakeInfluxDB {
+	f := &fakeInfluxDB{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.queries = append(f.queries, r.FormValue("db")+": "+r.FormValue("q"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"results":[{"series":[{"name":"logins","columns":["time","email","value"],"values":[[1,"alice@example.com",1]]}]}]}`)
+	}))
+	return f
+}
+
+func TestServeQuery(t *testing.T) {
+	influx := newFakeInfluxDB()
+	defer influx.Close()
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditPath := filepath.Join(dir, "audit.log")
+	h, cleanup := newTestHandler(t, decideConf+fmt.Sprintf(`
+[influxdb]
+    addr = %q
+[audit]
+    path = %q
+`, influx.URL, auditPath))
+	defer cleanup()
+
+	testData := []struct {
+		token  string
+		db     string
+		q      string
+		status int
+		sent   string // query received by InfluxDB, nothing if empty
+		body   string // part of the response body
+		hidden string // value that must not be returned
+	}{
+		{token(t, h, "john", devsDN), "metrics", "SELECT * FROM logins", http.StatusOK, "metrics: SELECT * FROM logins", "alice@example.com", ""},
+		{token(t, h, "john", devsDN), "metrics", "DROP MEASUREMENT logins", http.StatusForbidden, "", "privilege is required", ""},
+		{"", "metrics", "SELECT * FROM logins", http.StatusBadRequest, "", "", ""},
+		{token(t, h, "john", devsDN), "", "SELECT * FROM logins", http.StatusBadRequest, "", "", ""},
+		{token(t, h, "john", "CN=Unknown"), "metrics", "SELECT * FROM logins", http.StatusBadRequest, "", "", ""},
+		// rewrites of tenants and aliases are sent, redacted values are not returned
+		{token(t, h, "wile", acmeDN), "metrics", "SELECT * FROM logins", http.StatusOK, "acme_metrics: SELECT * FROM logins", "logins", ""},
+		{token(t, h, "john", devsDN), "payments", "SELECT * FROM payments..logins", http.StatusOK, "payments_prod: SELECT * FROM payments_prod..logins", "", ""},
+		{token(t, h, "sam", supportDN), "metrics", "SELECT * FROM logins", http.StatusOK, "metrics: SELECT * FROM logins", `"columns":["time","value"]`, "alice"},
+		{token(t, h, "root", adminDN), "metrics", "CREATE USER bob WITH PASSWORD 'secret'", http.StatusOK, "metrics: CREATE USER bob WITH PASSWORD 'secret'", "", ""},
+	}
+	for _, d := range testData {
+		influx.queries = nil
+		r := httptest.NewRequest("GET", "/query?"+url.Values{"db": {d.db}, "q": {d.q}}.Encode(), nil)
+		if d.token != "" {
+			r.Header.Set("AccessToken", d.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != d.status {
+			t.Errorf("%s: want %d, got %d: %s", d.q, d.status, w.Code, w.Body.String())
+			continue
+		}
+		if sent := strings.Join(influx.queries, "; "); sent != d.sent {
+			t.Errorf("%s: want %q sent to InfluxDB, got %q", d.q, d.sent, sent)
+		}
+		if !strings.Contains(w.Body.String(), d.body) {
+			t.Errorf("%s: want %s in the response, got %s", d.q, d.body, w.Body.String())
+		}
+		if d.hidden != "" && strings.Contains(w.Body.String(), d.hidden) {
+			t.Errorf("%s: want %s redacted, got %s", d.q, d.hidden, w.Body.String())
+		}
+	}
+
+	// every decision is audited, passwords are not
+	b, err := ioutil.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != len(testData) {
+		t.Errorf("want %d audit records, got %d", len(testData), lines)
+	}
+	if strings.Contains(string(b), "secret") || !strings.Contains(string(b), "[REDACTED]") {
+		t.Errorf("want redacted password in audit log, got %s", b)
+	}
+}
@@ -1,59 +1,154 @@
 package httpd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/Maksadbek/influxdb-shim/metrics"
+	"github.com/bmizerany/pat"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
 )
 
+var errInvalidConfig = errors.New("Unable to create handler, see the log for details")
+
 // service
 type service struct {
-	ln      net.Listener
-	addr    string
-	err     chan error
-	Handler *handler
+	ln          net.Listener
+	addr        string
+	server      *http.Server
+	adminLn     net.Listener
+	admin       string // address of admin listener, optional
+	adminServer *http.Server
+	tls         *tls.Config   // HTTPS config, plain HTTP if nil
+	certs       *certReloader // server certificate of HTTPS
+	http2       bool          // serve HTTP/2 over HTTPS
+	err         chan error
+	Handler     *handler
 }
 
 func NewService(c viper.Viper) (*service, error) {
+	// HTTPS with optional client certificates
+	tlsConfig, certs, err := newTLSConfig(c)
+	if err != nil {
+		glog.Errorf("Unable to configure TLS: %s", err.Error())
+		return nil, err
+	}
+	handler := NewHandler(c)
+	if handler == nil {
+		return nil, errInvalidConfig
+	}
 	// create a new web service
 	s := &service{
 		addr:    c.GetString("web.addr"),
-		Handler: NewHandler(c),
+		admin:   c.GetString("admin.addr"),
+		tls:     tlsConfig,
+		certs:   certs,
+		http2:   !c.GetBool("web.tls.disableHTTP2"),
+		Handler: handler,
 		err:     make(chan error),
 	}
+	s.server = &http.Server{Handler: handler}
+	if s.tls != nil {
+		// ServeTLS negotiates HTTP/2 by ALPN unless TLSNextProto is set to empty map
+		s.server.TLSConfig = s.tls
+		if !s.http2 {
+			s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+	mux := pat.New()
+	mux.Get("/metrics", metrics.Handler())
+	s.adminServer = &http.Server{Handler: mux}
 
 	return s, nil
 }
 
 func (s *service) Open() error {
+	if s.admin != "" {
+		if err := s.openAdmin(); err != nil {
+			return err
+		}
+	}
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
-	glog.Info("listening on HTTP:", listener.Addr().String())
+	if s.tls != nil {
+		if err := s.certs.Watch(); err != nil {
+			listener.Close()
+			return err
+		}
+		glog.Info("listening on HTTPS:", listener.Addr().String())
+	} else {
+		glog.Info("listening on HTTP:", listener.Addr().String())
+	}
 	s.ln = listener
 	s.serve()
 	return nil
 }
 
 func (s *service) serve() {
-	err := http.Serve(s.ln, s.Handler)
+	var err error
+	if s.tls != nil {
+		err = s.server.ServeTLS(s.ln, "", "")
+	} else {
+		err = s.server.Serve(s.ln)
+	}
 	if err != nil && !strings.Contains(err.Error(), "closed") {
 		s.err <- fmt.Errorf("listener failed: addr=%s, err=%s", s.addr, err)
 	}
 }
 
-func (s *service) Close() error {
-	if s.ln != nil {
-		return s.ln.Close()
+// openAdmin starts the admin listener that serves shim internals
+func (s *service) openAdmin() error {
+	listener, err := net.Listen("tcp", s.admin)
+	if err != nil {
+		return err
 	}
+	glog.Info("listening on admin HTTP:", listener.Addr().String())
+	s.adminLn = listener
+
+	go func() {
+		err := s.adminServer.Serve(listener)
+		if err != nil && !strings.Contains(err.Error(), "closed") {
+			s.err <- fmt.Errorf("admin listener failed: addr=%s, err=%s", s.admin, err)
+		}
+	}()
 	return nil
 }
 
+// Close closes listeners and connections immediately
+func (s *service) Close() error {
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	s.adminServer.Close()
+	err := s.server.Close()
+	s.Handler.Close()
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done,
+// then flushes the audit log
+func (s *service) Shutdown(ctx context.Context) error {
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	s.adminServer.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		// requests that are still running are cut off
+		s.server.Close()
+	}
+	s.Handler.Close()
+	return err
+}
+
 func (s *service) Err() <-chan error {
 	return s.err
 }
@@ -0,0 +1,142 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/golang/glog"
+)
+
+// groupsResponse is the current policy version with its groups
+type groupsResponse struct {
+	Version int          `json:"version"`
+	Groups  []conf.Group `json:"groups"`
+}
+
+// requirePolicy checks that the caller is admin and the policy file is configured,
+// returns the username of the admin
+func (h *handler) requirePolicy(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := h.requireAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", false
+	}
+	if h.policy == nil {
+		http.Error(w, errNoPolicyStore.Error(), http.StatusNotFound)
+		return "", false
+	}
+	return user.Username, true
+}
+
+// serveGroups lists groups of the current policy version
+func (h *handler) serveGroups(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePolicy(w, r); !ok {
+		return
+	}
+	resp := groupsResponse{
+		Version: h.policy.Current().Version,
+		Groups:  h.settings().groups.List(),
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveCreateGroup adds the group of JSON body
+func (h *handler) serveCreateGroup(w http.ResponseWriter, r *http.Request) {
+	h.updatePolicy(w, r, http.StatusCreated, func(groups conf.Groups, group conf.Group) error {
+		return groups.Add(group)
+	})
+}
+
+// serveUpdateGroup replaces the group by its full name with the group of JSON body
+func (h *handler) serveUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	h.updatePolicy(w, r, http.StatusOK, func(groups conf.Groups, group conf.Group) error {
+		return groups.Replace(name, group)
+	})
+}
+
+// serveDeleteGroup deletes the group by its full name
+func (h *handler) serveDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	h.updatePolicy(w, r, http.StatusOK, func(groups conf.Groups, _ conf.Group) error {
+		return groups.Delete(name)
+	})
+}
+
+// updatePolicy saves the change as the new policy version and applies it,
+// optional "version" param is the version the change is based on, the change is rejected if it is not current
+// optional "comment" param is saved with the version
+func (h *handler) updatePolicy(w http.ResponseWriter, r *http.Request, status int, change func(conf.Groups, conf.Group) error) {
+	author, ok := h.requirePolicy(w, r)
+	if !ok {
+		return
+	}
+	var group conf.Group
+	if r.Method != "DELETE" {
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	base := h.policy.Current().Version
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if base, err = strconv.Atoi(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	version, err := h.policy.Update(base, h.settings().configGroups, author, r.URL.Query().Get("comment"), func(groups conf.Groups) error {
+		return change(groups, group)
+	})
+	if err != nil {
+		glog.Errorf("Policy change by %s is rejected: %s", author, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.applyPolicy()
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(groupsResponse{version.Version, version.Groups}); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+	}
+}
+
+// servePolicyVersions lists saved policy versions, the latest first
+func (h *handler) servePolicyVersions(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePolicy(w, r); !ok {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.policy.Versions()); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveRollbackPolicy saves groups of the previous version as the new version and applies them
+func (h *handler) serveRollbackPolicy(w http.ResponseWriter, r *http.Request) {
+	author, ok := h.requirePolicy(w, r)
+	if !ok {
+		return
+	}
+	v, err := strconv.Atoi(r.URL.Query().Get(":version"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := h.policy.Rollback(v, author)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.applyPolicy()
+	glog.Infof("Policy is rolled back to version %d by %s", v, author)
+	if err := json.NewEncoder(w).Encode(groupsResponse{version.Version, version.Groups}); err != nil {
+		glog.Errorf("unable to encode json: %s", err.Error())
+	}
+}
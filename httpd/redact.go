@@ -0,0 +1,361 @@
+package httpd
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/query"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+var (
+	errNoHMACKey          = errors.New("Hash redaction requires redaction.hmacKey")
+	errHiddenRedacted     = errors.New("Redacted keys can not be renamed or passed to functions")
+	errRedactedCondition  = errors.New("Redacted keys can not be used in conditions, except equality to hashed values")
+	errUnknownHashedValue = errors.New("Hashed value of the condition is unknown, it must be taken from query results")
+)
+
+// default mask of masked values
+const defaultMask = "***"
+
+// max count of hashed values remembered to resolve conditions
+const maxHashes = 100000
+
+// hashIndex maps hashed values returned to users back to raw values,
+// so users can filter by values they see, e.g: WHERE email = '<hash>'.
+// The least recently used hashes are forgotten when the index is full,
+// conditions with forgotten hashes are rejected with errUnknownHashedValue
+type hashIndex struct {
+	mu     sync.Mutex
+	size   int
+	values map[string]*list.Element // hash to the element of hashEntry
+	lru    *list.List               // the most recently used hashes are in front
+}
+
+type hashEntry struct {
+	hash, value string
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{size: maxHashes, values: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (h *hashIndex) add(hash, value string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.values[hash]; ok {
+		h.lru.MoveToFront(e)
+		return
+	}
+	h.values[hash] = h.lru.PushFront(hashEntry{hash: hash, value: value})
+	if h.lru.Len() > h.size {
+		oldest := h.lru.Back()
+		h.lru.Remove(oldest)
+		delete(h.values, oldest.Value.(hashEntry).hash)
+	}
+}
+
+func (h *hashIndex) lookup(hash string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.values[hash]
+	if !ok {
+		return "", false
+	}
+	h.lru.MoveToFront(e)
+	return e.Value.(hashEntry).value, true
+}
+
+// redactor applies redaction rules of the group to query results
+type redactor struct {
+	rules    []conf.Redaction
+	patterns []*regexp.Regexp // compiled patterns of rules, nil if the whole value is masked
+	key      []byte           // HMAC key of hashed values
+	hashes   *hashIndex
+}
+
+func newRedactor(rules []conf.Redaction, key []byte, hashes *hashIndex) (*redactor, error) {
+	r := &redactor{rules: rules, patterns: make([]*regexp.Regexp, len(rules)), key: key, hashes: hashes}
+	for i, rule := range rules {
+		switch rule.Action {
+		case conf.RedactHash:
+			if len(key) == 0 {
+				return nil, errNoHMACKey
+			}
+		case conf.RedactMask:
+			if rule.Pattern != "" {
+				p, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					return nil, err
+				}
+				r.patterns[i] = p
+			}
+		}
+	}
+	return r, nil
+}
+
+// keys returns tag and field keys of the rules
+func (r *redactor) keys() []string {
+	keys := make([]string, 0, len(r.rules))
+	for _, rule := range r.rules {
+		keys = append(keys, rule.Key)
+	}
+	return keys
+}
+
+// rule returns the index of the rule of the key, -1 if the key is not redacted
+func (r *redactor) rule(measurement, key string) int {
+	for i, rule := range r.rules {
+		if rule.Matches(measurement, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// value returns the redacted value, false if the value is dropped
+func (r *redactor) value(i int, v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	rule := r.rules[i]
+	switch rule.Action {
+	case conf.RedactDrop:
+		return nil, false
+	case conf.RedactHash:
+		// keyed hash keeps equal values equal, so hashed values can still be grouped
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(s))
+		hash := hex.EncodeToString(mac.Sum(nil)[:16])
+		r.hashes.add(hash, s)
+		return hash, true
+	}
+	mask := rule.Mask
+	if mask == "" {
+		mask = defaultMask
+	}
+	if r.patterns[i] == nil {
+		return mask, true
+	}
+	return r.patterns[i].ReplaceAllLiteralString(s, mask), true
+}
+
+// redact applies rules to series of results, including tags of grouped series,
+// SHOW TAG VALUES and SHOW TAG KEYS / SHOW FIELD KEYS of dropped keys.
+// Results are in the same order as statements of the query
+func (r *redactor) redact(response *client.Response, q string) {
+	if response == nil || len(r.rules) == 0 {
+		return
+	}
+	statements, _ := query.Parse(q)
+	for i := range response.Results {
+		command := ""
+		if i < len(statements) {
+			command = statements[i].Command
+		}
+		series := response.Results[i].Series
+		for j := range series {
+			switch command {
+			case "SHOW TAG":
+				if hasColumn(series[j], "value") {
+					r.redactTagValues(&series[j])
+				} else {
+					r.dropKeys(&series[j], "tagKey")
+				}
+			case "SHOW FIELD":
+				r.dropKeys(&series[j], "fieldKey")
+			case "SHOW SERIES":
+				r.redactSeriesKeys(&series[j])
+			default:
+				r.redactSeries(&series[j])
+			}
+		}
+	}
+}
+
+// redactSeries redacts columns and tags of the series
+func (r *redactor) redactSeries(row *models.Row) {
+	for key, value := range row.Tags {
+		i := r.rule(row.Name, key)
+		if i < 0 {
+			continue
+		}
+		if v, ok := r.value(i, value); ok {
+			row.Tags[key] = fmt.Sprint(v)
+		} else {
+			delete(row.Tags, key)
+		}
+	}
+
+	// indexes of rules of columns, dropped columns are removed from rows
+	rules := make([]int, len(row.Columns))
+	var columns []string
+	for c, name := range row.Columns {
+		rules[c] = r.rule(row.Name, name)
+		if rules[c] < 0 || r.rules[rules[c]].Action != conf.RedactDrop {
+			columns = append(columns, name)
+		}
+	}
+	for v, values := range row.Values {
+		kept := make([]interface{}, 0, len(columns))
+		for c, value := range values {
+			if c >= len(rules) || rules[c] < 0 {
+				kept = append(kept, value)
+				continue
+			}
+			if redacted, ok := r.value(rules[c], value); ok {
+				kept = append(kept, redacted)
+			}
+		}
+		row.Values[v] = kept
+	}
+	row.Columns = columns
+}
+
+// redactSeriesKeys redacts tag values of series keys of SHOW SERIES, e.g: users,email=alice@example.com
+func (r *redactor) redactSeriesKeys(row *models.Row) {
+	index := columnIndex(row.Columns, "key")
+	if index < 0 {
+		return
+	}
+	for _, values := range row.Values {
+		if index >= len(values) {
+			continue
+		}
+		key, _ := values[index].(string)
+		name := seriesName(key)
+		// keys of series do not have fields, so the error of missing fields is expected
+		_, tags, _ := models.ParseKey(key)
+		for k, v := range tags {
+			i := r.rule(unescapeName(name), k)
+			if i < 0 {
+				continue
+			}
+			if redacted, ok := r.value(i, v); ok {
+				tags[k] = fmt.Sprint(redacted)
+			} else {
+				delete(tags, k)
+			}
+		}
+		values[index] = string(models.MakeKey([]byte(name), tags))
+	}
+}
+
+// seriesName returns the escaped measurement name of the series key
+func seriesName(key string) string {
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case ',':
+			return key[:i]
+		}
+	}
+	return key
+}
+
+func unescapeName(name string) string {
+	return strings.NewReplacer(`\,`, ",", `\ `, " ").Replace(name)
+}
+
+// conditions checks uses of redacted keys in WHERE clauses, drop and mask keys can not be used,
+// hash keys can be compared only for equality with hashed values, they are replaced by raw values.
+// Rules of measurements are applied to conditions of any measurement
+func (r *redactor) conditions(q string) (string, error) {
+	conditions, err := query.Conditions(q, r.keys())
+	if err != nil {
+		return q, err
+	}
+	if len(conditions) == 0 {
+		return q, nil
+	}
+	values := make([]string, len(conditions))
+	for i, c := range conditions {
+		for _, rule := range r.rules {
+			if rule.Key == c.Key && rule.Action != conf.RedactHash {
+				return q, errRedactedCondition
+			}
+		}
+		if c.Operator != "=" || c.Value.Kind != query.String {
+			return q, errRedactedCondition
+		}
+		value, ok := r.hashes.lookup(c.Value.Value)
+		if !ok {
+			return q, errUnknownHashedValue
+		}
+		values[i] = value
+	}
+	return query.Replace(q, conditions, values), nil
+}
+
+// redactTagValues redacts rows of SHOW TAG VALUES, rows of dropped keys are removed
+func (r *redactor) redactTagValues(row *models.Row) {
+	key, value := columnIndex(row.Columns, "key"), columnIndex(row.Columns, "value")
+	if key < 0 || value < 0 {
+		return
+	}
+	kept := [][]interface{}{}
+	for _, values := range row.Values {
+		if key >= len(values) || value >= len(values) {
+			continue
+		}
+		name, _ := values[key].(string)
+		i := r.rule(row.Name, name)
+		if i < 0 {
+			kept = append(kept, values)
+			continue
+		}
+		if v, ok := r.value(i, values[value]); ok {
+			values[value] = v
+			kept = append(kept, values)
+		}
+	}
+	row.Values = kept
+}
+
+// dropKeys removes rows of dropped keys from SHOW TAG KEYS and SHOW FIELD KEYS
+func (r *redactor) dropKeys(row *models.Row, column string) {
+	index := columnIndex(row.Columns, column)
+	if index < 0 {
+		return
+	}
+	kept := [][]interface{}{}
+	for _, values := range row.Values {
+		if index < len(values) {
+			name, _ := values[index].(string)
+			if i := r.rule(row.Name, name); i >= 0 && r.rules[i].Action == conf.RedactDrop {
+				continue
+			}
+		}
+		kept = append(kept, values)
+	}
+	row.Values = kept
+}
+
+func hasColumn(row models.Row, column string) bool {
+	return columnIndex(row.Columns, column) >= 0
+}
+
+// columnIndex returns the index of the column, -1 if there is no such column
+func columnIndex(columns []string, column string) int {
+	for i, c := range columns {
+		if c == column {
+			return i
+		}
+	}
+	return -1
+}
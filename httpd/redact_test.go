@@ -0,0 +1,93 @@
+package httpd
+
+import (
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestRedactSeriesKeys(t *testing.T) {
+	r, err := newRedactor([]conf.Redaction{
+		{Key: "email", Action: conf.RedactMask},
+		{Key: "ip", Action: conf.RedactDrop},
+	}, nil, newHashIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &client.Response{Results: []client.Result{{Series: []models.Row{{
+		Columns: []string{"key"},
+		Values: [][]interface{}{
+			{"users,email=alice@example.com,host=a,ip=10.0.0.1"},
+			{`user\ logins,email=bob@example.com`},
+		},
+	}}}}}
+	r.redact(response, "SHOW SERIES")
+
+	values := response.Results[0].Series[0].Values
+	for i, want := range []string{`users,email=***,host=a`, `user\ logins,email=***`} {
+		if values[i][0] != want {
+			t.Errorf("want %s, got %v", want, values[i][0])
+		}
+	}
+}
+
+func TestRedactConditions(t *testing.T) {
+	r, err := newRedactor([]conf.Redaction{
+		{Key: "email", Action: conf.RedactHash},
+		{Key: "ip", Action: conf.RedactMask},
+	}, []byte("secret"), newHashIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := r.value(0, "alice@example.com")
+
+	testData := []struct {
+		q    string
+		want string
+		err  error
+	}{
+		{"SELECT count(value) FROM users WHERE host = 'a'", "SELECT count(value) FROM users WHERE host = 'a'", nil},
+		{"SELECT count(value) FROM users WHERE email = '" + hash.(string) + "'", "SELECT count(value) FROM users WHERE email = 'alice@example.com'", nil},
+		{"SELECT count(value) FROM users WHERE email = 'bob@example.com'", "", errUnknownHashedValue},
+		{"SELECT count(value) FROM users WHERE email =~ /^a/", "", errRedactedCondition},
+		{"SELECT count(value) FROM users WHERE ip = '10.0.0.1'", "", errRedactedCondition},
+	}
+	for _, d := range testData {
+		q, err := r.conditions(d.q)
+		if err != d.err {
+			t.Errorf("%s: want error %v, got %v", d.q, d.err, err)
+			continue
+		}
+		if err == nil && q != d.want {
+			t.Errorf("want %s, got %s", d.want, q)
+		}
+	}
+}
+
+func TestHashIndexEviction(t *testing.T) {
+	h := newHashIndex()
+	h.size = 2
+	h.add("h1", "alice")
+	h.add("h2", "bob")
+	// lookup keeps the hash in use, the least recently used one is forgotten
+	if value, ok := h.lookup("h1"); !ok || value != "alice" {
+		t.Errorf("want alice, got %s", value)
+	}
+	h.add("h3", "carol")
+	testData := []struct {
+		hash  string
+		value string
+		ok    bool
+	}{
+		{"h1", "alice", true},
+		{"h2", "", false},
+		{"h3", "carol", true},
+	}
+	for _, d := range testData {
+		if value, ok := h.lookup(d.hash); value != d.value || ok != d.ok {
+			t.Errorf("%s: want %q and %v, got %q and %v", d.hash, d.value, d.ok, value, ok)
+		}
+	}
+}
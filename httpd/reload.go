@@ -0,0 +1,193 @@
+package httpd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/fatih/set.v0"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/Maksadbek/influxdb-shim/metrics"
+	"github.com/didip/tollbooth"
+	tollboothConfig "github.com/didip/tollbooth/config"
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/spf13/viper"
+)
+
+var configReloads = metrics.NewCounter("shim_config_reloads_total", "Count of config reloads.", "result")
+
+// Reloader is a part of the shim outside of the handler that is rebuilt from config on reload,
+// e.g: the points writer of ingest listeners.
+// PrepareReload validates the config and returns the function that swaps it in,
+// so the config is applied only if all parts accept it
+type Reloader interface {
+	PrepareReload(c viper.Viper) (func(), error)
+}
+
+// settings are the parts of the handler rebuilt from config on reload,
+// they are swapped atomically, so in-flight requests finish with the settings they started with
+type settings struct {
+	influxConf     client.HTTPConfig
+	blacklist      *set.Set
+	authenticator  auth.Authenticator
+	groups         conf.Groups // groups of the policy file if it was changed, config groups otherwise
+	configGroups   conf.Groups // [[groups]] of the config
+	adminGroupName string
+	aliases        *conf.Aliases // virtual database and measurement names
+	tenants        *conf.Tenants
+	redactKey      []byte     // HMAC key of hashed values
+	hashes         *hashIndex // raw values of hashes returned to users
+	downsampler    *downsampler
+	limiter        *tollboothConfig.Limiter
+}
+
+// newSettings builds settings by config and the policy file,
+// the limiter of prev settings is kept if rate limits are not changed, so counts are not reset
+func newSettings(c viper.Viper, prev *settings, policy *conf.PolicyStore) (*settings, error) {
+	s := &settings{
+		influxConf: client.HTTPConfig{
+			Addr:      c.GetString("influxdb.addr"),
+			Username:  c.GetString("influxdb.username"),
+			Password:  c.GetString("influxdb.password"),
+			UserAgent: c.GetString("influxdb.userAgent"),
+		},
+		blacklist:      set.New(),
+		adminGroupName: c.GetString("blacklist.adminGroup"),
+		redactKey:      []byte(c.GetString("redaction.hmacKey")),
+	}
+	// blacklist of queries
+	for _, v := range c.GetStringSlice("blacklist.queries") {
+		s.blacklist.Add(strings.ToLower(strings.Replace(v, " ", "", -1)))
+	}
+	// get groups list from config
+	groups, err := conf.NewGroups(c)
+	if err != nil {
+		glog.Errorf("Unable to unmarshal list of groups: %s", err.Error())
+		return nil, err
+	}
+	s.configGroups, s.groups = *groups, *groups
+	if policy != nil {
+		s.groups = policy.Groups(s.configGroups)
+	}
+	// virtual database and measurement names
+	s.aliases, err = conf.NewAliases(c)
+	if err != nil {
+		glog.Errorf("Unable to read aliases: %s", err.Error())
+		return nil, err
+	}
+	// database prefixes of tenants
+	s.tenants, err = conf.NewTenants(c)
+	if err != nil {
+		glog.Errorf("Unable to read tenants: %s", err.Error())
+		return nil, err
+	}
+	// retention policies of downsampled data
+	downsampling, err := conf.NewDownsampling(c)
+	if err != nil {
+		glog.Errorf("Unable to read downsampling policies: %s", err.Error())
+		return nil, err
+	}
+	s.downsampler = newDownsampler(downsampling, s.influxConf)
+	// chain of auth backends
+	s.authenticator, err = auth.NewAuthenticator(c)
+	if err != nil {
+		glog.Errorf("Unable to create auth backends: %s", err.Error())
+		return nil, err
+	}
+
+	// hashes of the same key are kept, so users can filter by values of previous results
+	if prev != nil && bytes.Equal(prev.redactKey, s.redactKey) {
+		s.hashes = prev.hashes
+	} else {
+		s.hashes = newHashIndex()
+	}
+
+	limit, ttl := int64(c.GetInt("qos.limit")), time.Duration(c.GetInt("qos.ttl"))*time.Second
+	if prev != nil && prev.limiter.Max == limit && prev.limiter.TTL == ttl {
+		s.limiter = prev.limiter
+	} else {
+		s.limiter = tollbooth.NewLimiter(limit, ttl)
+	}
+	return s, nil
+}
+
+// settings returns the current settings
+func (h *handler) settings() *settings {
+	return h.current.Load().(*settings)
+}
+
+// AddReloader registers r to be reloaded together with the handler
+func (h *handler) AddReloader(r Reloader) {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	h.reloaders = append(h.reloaders, r)
+}
+
+// Reload reads the config file again and swaps new groups, blacklist, rate limits,
+// auth backends and signing keys into the handler and reloads registered reloaders,
+// the current config is kept if the new one is not valid
+func (h *handler) Reload() error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	// the file is read into the copy, so the current config is not broken by invalid file
+	c := h.conf
+	if err := c.ReadInConfig(); err != nil {
+		return h.reloadFailed(err)
+	}
+	prev := h.settings()
+	s, err := newSettings(c, prev, h.policy)
+	if err != nil {
+		return h.reloadFailed(err)
+	}
+	// signing keys and reloaders are swapped only if all of them accept the config
+	commits := []func(){}
+	for _, r := range append([]Reloader{h.signer}, h.reloaders...) {
+		commit, err := r.PrepareReload(c)
+		if err != nil {
+			closeAuthenticator(s.authenticator)
+			return h.reloadFailed(err)
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	h.current.Store(s)
+	h.conf = c
+	closeAuthenticator(prev.authenticator)
+	prev.downsampler.close()
+	s.downsampler.start(prev.downsampler)
+
+	configReloads.Inc("success")
+	glog.Infof("Config is reloaded: %d groups, %d blacklisted queries", len(s.groups), s.blacklist.Size())
+	return nil
+}
+
+// applyPolicy swaps groups of the current policy version into the handler
+func (h *handler) applyPolicy() {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	s := *h.settings()
+	s.groups = h.policy.Groups(s.configGroups)
+	h.current.Store(&s)
+}
+
+func (h *handler) reloadFailed(err error) error {
+	configReloads.Inc("failure")
+	glog.Errorf("Config reload failed, keeping the current config: %s", err.Error())
+	return err
+}
+
+// closeAuthenticator releases resources of replaced backends, e.g: pooled LDAP connections
+func closeAuthenticator(a auth.Authenticator) {
+	if c, ok := a.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			glog.Errorf("Unable to close auth backends: %s", err.Error())
+		}
+	}
+}
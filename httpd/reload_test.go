@@ -0,0 +1,124 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/ingest"
+	"github.com/spf13/viper"
+)
+
+// fakeReloader records addresses of InfluxDB of reloaded configs
+type fakeReloader struct {
+	addrs []string
+	err   error
+}
+
+func (r *fakeReloader) PrepareReload(c viper.Viper) (func(), error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return func() { r.addrs = append(r.addrs, c.GetString("influxdb.addr")) }, nil
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret, path := filepath.Join(dir, "secret"), filepath.Join(dir, "conf.toml")
+	if err := ioutil.WriteFile(secret, []byte("test secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(config string) {
+		config = testConf + fmt.Sprintf(`
+[auth.token]
+    method = "HS256"
+    ttl = 10
+    privKeyPath = %q
+    pubKeyPath = %q
+`, secret, secret) + config
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("[influxdb]\naddr = \"http://first:8086\"\n")
+	c := viper.New()
+	c.SetConfigFile(path)
+	if err := c.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(*c)
+	if h == nil {
+		t.Fatal("unable to create handler")
+	}
+	defer h.Close()
+	r := &fakeReloader{}
+	h.AddReloader(r)
+
+	// invalid config is rejected, the current settings are kept
+	prev := h.settings()
+	for _, config := range []string{
+		"[influxdb\naddr = \"http://second:8086\"\n",
+		"[influxdb]\naddr = \"http://second:8086\"\n[[groups]]\ncn = \"Broken\"\nou = \"Eng\"\ndc = \"DC=example,DC=com\"\nprivileges = [\"unknown\"]\n",
+	} {
+		write(config)
+		if err := h.Reload(); err == nil {
+			t.Errorf("want error of %s, got nil", config)
+		}
+		if h.settings() != prev || h.settings().influxConf.Addr != "http://first:8086" {
+			t.Errorf("want the current settings kept, got %s", h.settings().influxConf.Addr)
+		}
+	}
+	if len(r.addrs) != 0 {
+		t.Errorf("want no reloads of invalid config, got %v", r.addrs)
+	}
+
+	// valid config is swapped in together with reloaders
+	write("[influxdb]\naddr = \"http://second:8086\"\n[[groups]]\ncn = \"Ops\"\nou = \"Eng\"\ndc = \"DC=example,DC=com\"\n")
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	s := h.settings()
+	if s == prev || s.influxConf.Addr != "http://second:8086" || len(s.groups) != 3 {
+		t.Errorf("want new settings, got %s and %d groups", s.influxConf.Addr, len(s.groups))
+	}
+	if len(r.addrs) != 1 || r.addrs[0] != "http://second:8086" {
+		t.Errorf("want reloader of http://second:8086, got %v", r.addrs)
+	}
+
+	// failed reloader rejects the config
+	r.err = errors.New("broken")
+	write("[influxdb]\naddr = \"http://third:8086\"\n")
+	if err := h.Reload(); err != r.err {
+		t.Errorf("want %v, got %v", r.err, err)
+	}
+	if h.settings() != s {
+		t.Errorf("want the current settings kept, got %s", h.settings().influxConf.Addr)
+	}
+
+	// signing keys are not swapped if the ingest writer rejects the config
+	writer, err := ingest.NewPointsWriter(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.reloaders = []Reloader{writer}
+	issued := token(t, h, "john", devsDN)
+	secret = filepath.Join(dir, "rotated")
+	if err := ioutil.WriteFile(secret, []byte("rotated secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write("[ingest.networks]\ntsdb = [\"10.0.0.0/33\"]\n")
+	if err := h.Reload(); err == nil {
+		t.Error("want error of invalid network, got nil")
+	}
+	if _, err := h.signer.Parse(issued); err != nil {
+		t.Errorf("want the current signing keys kept, got %v", err)
+	}
+}
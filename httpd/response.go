@@ -0,0 +1,39 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// responseRecorder keeps the status code and the group of the response for metrics
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	group  string
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// setGroup labels the response with the user's group
+func setGroup(w http.ResponseWriter, group string) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.group = group
+	}
+}
+
+// instrument counts requests of the route and measures their latency
+func instrument(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		status := strconv.Itoa(rec.status)
+		requestsTotal.Inc(name, status, rec.group)
+		requestDuration.Since(start, name, status, rec.group)
+	})
+}
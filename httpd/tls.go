@@ -0,0 +1,185 @@
+package httpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Maksadbek/influxdb-shim/util"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"gopkg.in/fsnotify.v1"
+)
+
+// certReloader keeps the server certificate,
+// the certificate is read again when its files are changed on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+	watcher  *fsnotify.Watcher
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte // contents of loaded files, the certificate is not parsed again if they are the same
+	keyPEM  []byte
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: filepath.Clean(certFile), keyFile: filepath.Clean(keyFile)}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the certificate and key files, returns true if their contents are changed,
+// symlinks are followed, so the files are read from their current targets
+func (r *certReloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	same := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert, r.certPEM, r.keyPEM = &cert, certPEM, keyPEM
+	r.mu.Unlock()
+	glog.Infof("Loaded server certificate %s", r.certFile)
+	return true, nil
+}
+
+// Watch reloads the certificate on changes of its files,
+// directories are watched and every event in them makes files read again,
+// so files replaced by rename or by swap of symlinks (e.g: "..data" of Kubernetes secrets) are noticed too
+func (r *certReloader) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{filepath.Dir(r.certFile): true, filepath.Dir(r.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	r.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// unchanged files are skipped by comparing their contents,
+				// previous certificate is kept if the new one can not be loaded,
+				// e.g: the key is not written yet
+				if _, err := r.reload(); err != nil {
+					glog.Errorf("Unable to reload server certificate, using previous one: %s", err.Error())
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("Certificate watcher error: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the files
+func (r *certReloader) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// cipherSuites converts names of cipher suites like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+// to tls package constants, empty list means the default suites
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newTLSConfig creates server TLS config by "web.tls" config,
+// returns nil config if TLS is not enabled
+func newTLSConfig(c viper.Viper) (*tls.Config, *certReloader, error) {
+	if !c.GetBool("web.tls.enabled") {
+		return nil, nil, nil
+	}
+	version, err := util.TLSVersion(c.GetString("web.tls.minTLSVersion"))
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := cipherSuites(c.GetStringSlice("web.tls.cipherSuites"))
+	if err != nil {
+		return nil, nil, err
+	}
+	reloader, err := newCertReloader(c.GetString("web.tls.certFile"), c.GetString("web.tls.keyFile"))
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     version,
+		CipherSuites:   suites,
+	}
+
+	// client certificates are verified by the CA bundle
+	switch mode := c.GetString("web.tls.clientAuth"); mode {
+	case "":
+		return config, reloader, nil
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("unknown client auth mode: %s", mode)
+	}
+	pool, err := util.LoadCertPool(c.GetString("web.tls.clientCAFile"))
+	if err != nil {
+		return nil, nil, err
+	}
+	config.ClientCAs = pool
+	return config, reloader, nil
+}
@@ -0,0 +1,157 @@
+package httpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCipherSuites(t *testing.T) {
+	testData := []struct {
+		names []string
+		want  []uint16
+		err   bool
+	}{
+		{nil, nil, false},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, false},
+		{
+			[]string{" TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_AES_128_GCM_SHA256"},
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_AES_128_GCM_SHA256}, false,
+		},
+		// insecure suites are not accepted
+		{[]string{"TLS_RSA_WITH_RC4_128_SHA"}, nil, true},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "unknown"}, nil, true},
+	}
+	for _, d := range testData {
+		ids, err := cipherSuites(d.names)
+		if (err != nil) != d.err {
+			t.Errorf("%v: want error %v, got %v", d.names, d.err, err)
+			continue
+		}
+		if len(ids) != len(d.want) {
+			t.Errorf("%v: want %v, got %v", d.names, d.want, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != d.want[i] {
+				t.Errorf("%v: want %v, got %v", d.names, d.want, ids)
+			}
+		}
+	}
+}
+
+// writeCert writes a new self-signed certificate of the host and its key into the dir
+func writeCert(t *testing.T, dir, host string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, "tls.crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commonName returns the host of the current certificate
+func commonName(t *testing.T, r *certReloader) string {
+	cert, _ := r.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+// waitCommonName waits until the certificate of the host is loaded
+func waitCommonName(t *testing.T, r *certReloader, host string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for commonName(t, r) != host && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := commonName(t, r); got != host {
+		t.Errorf("want certificate of %s, got %s", host, got)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files are symlinks to "..data" link of the current version, the same as Kubernetes secrets
+	writeCert(t, filepath.Join(dir, "v1"), "v1.example.com")
+	for _, link := range [][2]string{{"v1", "..data"}, {"..data/tls.crt", "tls.crt"}, {"..data/tls.key", "tls.key"}} {
+		if err := os.Symlink(link[0], filepath.Join(dir, link[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := newCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got := commonName(t, r); got != "v1.example.com" {
+		t.Fatalf("want certificate of v1.example.com, got %s", got)
+	}
+
+	// the new version is swapped in by rename of the "..data" link
+	writeCert(t, filepath.Join(dir, "v2"), "v2.example.com")
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitCommonName(t, r, "v2.example.com")
+	// files of the same contents are not loaded again
+	if changed, err := r.reload(); changed || err != nil {
+		t.Errorf("want unchanged files skipped, got changed %v and %v", changed, err)
+	}
+
+	// invalid files are not loaded, the previous certificate is kept
+	if err := ioutil.WriteFile(filepath.Join(dir, "v2", "tls.crt"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.reload(); err == nil {
+		t.Error("want error of invalid certificate, got nil")
+	}
+	if got := commonName(t, r); got != "v2.example.com" {
+		t.Errorf("want certificate of v2.example.com, got %s", got)
+	}
+}
@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// batcher groups points and flushes them when the batch is full
+// or when the timeout passes since the first point of the batch
+type batcher struct {
+	size    int
+	timeout time.Duration
+	flush   func([]models.Point)
+
+	in   chan models.Point
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.RWMutex // held by Add while points are queued, so none are queued after the last flush
+	stopped bool
+}
+
+func newBatcher(size int, timeout time.Duration, flush func([]models.Point)) *batcher {
+	if size <= 0 {
+		size = 1000
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &batcher{
+		size:    size,
+		timeout: timeout,
+		flush:   flush,
+		in:      make(chan models.Point, size),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start runs the batching loop in background
+func (b *batcher) Start() {
+	b.wg.Add(1)
+	go b.run()
+}
+
+// Stop flushes pending points and stops the loop
+func (b *batcher) Stop() {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return
+	}
+	b.stopped = true
+	close(b.done)
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// Add pushes points into the current batch, it returns count of points dropped after Stop
+func (b *batcher) Add(points ...models.Point) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.stopped {
+		return len(points)
+	}
+	for _, p := range points {
+		b.in <- p
+	}
+	return 0
+}
+
+// Len returns count of points waiting in the queue
+func (b *batcher) Len() int {
+	return len(b.in)
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+	var (
+		batch = make([]models.Point, 0, b.size)
+		timer <-chan time.Time
+	)
+	send := func() {
+		if len(batch) > 0 {
+			b.flush(batch)
+			batch = make([]models.Point, 0, b.size)
+		}
+		timer = nil
+	}
+
+	for {
+		select {
+		case p := <-b.in:
+			if len(batch) == 0 {
+				timer = time.After(b.timeout)
+			}
+			batch = append(batch, p)
+			if len(batch) >= b.size {
+				send()
+			}
+		case <-timer:
+			send()
+		case <-b.done:
+			// drain points that are already queued
+			for {
+				select {
+				case p := <-b.in:
+					batch = append(batch, p)
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
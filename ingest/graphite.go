@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	// default separator of graphite metric path
+	graphiteSeparator = "."
+	// field name used when template does not define a field
+	defaultFieldName = "value"
+)
+
+var (
+	errInvalidLine     = errors.New("Received line is not valid")
+	errInvalidTemplate = errors.New("Template is not valid")
+)
+
+// graphiteTemplate maps parts of the dotted metric path to measurement, field and tags
+// e.g: "servers.* .host.measurement.field*"
+type graphiteTemplate struct {
+	filter   []string
+	parts    []string
+	tags     models.Tags
+	greedyAt int // index of the "measurement*" or "field*" part, -1 if there is none
+}
+
+// newGraphiteTemplate parses template spec in form of "[filter] template [tag1=v1,tag2=v2]"
+func newGraphiteTemplate(spec string) (*graphiteTemplate, error) {
+	fields := strings.Fields(spec)
+	t := &graphiteTemplate{tags: models.Tags{}, greedyAt: -1}
+
+	var tmpl, tags string
+	switch len(fields) {
+	case 1:
+		tmpl = fields[0]
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			tmpl, tags = fields[0], fields[1]
+		} else {
+			t.filter = strings.Split(fields[0], graphiteSeparator)
+			tmpl = fields[1]
+		}
+	case 3:
+		t.filter = strings.Split(fields[0], graphiteSeparator)
+		tmpl, tags = fields[1], fields[2]
+	default:
+		return nil, errInvalidTemplate
+	}
+
+	t.parts = strings.Split(tmpl, graphiteSeparator)
+	for i, part := range t.parts {
+		if part == "measurement*" || part == "field*" {
+			if t.greedyAt != -1 {
+				return nil, errInvalidTemplate
+			}
+			t.greedyAt = i
+		}
+	}
+
+	if tags != "" {
+		for _, kv := range strings.Split(tags, ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+				return nil, errInvalidTemplate
+			}
+			t.tags[pair[0]] = pair[1]
+		}
+	}
+	return t, nil
+}
+
+// match checks whether metric path matches the template filter
+// template without filter matches every path
+func (t *graphiteTemplate) match(path []string) bool {
+	if len(t.filter) > len(path) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply extracts measurement, tags and field name from the metric path
+func (t *graphiteTemplate) apply(path []string) (string, models.Tags, string) {
+	var (
+		measurement []string
+		field       []string
+		tags        = map[string][]string{}
+	)
+	for i, part := range t.parts {
+		if i >= len(path) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, path[i])
+		case "field":
+			field = append(field, path[i])
+		case "measurement*":
+			measurement = append(measurement, path[i:]...)
+		case "field*":
+			field = append(field, path[i:]...)
+		default:
+			tags[part] = append(tags[part], path[i])
+		}
+		if i == t.greedyAt {
+			break
+		}
+	}
+
+	result := models.Tags{}
+	for k, v := range t.tags {
+		result[k] = v
+	}
+	for k, v := range tags {
+		result[k] = strings.Join(v, graphiteSeparator)
+	}
+	if len(measurement) == 0 {
+		measurement = path
+	}
+	return strings.Join(measurement, graphiteSeparator), result, strings.Join(field, "_")
+}
+
+// GraphiteParser converts graphite plaintext lines to points
+type GraphiteParser struct {
+	templates []*graphiteTemplate
+}
+
+// NewGraphiteParser creates parser with the given templates,
+// templates are checked in order, the first matching one is applied
+func NewGraphiteParser(templates []string) (*GraphiteParser, error) {
+	p := &GraphiteParser{}
+	for _, spec := range templates {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		t, err := newGraphiteTemplate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, spec)
+		}
+		p.templates = append(p.templates, t)
+	}
+	return p, nil
+}
+
+// Parse parses line in form of "<metric path> <value> [timestamp]"
+func (p *GraphiteParser) Parse(line string) (models.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errInvalidLine
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, errInvalidLine
+	}
+
+	ts := time.Now().UTC()
+	if len(fields) == 3 {
+		unix, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		// -1 means the timestamp is not set
+		if unix != -1 {
+			ts = time.Unix(int64(unix), int64((unix-math.Floor(unix))*float64(time.Second))).UTC()
+		}
+	}
+
+	path := strings.Split(fields[0], graphiteSeparator)
+	measurement, tags, field := fields[0], models.Tags{}, ""
+	for _, t := range p.templates {
+		if t.match(path) {
+			measurement, tags, field = t.apply(path)
+			break
+		}
+	}
+	if field == "" {
+		field = defaultFieldName
+	}
+	return models.NewPoint(measurement, tags, models.Fields{field: value}, ts)
+}
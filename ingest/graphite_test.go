@@ -0,0 +1,100 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGraphiteParse(t *testing.T) {
+	parser, err := NewGraphiteParser([]string{
+		"servers.* .host.measurement.field*",
+		"stats.* .measurement region=eu-west,app=web",
+		"measurement*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		line        string
+		measurement string
+		tags        map[string]string
+		field       string
+		ts          time.Time
+	}{
+		{
+			line:        "servers.localhost.cpu.load.avg 0.5 1457000000",
+			measurement: "cpu",
+			tags:        map[string]string{"host": "localhost"},
+			field:       "load_avg",
+			ts:          time.Unix(1457000000, 0),
+		},
+		{
+			line:        "stats.requests 10 1457000000",
+			measurement: "requests",
+			tags:        map[string]string{"region": "eu-west", "app": "web"},
+			field:       "value",
+			ts:          time.Unix(1457000000, 0),
+		},
+		{
+			line:        "mem.free 1024 1457000000",
+			measurement: "mem.free",
+			tags:        map[string]string{},
+			field:       "value",
+			ts:          time.Unix(1457000000, 0),
+		},
+	}
+
+	for _, d := range testData {
+		p, err := parser.Parse(d.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name() != d.measurement {
+			t.Errorf("want %s, got %s", d.measurement, p.Name())
+		}
+		if len(p.Tags()) != len(d.tags) {
+			t.Errorf("want %+v, got %+v", d.tags, p.Tags())
+		}
+		for k, v := range d.tags {
+			if p.Tags()[k] != v {
+				t.Errorf("want %s=%s, got %s=%s", k, v, k, p.Tags()[k])
+			}
+		}
+		if _, ok := p.Fields()[d.field]; !ok {
+			t.Errorf("want field %s, got %+v", d.field, p.Fields())
+		}
+		if !p.Time().Equal(d.ts) {
+			t.Errorf("want %s, got %s", d.ts, p.Time())
+		}
+	}
+
+	for _, line := range []string{"cpu", "cpu abc", "cpu 1 2 3"} {
+		if _, err := parser.Parse(line); err == nil {
+			t.Errorf("want error for line '%s'", line)
+		}
+	}
+}
+
+func TestOpenTSDBParse(t *testing.T) {
+	p, err := ParseOpenTSDB("put sys.cpu.user 1356998400000 42.5 host=webserver01 cpu=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "sys.cpu.user" {
+		t.Errorf("want %s, got %s", "sys.cpu.user", p.Name())
+	}
+	if p.Tags()["host"] != "webserver01" || p.Tags()["cpu"] != "0" {
+		t.Errorf("invalid tags: %+v", p.Tags())
+	}
+	if p.Fields()["value"] != 42.5 {
+		t.Errorf("want %v, got %v", 42.5, p.Fields()["value"])
+	}
+	if !p.Time().Equal(time.Unix(1356998400, 0)) {
+		t.Errorf("want %s, got %s", time.Unix(1356998400, 0), p.Time())
+	}
+
+	if _, err := ParseOpenTSDB("get sys.cpu.user 1356998400 42.5"); err == nil {
+		t.Error("want error for non put line")
+	}
+}
@@ -0,0 +1,49 @@
+package ingest
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// ParseOpenTSDB parses telnet put line in form of
+// "put <metric> <timestamp> <value> <tagk1=tagv1 ...>"
+// timestamp can be given in seconds or milliseconds
+func ParseOpenTSDB(line string) (models.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "put" {
+		return nil, errInvalidLine
+	}
+
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var ts time.Time
+	if len(fields[2]) > 10 {
+		ts = time.Unix(0, unix*int64(time.Millisecond)).UTC()
+	} else {
+		ts = time.Unix(unix, 0).UTC()
+	}
+
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, errInvalidLine
+	}
+
+	tags := models.Tags{}
+	for _, kv := range fields[4:] {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, errInvalidLine
+		}
+		tags[pair[0]] = pair[1]
+	}
+	return models.NewPoint(fields[1], tags, models.Fields{defaultFieldName: value}, ts)
+}
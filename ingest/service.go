@@ -0,0 +1,316 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+	"github.com/spf13/viper"
+)
+
+// maximum size of the UDP packet
+const udpBufferSize = 65536
+
+var errNotDrained = errors.New("Connections are not drained before the shutdown deadline")
+
+// Service is the listener that receives points from outside
+type Service interface {
+	Open() error
+	Close(ctx context.Context) error
+	Err() <-chan error
+	Name() string
+	Statistics() Statistics
+}
+
+// lineParser converts a received line to a point
+type lineParser func(line string) (models.Point, error)
+
+// service is the line based TCP or UDP listener,
+// it parses received lines and writes them to the configured database
+type service struct {
+	name            string
+	protocol        string
+	addr            string
+	database        string
+	tenant          string // database is prefixed with the tenant id
+	retentionPolicy string
+	parse           lineParser
+	writer          *PointsWriter
+	batcher         *batcher
+	stats           Statistics
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conn   net.PacketConn
+	conns  map[net.Conn]struct{} // open TCP connections
+	closed bool                  // no connections are served after Close
+	wg     sync.WaitGroup        // serving goroutines, added under mu before Close
+	err    chan error
+}
+
+// NewServices creates listeners that are enabled in config and write points by the writer,
+// "graphite", "opentsdb" and "udp" sections are supported
+func NewServices(c viper.Viper, writer *PointsWriter) ([]Service, error) {
+	// databases of listeners can belong to tenants
+	for _, name := range []string{"graphite", "opentsdb", "udp"} {
+		if err := conf.ValidateTenant(c.GetString(name + ".tenant")); err != nil {
+			glog.Errorf("Invalid tenant of %s listener: %s", name, err.Error())
+			return nil, err
+		}
+	}
+
+	var services []Service
+	if c.GetBool("graphite.enabled") {
+		parser, err := NewGraphiteParser(c.GetStringSlice("graphite.templates"))
+		if err != nil {
+			glog.Errorf("Unable to parse graphite templates: %s", err.Error())
+			return nil, err
+		}
+		services = append(services, newService("graphite", c, writer, parser.Parse))
+	}
+	if c.GetBool("opentsdb.enabled") {
+		services = append(services, newService("opentsdb", c, writer, ParseOpenTSDB))
+	}
+	if c.GetBool("udp.enabled") {
+		services = append(services, newUDPService(c, writer))
+	}
+	return services, nil
+}
+
+func newService(name string, c viper.Viper, writer *PointsWriter, parse lineParser) *service {
+	s := &service{
+		name:            name,
+		protocol:        c.GetString(name + ".protocol"),
+		addr:            c.GetString(name + ".addr"),
+		database:        c.GetString(name + ".database"),
+		tenant:          c.GetString(name + ".tenant"),
+		retentionPolicy: c.GetString(name + ".retentionPolicy"),
+		parse:           parse,
+		writer:          writer,
+		conns:           map[net.Conn]struct{}{},
+		err:             make(chan error),
+	}
+	if s.protocol == "" {
+		s.protocol = "tcp"
+	}
+	s.batcher = newBatcher(
+		c.GetInt(name+".batchSize"),
+		time.Duration(c.GetInt(name+".batchTimeout"))*time.Millisecond,
+		s.flush,
+	)
+	return s
+}
+
+// Open starts listening and blocks until the listener is closed
+func (s *service) Open() error {
+	switch s.protocol {
+	case "tcp":
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		glog.Infof("%s listening on TCP: %s", s.name, ln.Addr().String())
+		if !s.serve(ln, nil) {
+			return ln.Close()
+		}
+		defer s.wg.Done()
+		s.serveTCP()
+	case "udp":
+		conn, err := net.ListenPacket("udp", s.addr)
+		if err != nil {
+			return err
+		}
+		glog.Infof("%s listening on UDP: %s", s.name, conn.LocalAddr().String())
+		if !s.serve(nil, conn) {
+			return conn.Close()
+		}
+		defer s.wg.Done()
+		s.serveUDP()
+	default:
+		return fmt.Errorf("unknown protocol of %s listener: %s", s.name, s.protocol)
+	}
+	return nil
+}
+
+// serve registers the listener and its goroutine and starts the batcher unless the service is closed
+func (s *service) serve(ln net.Listener, conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.ln, s.conn = ln, conn
+	s.wg.Add(1)
+	s.batcher.Start()
+	return true
+}
+
+func (s *service) serveTCP() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "closed") {
+				s.err <- fmt.Errorf("listener failed: addr=%s, err=%s", s.addr, err)
+			}
+			return
+		}
+		// connection accepted while Close is running is not served
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *service) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	atomic.AddInt64(&s.stats.PacketsReceived, 1)
+	if err := s.writer.Authorize(s.database, conn.RemoteAddr()); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+	// timeout is the read deadline set by Close
+	if err := scanner.Err(); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return
+		}
+		glog.Errorf("Unable to read from %s: %s", conn.RemoteAddr(), err.Error())
+	}
+}
+
+func (s *service) serveUDP() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "closed") {
+				s.err <- fmt.Errorf("listener failed: addr=%s, err=%s", s.addr, err)
+			}
+			return
+		}
+		atomic.AddInt64(&s.stats.PacketsReceived, 1)
+		if err := s.writer.Authorize(s.database, addr); err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handleLine(line)
+		}
+	}
+}
+
+func (s *service) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	p, err := s.parse(line)
+	if err != nil {
+		glog.Errorf("Unable to parse %s line '%s': %s", s.name, line, err.Error())
+		atomic.AddInt64(&s.stats.ParseErrors, 1)
+		return
+	}
+	atomic.AddInt64(&s.stats.PointsReceived, 1)
+	if dropped := s.batcher.Add(p); dropped > 0 {
+		atomic.AddInt64(&s.stats.PointsDropped, int64(dropped))
+	}
+}
+
+func (s *service) flush(points []models.Point) {
+	points, dropped := s.writer.Filter(s.database, points)
+	atomic.AddInt64(&s.stats.PointsDropped, int64(dropped))
+	if err := s.writer.WritePoints(s.tenant, s.database, s.retentionPolicy, points); err != nil {
+		glog.Errorf("Unable to write %s points: %s", s.name, err.Error())
+		atomic.AddInt64(&s.stats.WriteErrors, 1)
+	}
+}
+
+// Close stops the listener, waits for lines already received and flushes pending points,
+// connections that are not drained before the deadline of ctx are closed and their lines are lost
+func (s *service) Close(ctx context.Context) error {
+	var err error
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	// reads of open connections are interrupted, lines that are already read are processed
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	if !wait(ctx, &s.wg) {
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		// queued points are flushed, points of connections that are still read are dropped and counted
+		glog.Errorf("%s connections are not drained before the shutdown deadline, dropping their points", s.name)
+		s.batcher.Stop()
+		return errNotDrained
+	}
+	s.batcher.Stop()
+	return err
+}
+
+// wait waits for the group until the deadline of ctx, it returns false if the deadline is passed
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Err returns the channel of listener errors
+func (s *service) Err() <-chan error {
+	return s.err
+}
+
+// Name returns the name of the listener
+func (s *service) Name() string {
+	return s.name
+}
+
+// Statistics returns current counters of the listener
+func (s *service) Statistics() Statistics {
+	stats := s.stats.Snapshot()
+	stats.QueueDepth = int64(s.batcher.Len())
+	return stats
+}
@@ -0,0 +1,220 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/spf13/viper"
+)
+
+// fakeInfluxDB records the databases and bodies of received writes
+type fakeInfluxDB struct {
+	*httptest.Server
+	mu     sync.Mutex
+	writes []string
+}
+
+func newFakeInfluxDB() *fakeInfluxDB {
+	f := &fakeInfluxDB{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.writes = append(f.writes, r.FormValue("db")+": "+strings.TrimSpace(string(body)))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return f
+}
+
+func (f *fakeInfluxDB) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.writes...)
+}
+
+// newTestConfig reads the config of listeners writing to the InfluxDB
+func newTestConfig(t *testing.T, influxAddr, config string) viper.Viper {
+	c := viper.New()
+	c.SetConfigType("toml")
+	if err := c.ReadConfig(bytes.NewBufferString(fmt.Sprintf("[influxdb]\naddr = %q\n", influxAddr) + config)); err != nil {
+		t.Fatal(err)
+	}
+	return *c
+}
+
+// listenAddr waits until the TCP listener of the service is opened
+func listenAddr(t *testing.T, s *service) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		ln := s.ln
+		s.mu.Unlock()
+		if ln != nil {
+			return ln.Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("listener is not opened")
+	return ""
+}
+
+func TestServiceClose(t *testing.T) {
+	influx := newFakeInfluxDB()
+	defer influx.Close()
+	c := newTestConfig(t, influx.URL, `
+[opentsdb]
+addr = "127.0.0.1:0"
+database = "tsdb"
+batchSize = 100
+batchTimeout = 60000
+`)
+	writer, err := NewPointsWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newService("opentsdb", c, writer, ParseOpenTSDB)
+	opened := make(chan error, 1)
+	go func() { opened <- s.Open() }()
+
+	// idle connection does not block the shutdown, its lines are flushed
+	conn, err := net.Dial("tcp", listenAddr(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "put sys.cpu 1457000000 0.5 host=a")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Statistics().PointsReceived == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if err := <-opened; err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if writes := influx.received(); len(writes) != 1 || !strings.HasPrefix(writes[0], "tsdb: sys.cpu,host=a") {
+		t.Errorf("want the point written to tsdb, got %v", writes)
+	}
+
+	// connections are not served after Close
+	s.mu.Lock()
+	served := len(s.conns)
+	s.mu.Unlock()
+	if served != 0 {
+		t.Errorf("want no served connections, got %d", served)
+	}
+}
+
+func TestServiceCloseBeforeOpen(t *testing.T) {
+	c := newTestConfig(t, "http://127.0.0.1:0", `
+[opentsdb]
+addr = "127.0.0.1:0"
+database = "tsdb"
+`)
+	writer, err := NewPointsWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newService("opentsdb", c, writer, ParseOpenTSDB)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+
+	// the listener opened after Close is closed at once instead of serving forever
+	opened := make(chan error, 1)
+	go func() { opened <- s.Open() }()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("want nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want Open to return after Close")
+	}
+}
+
+func TestServiceCloseDeadline(t *testing.T) {
+	influx := newFakeInfluxDB()
+	defer influx.Close()
+	c := newTestConfig(t, influx.URL, `
+[opentsdb]
+addr = "127.0.0.1:0"
+database = "tsdb"
+batchSize = 100
+batchTimeout = 60000
+`)
+	writer, err := NewPointsWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newService("opentsdb", c, writer, ParseOpenTSDB)
+	// the serving goroutine that does not finish is not waited after the deadline
+	if !s.serve(nil, nil) {
+		t.Fatal("want the service served")
+	}
+	defer s.wg.Done()
+	s.handleLine("put sys.cpu 1457000000 0.5 host=a")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Close(ctx); err != errNotDrained {
+		t.Errorf("want %v, got %v", errNotDrained, err)
+	}
+
+	// queued points are flushed, points read after the deadline are dropped and counted
+	if writes := influx.received(); len(writes) != 1 || !strings.HasPrefix(writes[0], "tsdb: sys.cpu,host=a") {
+		t.Errorf("want the queued point written to tsdb, got %v", writes)
+	}
+	s.handleLine("put sys.cpu 1457000001 0.5 host=b")
+	if stats := s.Statistics(); stats.PointsReceived != 2 || stats.PointsDropped != 1 {
+		t.Errorf("want 2 received and 1 dropped points, got %d and %d", stats.PointsReceived, stats.PointsDropped)
+	}
+}
+
+func TestPointsWriterReload(t *testing.T) {
+	first, second := newFakeInfluxDB(), newFakeInfluxDB()
+	defer first.Close()
+	defer second.Close()
+	writer, err := NewPointsWriter(newTestConfig(t, first.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := ParseOpenTSDB("put sys.cpu 1457000000 0.5 host=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid config is rejected, the current settings are kept
+	if err := writer.Reload(newTestConfig(t, second.URL, "[ingest.networks]\ntsdb = [\"10.0.0.0/33\"]\n")); err == nil {
+		t.Error("want error of invalid network, got nil")
+	}
+	if err := writer.WritePoints("", "tsdb", "", []models.Point{points}); err != nil {
+		t.Fatal(err)
+	}
+
+	// valid config is swapped in, e.g: new InfluxDB address and aliases
+	if err := writer.Reload(newTestConfig(t, second.URL, "[[aliases.databases]]\nvirtual = \"tsdb\"\nphysical = \"tsdb_prod\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WritePoints("", "tsdb", "", []models.Point{points}); err != nil {
+		t.Fatal(err)
+	}
+	if w1, w2 := first.received(), second.received(); len(w1) != 1 || len(w2) != 1 || !strings.HasPrefix(w2[0], "tsdb_prod: ") {
+		t.Errorf("want one write to each InfluxDB, got %v and %v", w1, w2)
+	}
+}
@@ -0,0 +1,25 @@
+package ingest
+
+import "sync/atomic"
+
+// Statistics keeps counters of the listener,
+// counters are updated atomically and can be read while listener is running
+type Statistics struct {
+	PacketsReceived int64 // count of received UDP packets or TCP connections
+	PointsReceived  int64 // count of successfully parsed points
+	PointsDropped   int64 // count of points dropped by the policy
+	ParseErrors     int64 // count of lines that failed to parse
+	WriteErrors     int64 // count of failed writes to InfluxDB
+	QueueDepth      int64 // count of points waiting to be batched
+}
+
+// Snapshot returns the copy of current counters
+func (s *Statistics) Snapshot() Statistics {
+	return Statistics{
+		PacketsReceived: atomic.LoadInt64(&s.PacketsReceived),
+		PointsReceived:  atomic.LoadInt64(&s.PointsReceived),
+		PointsDropped:   atomic.LoadInt64(&s.PointsDropped),
+		ParseErrors:     atomic.LoadInt64(&s.ParseErrors),
+		WriteErrors:     atomic.LoadInt64(&s.WriteErrors),
+	}
+}
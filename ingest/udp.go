@@ -0,0 +1,215 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/models"
+	"github.com/spf13/viper"
+)
+
+// denied points are logged at most once per interval, so a flood of denied packets does not flood the log
+const deniedLogInterval = 10 * time.Second
+
+// udpService receives line protocol over UDP,
+// points are routed to databases by measurement name and written in batches
+type udpService struct {
+	addr            string
+	database        string // default database of points without route
+	tenant          string // databases are prefixed with the tenant id
+	retentionPolicy string
+	precision       string
+	routes          map[string]string // measurement name to database
+	writer          *PointsWriter
+	batcher         *batcher
+	stats           Statistics
+
+	denied       int       // points denied since the last log, used only by the serving goroutine
+	deniedLogged time.Time // time of the last log of denied points
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool           // the listener is not served after Close
+	wg     sync.WaitGroup // serving goroutine, added under mu before Close
+	err    chan error
+}
+
+func newUDPService(c viper.Viper, writer *PointsWriter) *udpService {
+	s := &udpService{
+		addr:            c.GetString("udp.addr"),
+		database:        c.GetString("udp.database"),
+		tenant:          c.GetString("udp.tenant"),
+		retentionPolicy: c.GetString("udp.retentionPolicy"),
+		precision:       c.GetString("udp.precision"),
+		routes:          c.GetStringMapString("udp.routes"),
+		writer:          writer,
+		err:             make(chan error),
+	}
+	s.batcher = newBatcher(
+		c.GetInt("udp.batchSize"),
+		time.Duration(c.GetInt("udp.batchTimeout"))*time.Millisecond,
+		s.flush,
+	)
+	return s
+}
+
+// Open starts listening and blocks until the listener is closed
+func (s *udpService) Open() error {
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	glog.Infof("udp listening on UDP: %s", conn.LocalAddr().String())
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conn = conn
+	s.wg.Add(1)
+	s.batcher.Start()
+	s.mu.Unlock()
+	defer s.wg.Done()
+	s.serve()
+	return nil
+}
+
+func (s *udpService) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "closed") {
+				s.err <- fmt.Errorf("listener failed: addr=%s, err=%s", s.addr, err)
+			}
+			return
+		}
+		atomic.AddInt64(&s.stats.PacketsReceived, 1)
+
+		now := time.Now().UTC()
+		points, failed := parseLines(buf[:n], now, s.precision)
+		if failed > 0 {
+			glog.Errorf("Unable to parse %d lines of UDP packet from %s", failed, addr)
+			atomic.AddInt64(&s.stats.ParseErrors, int64(failed))
+		}
+		atomic.AddInt64(&s.stats.PointsReceived, int64(len(points)))
+
+		denied, dropped := 0, 0
+		for _, p := range points {
+			if err := s.writer.authorize(s.route(p), addr); err != nil {
+				denied++
+				continue
+			}
+			dropped += s.batcher.Add(p)
+		}
+		if denied+dropped > 0 {
+			atomic.AddInt64(&s.stats.PointsDropped, int64(denied+dropped))
+		}
+		if denied > 0 {
+			s.logDenied(denied, addr, now)
+		}
+	}
+}
+
+// logDenied counts denied points and logs them if the interval has passed since the last log
+func (s *udpService) logDenied(denied int, addr net.Addr, now time.Time) {
+	s.denied += denied
+	if now.Sub(s.deniedLogged) < deniedLogInterval {
+		return
+	}
+	glog.Errorf("Writes of %d UDP points are denied by networks of their databases, the last one from %s", s.denied, addr)
+	s.denied, s.deniedLogged = 0, now
+}
+
+// parseLines parses line protocol line by line, returns parsed points and count of failed lines,
+// line protocol does not allow newlines in tag and field values, so lines are split by them
+func parseLines(buf []byte, now time.Time, precision string) ([]models.Point, int) {
+	var (
+		points []models.Point
+		failed int
+	)
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parsed, err := models.ParsePointsWithPrecision(line, now, precision)
+		if err != nil {
+			glog.Errorf("Unable to parse UDP line: %s", err.Error())
+			failed++
+			continue
+		}
+		points = append(points, parsed...)
+	}
+	return points, failed
+}
+
+// route returns the database of the point
+func (s *udpService) route(p models.Point) string {
+	if db, ok := s.routes[p.Name()]; ok {
+		return db
+	}
+	return s.database
+}
+
+func (s *udpService) flush(points []models.Point) {
+	// group points by their databases
+	batches := map[string][]models.Point{}
+	for _, p := range points {
+		db := s.route(p)
+		batches[db] = append(batches[db], p)
+	}
+
+	for db, batch := range batches {
+		batch, dropped := s.writer.Filter(db, batch)
+		atomic.AddInt64(&s.stats.PointsDropped, int64(dropped))
+		if err := s.writer.WritePoints(s.tenant, db, s.retentionPolicy, batch); err != nil {
+			glog.Errorf("Unable to write udp points: %s", err.Error())
+			atomic.AddInt64(&s.stats.WriteErrors, 1)
+		}
+	}
+}
+
+// Close stops the listener and flushes pending points until the deadline of ctx
+func (s *udpService) Close(ctx context.Context) error {
+	var err error
+	s.mu.Lock()
+	s.closed = true
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+	// the packet that is being parsed is added before the last flush
+	if !wait(ctx, &s.wg) {
+		// queued points are flushed, points of the packet that is still parsed are dropped and counted
+		glog.Errorf("udp packets are not drained before the shutdown deadline, dropping their points")
+		s.batcher.Stop()
+		return errNotDrained
+	}
+	s.batcher.Stop()
+	return err
+}
+
+// Err returns the channel of listener errors
+func (s *udpService) Err() <-chan error {
+	return s.err
+}
+
+// Name returns the name of the listener
+func (s *udpService) Name() string {
+	return "udp"
+}
+
+// Statistics returns current counters of the listener
+func (s *udpService) Statistics() Statistics {
+	stats := s.stats.Snapshot()
+	stats.QueueDepth = int64(s.batcher.Len())
+	return stats
+}
@@ -0,0 +1,122 @@
+package ingest
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLines(t *testing.T) {
+	testData := []struct {
+		buf    string
+		points int
+		failed int
+	}{
+		{"cpu value=1\nmem value=2\n", 2, 0},
+		{"cpu value=1\nbroken\nmem value=\n# comment\n\n", 1, 2},
+		{"broken one\nbroken two", 0, 2},
+		{"", 0, 0},
+	}
+	for _, d := range testData {
+		points, failed := parseLines([]byte(d.buf), time.Now(), "")
+		if len(points) != d.points || failed != d.failed {
+			t.Errorf("%q: want %d points and %d failed lines, got %d and %d", d.buf, d.points, d.failed, len(points), failed)
+		}
+	}
+}
+
+func TestUDPLogDenied(t *testing.T) {
+	s := &udpService{}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 8089}
+	now := time.Now()
+	testData := []struct {
+		denied  int
+		after   time.Duration
+		pending int // denied points that are not logged yet
+	}{
+		{2, 0, 0},
+		// denials within the interval are counted and logged together later
+		{3, time.Second, 3},
+		{4, 2 * time.Second, 7},
+		{1, deniedLogInterval, 0},
+	}
+	for _, d := range testData {
+		s.logDenied(d.denied, addr, now.Add(d.after))
+		if s.denied != d.pending {
+			t.Errorf("%v: want %d pending denied points, got %d", d.after, d.pending, s.denied)
+		}
+	}
+}
+
+func TestUDPService(t *testing.T) {
+	influx := newFakeInfluxDB()
+	defer influx.Close()
+	c := newTestConfig(t, influx.URL, `
+[udp]
+addr = "127.0.0.1:0"
+database = "metrics"
+batchSize = 100
+batchTimeout = 60000
+[udp.routes]
+logins = "audit"
+secrets = "vault"
+[ingest.measurements]
+metrics = ["cpu"]
+[ingest.networks]
+vault = ["10.0.0.0/8"]
+`)
+	writer, err := NewPointsWriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newUDPService(c, writer)
+	opened := make(chan error, 1)
+	go func() { opened <- s.Open() }()
+
+	var addr net.Addr
+	deadline := time.Now().Add(5 * time.Second)
+	for addr == nil && time.Now().Before(deadline) {
+		s.mu.Lock()
+		if s.conn != nil {
+			addr = s.conn.LocalAddr()
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("listener is not opened")
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// points are routed by measurement, measurements not allowed in the database and databases denied to the network are dropped
+	conn.Write([]byte("cpu,host=a value=1 1457000000000000000\nlogins,user=bob value=1 1457000000000000000\nmem value=2\nsecrets value=3\nbroken\n"))
+	for s.Statistics().PacketsReceived == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+
+	writes := influx.received()
+	sort.Strings(writes)
+	want := []string{"audit: logins,user=bob value=1 1457000000000000000", "metrics: cpu,host=a value=1 1457000000000000000"}
+	if strings.Join(writes, "; ") != strings.Join(want, "; ") {
+		t.Errorf("want %v, got %v", want, writes)
+	}
+	stats := s.Statistics()
+	if stats.PointsReceived != 4 || stats.ParseErrors != 1 || stats.PointsDropped != 2 || s.denied != 0 {
+		t.Errorf("want 4 received, 1 parse error and 2 dropped points, got %+v", stats)
+	}
+}
@@ -0,0 +1,258 @@
+package ingest
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Maksadbek/influxdb-shim/conf"
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+var (
+	errNetworkDenied = errors.New("Source network is not allowed to write into this database")
+	errNoDatabase    = errors.New("Listener does not have a database configured")
+)
+
+// Networks keeps the list of source networks allowed to write into each database
+type Networks map[string][]*net.IPNet
+
+// NewNetworks parses the CIDR lists of "ingest.networks" config
+// e.g: graphite = ["10.0.0.0/8", "127.0.0.1/32"]
+func NewNetworks(c viper.Viper) (Networks, error) {
+	networks := Networks{}
+	for db, cidrs := range stringMapSlice(c, "ingest.networks") {
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				glog.Errorf("Invalid network '%s' for database '%s'", cidr, db)
+				return nil, err
+			}
+			networks[db] = append(networks[db], ipNet)
+		}
+	}
+	return networks, nil
+}
+
+// stringMapSlice reads the table of string lists, e.g: telegraf = ["cpu", "mem*"],
+// GetStringMapStringSlice of the vendored viper loses values of TOML arrays
+func stringMapSlice(c viper.Viper, key string) map[string][]string {
+	m := map[string][]string{}
+	for k, v := range c.GetStringMap(key) {
+		m[k] = cast.ToStringSlice(v)
+	}
+	return m
+}
+
+// Allowed checks whether given ip can write into the database
+// databases without configured networks are open for everyone
+func (n Networks) Allowed(database string, ip net.IP) bool {
+	nets, ok := n[database]
+	if !ok {
+		return true
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Measurements keeps the list of measurements allowed to be written into each database,
+// pattern with "*" suffix matches all measurements with such prefix
+type Measurements map[string][]string
+
+// Allowed checks whether measurement can be written into the database
+// databases without configured measurements accept any measurement
+func (m Measurements) Allowed(database, measurement string) bool {
+	patterns, ok := m[database]
+	if !ok {
+		return true
+	}
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(measurement, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+		if p == measurement {
+			return true
+		}
+	}
+	return false
+}
+
+// PointsWriter forwards points received by listeners to InfluxDB,
+// its settings are swapped atomically on reload
+type PointsWriter struct {
+	current atomic.Value // *writerSettings
+}
+
+// writerSettings are the parts of the writer rebuilt from config on reload
+type writerSettings struct {
+	influxConf   client.HTTPConfig
+	networks     Networks
+	measurements Measurements
+	aliases      *conf.Aliases // virtual database and measurement names
+	tenants      *conf.Tenants
+}
+
+// NewPointsWriter creates new PointsWriter with the InfluxDB configs
+func NewPointsWriter(c viper.Viper) (*PointsWriter, error) {
+	w := &PointsWriter{}
+	if err := w.Reload(c); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Reload swaps InfluxDB address, networks, measurements, aliases and tenants of the config into the writer,
+// the current settings are kept if the config is not valid
+func (w *PointsWriter) Reload(c viper.Viper) error {
+	commit, err := w.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload builds settings of the config without swapping them in,
+// the returned function swaps them
+func (w *PointsWriter) PrepareReload(c viper.Viper) (func(), error) {
+	networks, err := NewNetworks(c)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := conf.NewAliases(c)
+	if err != nil {
+		glog.Errorf("Unable to read aliases: %s", err.Error())
+		return nil, err
+	}
+	tenants, err := conf.NewTenants(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &writerSettings{
+		influxConf: client.HTTPConfig{
+			Addr:      c.GetString("influxdb.addr"),
+			Username:  c.GetString("influxdb.username"),
+			Password:  c.GetString("influxdb.password"),
+			UserAgent: c.GetString("influxdb.userAgent"),
+		},
+		networks:     networks,
+		measurements: Measurements(stringMapSlice(c, "ingest.measurements")),
+		aliases:      aliases,
+		tenants:      tenants,
+	}
+	return func() { w.current.Store(s) }, nil
+}
+
+// settings returns the current settings
+func (w *PointsWriter) settings() *writerSettings {
+	return w.current.Load().(*writerSettings)
+}
+
+// Authorize checks that the source address may write into the database
+func (w *PointsWriter) Authorize(database string, addr net.Addr) error {
+	err := w.authorize(database, addr)
+	if err == errNetworkDenied {
+		glog.Errorf("Write from %s to database '%s' is denied", addr, database)
+	}
+	return err
+}
+
+// authorize is Authorize without logging, for callers that check every point and log denials themselves
+func (w *PointsWriter) authorize(database string, addr net.Addr) error {
+	if database == "" {
+		return errNoDatabase
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if !w.settings().networks.Allowed(database, ip) {
+		return errNetworkDenied
+	}
+	return nil
+}
+
+// Filter drops points whose measurements are not allowed in the database,
+// returns allowed points and count of dropped ones
+func (w *PointsWriter) Filter(database string, points []models.Point) ([]models.Point, int) {
+	measurements := w.settings().measurements
+	allowed := points[:0]
+	for _, p := range points {
+		if measurements.Allowed(database, p.Name()) {
+			allowed = append(allowed, p)
+		}
+	}
+	dropped := len(points) - len(allowed)
+	if dropped > 0 {
+		glog.Infof("%d points are not allowed in database: '%s'", dropped, database)
+	}
+	return allowed, dropped
+}
+
+// WritePoints sends points to the given database of the tenant and retention policy,
+// virtual database and measurement names are replaced by physical ones
+func (w *PointsWriter) WritePoints(tenant, database, retentionPolicy string, points []models.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	ws := w.settings()
+	database = ws.tenants.Database(tenant, ws.aliases.Database(database))
+	points, err := ws.rename(points)
+	if err != nil {
+		return err
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        database,
+		RetentionPolicy: retentionPolicy,
+		Precision:       "ns",
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		bp.AddPoint(client.NewPointFrom(p))
+	}
+
+	c, err := client.NewHTTPClient(ws.influxConf)
+	if err != nil {
+		glog.Errorf("Unable to open connection to InfluxDB: %v", err)
+		return err
+	}
+	defer c.Close()
+
+	glog.Infof("Writing %d points to database: '%s'", len(points), database)
+	return c.Write(bp)
+}
+
+// rename replaces virtual measurement names of points by physical ones
+func (w *writerSettings) rename(points []models.Point) ([]models.Point, error) {
+	if w.aliases.Empty() {
+		return points, nil
+	}
+	renamed := make([]models.Point, len(points))
+	for i, p := range points {
+		name := w.aliases.Measurement(p.Name())
+		if name == p.Name() {
+			renamed[i] = p
+			continue
+		}
+		np, err := models.NewPoint(name, p.Tags(), p.Fields(), p.Time())
+		if err != nil {
+			return nil, err
+		}
+		renamed[i] = np
+	}
+	return renamed, nil
+}
@@ -0,0 +1,70 @@
+package ingest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestMeasurementsAllowed(t *testing.T) {
+	m := Measurements{"metrics": {"cpu", "disk_*"}, "closed": {}}
+
+	testData := []struct {
+		database    string
+		measurement string
+		want        bool
+	}{
+		{"metrics", "cpu", true},
+		{"metrics", "disk_io", true},
+		{"metrics", "disk", false},
+		{"metrics", "cpu_load", false},
+		// databases without configured measurements accept any measurement
+		{"other", "anything", true},
+		{"closed", "cpu", false},
+	}
+	for _, d := range testData {
+		if got := m.Allowed(d.database, d.measurement); got != d.want {
+			t.Errorf("%s of %s: want %v, got %v", d.measurement, d.database, d.want, got)
+		}
+	}
+}
+
+func TestPointsWriterAuthorize(t *testing.T) {
+	writer, err := NewPointsWriter(newTestConfig(t, "http://127.0.0.1:0", "[ingest.networks]\nmetrics = [\"10.0.0.0/8\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		database string
+		addr     net.Addr
+		want     error
+	}{
+		{"metrics", &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, nil},
+		{"metrics", &net.UDPAddr{IP: net.ParseIP("192.168.0.1")}, errNetworkDenied},
+		{"other", &net.UDPAddr{IP: net.ParseIP("192.168.0.1")}, nil},
+		{"", &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, errNoDatabase},
+	}
+	for _, d := range testData {
+		if err := writer.Authorize(d.database, d.addr); err != d.want {
+			t.Errorf("%s from %s: want %v, got %v", d.database, d.addr, d.want, err)
+		}
+	}
+}
+
+func TestPointsWriterFilter(t *testing.T) {
+	writer, err := NewPointsWriter(newTestConfig(t, "http://127.0.0.1:0", "[ingest.measurements]\nmetrics = [\"cpu\", \"disk_*\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := models.ParsePoints([]byte("cpu value=1\nmem value=2\ndisk_io value=3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, dropped := writer.Filter("metrics", points)
+	if len(allowed) != 2 || dropped != 1 || allowed[0].Name() != "cpu" || allowed[1].Name() != "disk_io" {
+		t.Errorf("want cpu and disk_io with 1 dropped, got %v with %d dropped", allowed, dropped)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Maksadbek/influxdb-shim/auth"
+	"github.com/spf13/viper"
+)
+
+// runKeys manages API keys of service accounts from the command line:
+//
+//	keys list
+//	keys create -service name [-groups dn;dn] [-dbs db,db] [-cidr net]
+//	keys revoke id
+func runKeys(c viper.Viper, args []string) error {
+	path := c.GetString("auth.managedKeys.path")
+	if path == "" {
+		return fmt.Errorf("auth.managedKeys.path is not configured")
+	}
+	store, err := auth.OpenKeyStore(path)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keys list|create|revoke")
+	}
+
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSERVICE\tGROUPS\tDATABASES\tCIDR\tCREATED")
+		for _, k := range store.List() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Service,
+				strings.Join(k.Groups, ";"), strings.Join(k.Databases, ","), k.CIDR, k.Created.Format("2006-01-02"))
+		}
+		return w.Flush()
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		service := fs.String("service", "", "service account name")
+		groups := fs.String("groups", "", "group DNs separated by ';'")
+		dbs := fs.String("dbs", "", "allowed databases separated by ',', all if empty")
+		cidr := fs.String("cidr", "", "allowed source network, any if empty")
+		fs.Parse(args[1:])
+		key, k, err := store.Create(*service, splitNonEmpty(*groups, ";"), splitNonEmpty(*dbs, ","), *cidr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id: %s\nkey: %s\n", k.ID, key)
+		fmt.Println("the key is shown only once, store it securely")
+		return nil
+	case "revoke":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: keys revoke id")
+		}
+		return store.Revoke(args[1])
+	}
+	return fmt.Errorf("unknown keys command: %s", args[0])
+}
+
+func splitNonEmpty(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Maksadbek/influxdb-shim/httpd"
+	"github.com/Maksadbek/influxdb-shim/ingest"
+	"github.com/Maksadbek/influxdb-shim/monitor"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
+	"gopkg.in/fsnotify.v1"
 )
 
 // config file type must be toml
@@ -29,6 +37,22 @@ func main() {
 		glog.Fatal(err)
 	}
 
+	// manage API keys and exit, e.g: influxdb-shim keys list
+	if flag.Arg(0) == "keys" {
+		if err := runKeys(*v, flag.Args()[1:]); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
+	// explain the policy decision for the query and exit, e.g: influxdb-shim explain -user john -db metrics -q "SHOW MEASUREMENTS"
+	if flag.Arg(0) == "explain" {
+		if err := runExplain(*v, flag.Args()[1:]); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
 	webService, err := httpd.NewService(*v)
 	if err != nil {
 		glog.Fatal(err)
@@ -39,5 +63,90 @@ func main() {
 			glog.Fatal(err)
 		}
 	}()
-	glog.Fatal(webService.Open())
+
+	// start graphite & opentsdb listeners if they are enabled,
+	// their points writer is reloaded together with the web handler
+	writer, err := ingest.NewPointsWriter(*v)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	webService.Handler.AddReloader(writer)
+	ingestServices, err := ingest.NewServices(*v, writer)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	for _, s := range ingestServices {
+		s := s
+		go func() {
+			for err := range s.Err() {
+				glog.Fatal(err)
+			}
+		}()
+		go func() {
+			if err := s.Open(); err != nil {
+				glog.Fatal(err)
+			}
+		}()
+	}
+
+	// report shim statistics into InfluxDB if it is enabled
+	reporter := monitor.NewReporter(*v, ingestServices)
+	if reporter != nil {
+		reporter.Open()
+	}
+	go func() {
+		if err := webService.Open(); err != nil {
+			glog.Fatal(err)
+		}
+	}()
+
+	// deadline of in-flight requests on shutdown, read before config is watched
+	shutdownTimeout := time.Duration(v.GetInt("web.shutdownTimeout")) * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+
+	// reload groups, blacklist, rate limits and auth backends on SIGHUP and on changes of the config file,
+	// invalid config is rejected and the current one is kept
+	v.OnConfigChange(func(e fsnotify.Event) {
+		glog.Infof("Config file %s is changed, reloading", e.Name)
+		webService.Handler.Reload()
+	})
+	v.WatchConfig()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			glog.Info("SIGHUP is received, reloading config")
+			webService.Handler.Reload()
+		}
+	}()
+
+	// shut down gracefully on SIGTERM or SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	glog.Infof("%s is received, shutting down", sig)
+
+	// stop accepting connections, wait for in-flight requests until the timeout,
+	// then flush buffered points and audit records
+	status := 0
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := webService.Shutdown(ctx); err != nil {
+		glog.Errorf("Requests are not finished in %s: %s", shutdownTimeout, err.Error())
+		status = 1
+	}
+	for _, s := range ingestServices {
+		if err := s.Close(ctx); err != nil {
+			glog.Errorf("Unable to close %s listener: %s", s.Name(), err.Error())
+			status = 1
+		}
+	}
+	if reporter != nil {
+		reporter.Close()
+	}
+	glog.Info("shutdown is completed")
+	glog.Flush()
+	cancel()
+	os.Exit(status)
 }
@@ -0,0 +1,279 @@
+// Package metrics keeps counters and histograms of the shim internals
+// and exposes them in Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is implemented by every collector in the registry
+type metric interface {
+	write(w io.Writer)
+	samples() []Sample
+}
+
+// Sample is the current value of a metric with a set of label values
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Values map[string]interface{}
+}
+
+// Registry keeps the list of registered metrics
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []metric
+}
+
+// Default is the registry used by package level constructors
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Expose writes all metrics in Prometheus text format
+func (r *Registry) Expose(w io.Writer) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// Snapshot returns current values of all metrics
+func (r *Registry) Snapshot() []Sample {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var samples []Sample
+	for _, m := range r.metrics {
+		samples = append(samples, m.samples()...)
+	}
+	return samples
+}
+
+// ServeHTTP serves metrics to Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Expose(w)
+}
+
+// Handler returns http handler of the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// labelKey joins label values to use them as a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns labels in form of {name1="value1",name2="value2"}
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelMap pairs label names with their values
+func labelMap(names, values []string) map[string]string {
+	m := make(map[string]string, len(names))
+	for i, n := range names {
+		if i < len(values) && values[i] != "" {
+			m[n] = values[i]
+		}
+	}
+	return m
+}
+
+// Counter is the monotonically increasing value partitioned by labels
+type Counter struct {
+	metricName string
+	help       string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter creates counter and registers it in the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		values:     map[string]*counterValue{},
+	}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter with given label values by one
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds delta to the counter with given label values
+func (c *Counter) Add(delta float64, labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := labelKey(labels)
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: labels}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+func (c *Counter) samples() []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, v := range c.values {
+		samples = append(samples, Sample{
+			Name:   c.metricName,
+			Labels: labelMap(c.labels, v.labels),
+			Values: map[string]interface{}{"value": v.value},
+		})
+	}
+	return samples
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.metricName, c.help, c.metricName)
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %v\n", c.metricName, formatLabels(c.labels, v.labels), v.value)
+	}
+}
+
+// Histogram counts observations in configurable buckets partitioned by labels
+type Histogram struct {
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates histogram with default buckets and registers it in the default registry
+func NewHistogram(name, help string, labels ...string) *Histogram {
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		buckets:    DefaultBuckets,
+		values:     map[string]*histogramValue{},
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe adds the value to the histogram with given label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(labels)
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Since observes duration passed since start, in seconds
+func (h *Histogram) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) samples() []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := make([]Sample, 0, len(h.values))
+	for _, v := range h.values {
+		samples = append(samples, Sample{
+			Name:   h.metricName,
+			Labels: labelMap(h.labels, v.labels),
+			Values: map[string]interface{}{
+				"count": int64(v.count),
+				"sum":   v.sum,
+				"mean":  v.sum / float64(v.count),
+			},
+		})
+	}
+	return samples
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.metricName, h.help, h.metricName)
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, v.labels, "le", fmt.Sprint(upper)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, v.labels, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.metricName, formatLabels(h.labels, v.labels), v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, v.labels), v.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch values := m.(type) {
+	case map[string]*counterValue:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValue:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
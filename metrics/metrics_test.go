@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExpose(t *testing.T) {
+	r := &Registry{}
+	c := &Counter{metricName: "test_total", help: "Test counter.", labels: []string{"route"}, values: map[string]*counterValue{}}
+	h := &Histogram{metricName: "test_seconds", help: "Test histogram.", buckets: []float64{1, 5}, values: map[string]*histogramValue{}}
+	r.register(c)
+	r.register(h)
+
+	c.Inc("query")
+	c.Add(2, "query")
+	c.Inc("auth")
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	r.Expose(&buf)
+
+	for _, want := range []string{
+		"# TYPE test_total counter",
+		`test_total{route="auth"} 1`,
+		`test_total{route="query"} 3`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="5"} 2`,
+		`test_seconds_bucket{le="+Inf"} 2`,
+		"test_seconds_sum 3.5",
+		"test_seconds_count 2",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %s in output:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package monitor periodically writes shim statistics into InfluxDB,
+// similar to the "_internal" database of InfluxDB itself
+package monitor
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Maksadbek/influxdb-shim/ingest"
+	"github.com/Maksadbek/influxdb-shim/metrics"
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/spf13/viper"
+)
+
+// timeout of backend health check
+const pingTimeout = 5 * time.Second
+
+// Reporter writes statistics of the shim as points
+type Reporter struct {
+	influxConf      client.HTTPConfig
+	database        string
+	retentionPolicy string
+	interval        time.Duration
+	hostname        string
+	services        []ingest.Service
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReporter creates new reporter by "monitor" section of config
+// returns nil if the reporter is not enabled
+func NewReporter(c viper.Viper, services []ingest.Service) *Reporter {
+	if !c.GetBool("monitor.enabled") {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	r := &Reporter{
+		influxConf: client.HTTPConfig{
+			Addr:      c.GetString("influxdb.addr"),
+			Username:  c.GetString("influxdb.username"),
+			Password:  c.GetString("influxdb.password"),
+			UserAgent: c.GetString("influxdb.userAgent"),
+		},
+		database:        c.GetString("monitor.database"),
+		retentionPolicy: c.GetString("monitor.retentionPolicy"),
+		interval:        time.Duration(c.GetInt("monitor.interval")) * time.Second,
+		hostname:        hostname,
+		services:        services,
+		done:            make(chan struct{}),
+	}
+	if r.database == "" {
+		r.database = "_shim"
+	}
+	if r.interval <= 0 {
+		r.interval = 10 * time.Second
+	}
+	return r
+}
+
+// Open starts reporting in background
+func (r *Reporter) Open() {
+	glog.Infof("Reporting statistics to database '%s' every %s", r.database, r.interval)
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close stops reporting
+func (r *Reporter) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *Reporter) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.report(); err != nil {
+				glog.Errorf("Unable to report statistics: %s", err.Error())
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// report collects statistics and writes them in one batch
+func (r *Reporter) report() error {
+	c, err := client.NewHTTPClient(r.influxConf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        r.database,
+		RetentionPolicy: r.retentionPolicy,
+		Precision:       "s",
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	add := func(name string, tags map[string]string, fields map[string]interface{}) {
+		tags["hostname"] = r.hostname
+		p, err := client.NewPoint(name, tags, fields, now)
+		if err != nil {
+			glog.Errorf("Unable to create %s point: %s", name, err.Error())
+			return
+		}
+		bp.AddPoint(p)
+	}
+
+	// requests, denials and latencies
+	for _, s := range metrics.Default.Snapshot() {
+		add(s.Name, s.Labels, s.Values)
+	}
+
+	// listeners counters and queue depths
+	for _, s := range r.services {
+		stats := s.Statistics()
+		add("shim_ingest", map[string]string{"listener": s.Name()}, map[string]interface{}{
+			"packetsReceived": stats.PacketsReceived,
+			"pointsReceived":  stats.PointsReceived,
+			"pointsDropped":   stats.PointsDropped,
+			"parseErrors":     stats.ParseErrors,
+			"writeErrors":     stats.WriteErrors,
+			"queueDepth":      stats.QueueDepth,
+		})
+	}
+
+	// backend health
+	rtt, version, err := c.Ping(pingTimeout)
+	tags := map[string]string{}
+	if version != "" {
+		tags["version"] = version
+	}
+	add("shim_backend", tags, map[string]interface{}{
+		"up":      err == nil,
+		"pingRTT": rtt.Seconds(),
+	})
+	if err != nil {
+		glog.Errorf("InfluxDB is not healthy: %s", err.Error())
+		return err
+	}
+
+	return c.Write(bp)
+}
@@ -0,0 +1,112 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Maksadbek/influxdb-shim/ingest"
+	"github.com/spf13/viper"
+)
+
+// fakeService is the listener with fixed statistics
+type fakeService struct {
+	name  string
+	stats ingest.Statistics
+}
+
+func (s *fakeService) Open() error                     { return nil }
+func (s *fakeService) Close(ctx context.Context) error { return nil }
+func (s *fakeService) Err() <-chan error               { return nil }
+func (s *fakeService) Name() string                    { return s.name }
+func (s *fakeService) Statistics() ingest.Statistics   { return s.stats }
+
+// fakeInfluxDB answers pings and records databases and lines of writes
+type fakeInfluxDB struct {
+	*httptest.Server
+	writes []string
+}
+
+func newFakeInfluxDB() *fakeInfluxDB {
+	f := &fakeInfluxDB{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "1.8.0")
+		if r.URL.Path == "/write" {
+			body, _ := ioutil.ReadAll(r.Body)
+			for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+				f.writes = append(f.writes, r.FormValue("db")+"."+r.FormValue("rp")+": "+line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return f
+}
+
+func TestNewReporter(t *testing.T) {
+	c := viper.New()
+	if r := NewReporter(*c, nil); r != nil {
+		t.Errorf("want nil reporter if monitor is not enabled, got %+v", r)
+	}
+	c.Set("monitor.enabled", true)
+	r := NewReporter(*c, nil)
+	if r == nil || r.database != "_shim" || r.interval.Seconds() != 10 {
+		t.Errorf("want reporter to _shim every 10s, got %+v", r)
+	}
+}
+
+func TestReport(t *testing.T) {
+	influx := newFakeInfluxDB()
+	defer influx.Close()
+	c := viper.New()
+	c.SetConfigType("toml")
+	err := c.ReadConfig(bytes.NewBufferString(fmt.Sprintf(`
+[influxdb]
+addr = %q
+[monitor]
+enabled = true
+database = "shim"
+retentionPolicy = "weekly"
+`, influx.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReporter(*c, []ingest.Service{
+		&fakeService{name: "graphite", stats: ingest.Statistics{PacketsReceived: 3, PointsReceived: 5, PointsDropped: 1, ParseErrors: 2, QueueDepth: 4}},
+	})
+	r.hostname = "shim-1"
+	if err := r.report(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"shim.weekly: shim_ingest,hostname=shim-1,listener=graphite packetsReceived=3i,parseErrors=2i,pointsDropped=1i,pointsReceived=5i,queueDepth=4i,writeErrors=0i",
+		"shim.weekly: shim_backend,hostname=shim-1,version=1.8.0 pingRTT=",
+	}
+	for _, w := range want {
+		found := false
+		for _, line := range influx.writes {
+			if strings.HasPrefix(line, w) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("want %s, got %v", w, influx.writes)
+		}
+	}
+	for _, line := range influx.writes {
+		if !strings.Contains(line, "hostname=shim-1") {
+			t.Errorf("want hostname tag, got %s", line)
+		}
+	}
+
+	// unreachable InfluxDB is reported as the error
+	influx.Close()
+	if err := r.report(); err == nil {
+		t.Error("want error of unreachable InfluxDB, got nil")
+	}
+}
@@ -0,0 +1,466 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errNotContinuousQuery = errors.New("Query is not a continuous query")
+
+// Shape is the part of the SELECT statement that decides which retention policy can serve it
+type Shape struct {
+	Database     string        // database of sources
+	Measurements []string      // names of measurement sources
+	Regex        bool          // some sources are regexes, they can match any measurement
+	Interval     time.Duration // GROUP BY time interval
+	Start        time.Time     // lower bound of time, zero if the range is not bounded
+	Aggregates   []Aggregate   // functions of fields of the statement
+}
+
+// Aggregate is the function of one field, e.g: mean(value)
+type Aggregate struct {
+	Function string // lower case function name
+	Field    string
+}
+
+func (a Aggregate) String() string {
+	return a.Function + "(" + quoteIdent(a.Field, false) + ")"
+}
+
+// composable functions of downsampled points give results of raw points,
+// e.g: the maximum of hourly maximums is the maximum, the mean of hourly means is the mean of evenly spaced points
+var composable = map[string]bool{"mean": true, "sum": true, "min": true, "max": true, "first": true, "last": true}
+
+// Composable checks whether the function of points downsampled by the same function gives the result of raw points,
+// e.g: count of hourly counts is not the count of points
+func Composable(function string) bool {
+	return composable[strings.ToLower(function)]
+}
+
+// ParseAggregate parses the function of one field, e.g: mean(value)
+func ParseAggregate(s string) (Aggregate, error) {
+	tokens, err := Tokenize(s)
+	if err != nil {
+		return Aggregate{}, err
+	}
+	aggs, ok := aggregates(tokens)
+	if !ok || len(aggs) != 1 || len(tokens) != 4 {
+		return Aggregate{}, fmt.Errorf("invalid function of the field: %s", s)
+	}
+	return aggs[0], nil
+}
+
+// aggregates returns functions of fields in the field list of SELECT statement,
+// e.g: mean(value) and max(value) of mean(value), derivative(max(value), 1h),
+// false if some fields are not aggregated by the function of one field, e.g: value, percentile(value, 95), mean(*)
+func aggregates(fields []Token) ([]Aggregate, bool) {
+	var aggs []Aggregate
+	for i := 0; i < len(fields); i++ {
+		t := fields[i]
+		switch {
+		case t.Kind == Regex:
+			return nil, false
+		case t.IsKeyword("AS"):
+			// skip the alias
+			i++
+		case t.Kind == Ident && !isKeyword(t):
+			if i+3 >= len(fields) || fields[i+1].Kind != Operator || fields[i+1].Value != "(" {
+				// raw field
+				return nil, false
+			}
+			arg, next := fields[i+2], fields[i+3]
+			switch {
+			case arg.Kind == Ident && !isKeyword(arg) && next.Kind == Operator && next.Value == ")":
+				aggs = append(aggs, Aggregate{Function: strings.ToLower(t.Value), Field: arg.Value})
+				i += 3
+			case arg.Kind == Ident && !isKeyword(arg) && next.Kind == Operator && next.Value == "(":
+				// transformation of the aggregate, e.g: derivative(mean(value), 1h)
+				i++
+			default:
+				return nil, false
+			}
+		}
+	}
+	return aggs, len(aggs) > 0
+}
+
+// Route reads SELECT statements grouped by time from the retention policy chosen by choose,
+// statements with explicit retention policy, INTO, subqueries or OR conditions are kept as they are.
+// database is the database of sources that are not fully qualified,
+// choose returns empty name if the default retention policy must be read.
+// Returns the query and chosen policies in order of statements
+func Route(q, database string, now time.Time, choose func(Shape) string) (string, []string, error) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return q, nil, err
+	}
+	var edits []edit
+	var chosen []string
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].Kind == Operator && tokens[i].Value == ";") {
+			continue
+		}
+		if stmt := tokens[start:i]; len(stmt) > 0 {
+			if rp, e := route(stmt, database, now, choose); rp != "" {
+				edits = append(edits, e...)
+				chosen = append(chosen, rp)
+			}
+		}
+		start = i + 1
+	}
+	if len(edits) == 0 {
+		return q, nil, nil
+	}
+	return apply(q, edits), chosen, nil
+}
+
+// route returns the chosen retention policy of the statement and edits of its sources
+func route(stmt []Token, database string, now time.Time, choose func(Shape) string) (string, []edit) {
+	if keywordAt(stmt, 0) != "SELECT" {
+		return "", nil
+	}
+	from := -1
+	for i, t := range stmt {
+		switch {
+		case t.IsKeyword("INTO") || t.IsKeyword("OR"):
+			return "", nil
+		case t.IsKeyword("FROM"):
+			if from >= 0 {
+				return "", nil
+			}
+			from = i
+		}
+	}
+	if from < 0 || from+1 >= len(stmt) {
+		return "", nil
+	}
+
+	shape := Shape{Database: database}
+	var ok bool
+	if shape.Aggregates, ok = aggregates(stmt[1:from]); !ok {
+		// raw fields and functions of several fields are not downsampled
+		return "", nil
+	}
+	// positions where the retention policy is inserted, with "." after it if needed
+	type insert struct {
+		pos int
+		dot bool
+	}
+	qualified := ""
+	var inserts []insert
+	for j := from + 1; j < len(stmt); j++ {
+		switch {
+		case stmt[j].Kind == Regex:
+			shape.Regex = true
+			inserts = append(inserts, insert{pos: stmt[j].Pos, dot: true})
+			j++
+		case stmt[j].Kind == Ident && !isKeyword(stmt[j]):
+			parts, next := source(stmt, j)
+			switch {
+			case len(parts) == 1:
+				shape.Measurements = append(shape.Measurements, parts[0].Value)
+				inserts = append(inserts, insert{pos: parts[0].Pos, dot: true})
+			case len(parts) == 3 && parts[1] == nil && parts[2] != nil:
+				// db..measurement, the policy goes between dots,
+				// sources of one statement must be in one database
+				if qualified != "" && qualified != parts[0].Value {
+					return "", nil
+				}
+				qualified = parts[0].Value
+				shape.Measurements = append(shape.Measurements, parts[2].Value)
+				inserts = append(inserts, insert{pos: dotAfter(stmt, parts[0])})
+			default:
+				// explicit retention policy or subquery
+				return "", nil
+			}
+			j = next
+		default:
+			return "", nil
+		}
+		if j >= len(stmt) || stmt[j].Kind != Operator || stmt[j].Value != "," {
+			break
+		}
+	}
+
+	if qualified != "" {
+		if len(shape.Measurements) != len(inserts) {
+			// mix of qualified and unqualified sources
+			return "", nil
+		}
+		shape.Database = qualified
+	}
+
+	shape.Interval = groupByInterval(stmt)
+	if shape.Interval <= 0 {
+		// raw points are not downsampled
+		return "", nil
+	}
+	shape.Start = lowerBound(stmt, now)
+
+	rp := choose(shape)
+	if rp == "" {
+		return "", nil
+	}
+	edits := make([]edit, len(inserts))
+	for i, in := range inserts {
+		text := quoteIdent(rp, false)
+		if in.dot {
+			text += "."
+		}
+		edits[i] = edit{pos: in.pos, end: in.pos, text: text}
+	}
+	return rp, edits
+}
+
+// dotAfter returns the offset after the dot following the token
+func dotAfter(stmt []Token, t *Token) int {
+	for i := range stmt {
+		if stmt[i].Pos == t.Pos && i+1 < len(stmt) {
+			return stmt[i+1].End
+		}
+	}
+	return t.End + 1
+}
+
+// groupByInterval returns the interval of GROUP BY time(interval), 0 if there is none
+func groupByInterval(stmt []Token) time.Duration {
+	for i := 0; i+1 < len(stmt); i++ {
+		if !stmt[i].IsKeyword("GROUP") || !stmt[i+1].IsKeyword("BY") {
+			continue
+		}
+		for j := i + 2; j+2 < len(stmt); j++ {
+			if stmt[j].IsKeyword("time") && stmt[j+1].Kind == Operator && stmt[j+1].Value == "(" && stmt[j+2].Kind == Duration {
+				d, err := ParseDuration(stmt[j+2].Value)
+				if err != nil {
+					return 0
+				}
+				return d
+			}
+		}
+	}
+	return 0
+}
+
+// lowerBound returns the latest lower bound of time in conditions of the statement,
+// e.g: time > now() - 30d, time >= '2016-01-01T00:00:00Z', zero if there is none
+func lowerBound(stmt []Token, now time.Time) time.Time {
+	var bound time.Time
+	for i := 0; i+2 < len(stmt); i++ {
+		if !stmt[i].IsKeyword("time") || stmt[i+1].Kind != Operator || (stmt[i+1].Value != ">" && stmt[i+1].Value != ">=") {
+			continue
+		}
+		var t time.Time
+		v := stmt[i+2:]
+		switch {
+		case v[0].IsKeyword("now") && len(v) >= 3 && v[1].Value == "(" && v[2].Value == ")":
+			t = now
+			if len(v) >= 5 && v[3].Kind == Operator && v[4].Kind == Duration {
+				d, err := ParseDuration(v[4].Value)
+				if err != nil {
+					continue
+				}
+				switch v[3].Value {
+				case "-":
+					t = now.Add(-d)
+				case "+":
+					t = now.Add(d)
+				}
+			}
+		case v[0].Kind == String:
+			var err error
+			if t, err = time.Parse(time.RFC3339Nano, v[0].Value); err != nil {
+				if t, err = time.Parse("2006-01-02 15:04:05", v[0].Value); err != nil {
+					if t, err = time.Parse("2006-01-02", v[0].Value); err != nil {
+						continue
+					}
+				}
+			}
+		case v[0].Kind == Number:
+			ns, err := strconv.ParseInt(v[0].Value, 10, 64)
+			if err != nil {
+				continue
+			}
+			t = time.Unix(0, ns)
+		default:
+			continue
+		}
+		if t.After(bound) {
+			bound = t
+		}
+	}
+	return bound
+}
+
+// duration units of InfluxQL
+var units = map[string]time.Duration{
+	"ns": time.Nanosecond, "u": time.Microsecond, "µ": time.Microsecond, "ms": time.Millisecond,
+	"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour,
+}
+
+// ParseDuration parses InfluxQL duration, e.g: 90m, 1h30m, 1d, 4w, "0" is zero duration
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	var d time.Duration
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		start := i
+		for i < len(r) && unicode.IsDigit(r[i]) {
+			i++
+		}
+		n, err := strconv.ParseInt(string(r[start:i]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		start = i
+		for i < len(r) && !unicode.IsDigit(r[i]) {
+			i++
+		}
+		unit, ok := units[strings.ToLower(string(r[start:i]))]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// ContinuousQuery is the target of the continuous query
+type ContinuousQuery struct {
+	Database        string
+	RetentionPolicy string
+	Measurements    []string // measurements written by the query, all if empty
+	Interval        time.Duration
+	Aggregates      []Aggregate // functions of fields that keep field names, e.g: mean(value) AS value
+}
+
+// ParseContinuousQuery reads the target retention policy, source measurements, interval and functions of fields of
+// CREATE CONTINUOUS QUERY ... BEGIN SELECT ... INTO [db.]rp.:MEASUREMENT FROM ... GROUP BY time(interval) ... END,
+// queries that write into other measurement names than their sources or rename all fields are not supported
+func ParseContinuousQuery(q string) (ContinuousQuery, error) {
+	var cq ContinuousQuery
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return cq, err
+	}
+	into := -1
+	for i, t := range tokens {
+		if t.IsKeyword("INTO") {
+			into = i
+			break
+		}
+	}
+	if into < 0 || into+1 >= len(tokens) {
+		return cq, errNotContinuousQuery
+	}
+	parts, next := source(tokens, into+1)
+	var target *Token
+	switch len(parts) {
+	case 2:
+		if parts[0] != nil {
+			cq.RetentionPolicy = parts[0].Value
+		}
+		target = parts[1]
+	case 3:
+		if parts[0] != nil {
+			cq.Database = parts[0].Value
+		}
+		if parts[1] != nil {
+			cq.RetentionPolicy = parts[1].Value
+		}
+		target = parts[2]
+	}
+	if cq.RetentionPolicy == "" {
+		return cq, errNotContinuousQuery
+	}
+	// :MEASUREMENT back-reference writes into names of sources
+	backReference := target == nil && next+1 < len(tokens) && tokens[next].Value == ":" && tokens[next+1].IsKeyword("MEASUREMENT")
+
+	regex := false
+	for i := next; i < len(tokens); i++ {
+		if !tokens[i].IsKeyword("FROM") {
+			continue
+		}
+		for j := i + 1; j < len(tokens); j++ {
+			name, isRegex, n := measurementAt(tokens, j)
+			switch {
+			case isRegex:
+				regex = true
+			case name != "":
+				cq.Measurements = append(cq.Measurements, name)
+			default:
+				return cq, errNotContinuousQuery
+			}
+			if j = n; j >= len(tokens) || tokens[j].Kind != Operator || tokens[j].Value != "," {
+				break
+			}
+		}
+		break
+	}
+	switch {
+	case backReference && regex:
+		cq.Measurements = nil
+	case backReference:
+	case target != nil && !regex && len(cq.Measurements) == 1 && cq.Measurements[0] == target.Value:
+	default:
+		return cq, errNotContinuousQuery
+	}
+	if cq.Interval = groupByInterval(tokens); cq.Interval <= 0 {
+		return cq, errNotContinuousQuery
+	}
+	for i := 0; i < into; i++ {
+		if !tokens[i].IsKeyword("SELECT") {
+			continue
+		}
+		cq.Aggregates = aliased(tokens[i+1 : into])
+		break
+	}
+	if len(cq.Aggregates) == 0 {
+		return cq, errNotContinuousQuery
+	}
+	return cq, nil
+}
+
+// aliased returns functions of fields written into the same field names, e.g: mean(value) AS value
+func aliased(fields []Token) []Aggregate {
+	var aggs []Aggregate
+	for i := 0; i+5 < len(fields); i++ {
+		f := fields[i : i+6]
+		// the field is the whole expression, e.g: not 2 * mean(value) AS value
+		whole := (i == 0 || isComma(fields[i-1])) && (i+6 == len(fields) || isComma(fields[i+6]))
+		if whole && f[0].Kind == Ident && !isKeyword(f[0]) && f[1].Kind == Operator && f[1].Value == "(" &&
+			f[2].Kind == Ident && f[3].Kind == Operator && f[3].Value == ")" &&
+			f[4].IsKeyword("AS") && f[5].Kind == Ident && f[5].Value == f[2].Value {
+			aggs = append(aggs, Aggregate{Function: strings.ToLower(f[0].Value), Field: f[2].Value})
+		}
+	}
+	return aggs
+}
+
+func isComma(t Token) bool {
+	return t.Kind == Operator && t.Value == ","
+}
+
+// measurementAt reads the source at start, e.g: cpu, db.rp.cpu, /^cpu/, db.rp./^cpu/,
+// returns the measurement name or true if it is a regex, and the index of the next token
+func measurementAt(tokens []Token, start int) (string, bool, int) {
+	if tokens[start].Kind == Regex {
+		return "", true, start + 1
+	}
+	parts, next := source(tokens, start)
+	switch {
+	case len(parts) == 0:
+		return "", false, next
+	case parts[len(parts)-1] != nil:
+		return parts[len(parts)-1].Value, false, next
+	case next < len(tokens) && tokens[next].Kind == Regex:
+		return "", true, next + 1
+	}
+	return "", false, next
+}
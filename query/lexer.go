@@ -0,0 +1,182 @@
+// Package query is the lightweight InfluxQL tokenizer of the shim,
+// it is enough to compare queries by their shape without the full parser
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Kind is the kind of the token
+type Kind int
+
+// kinds of tokens
+const (
+	Ident    Kind = iota // bare or double quoted identifier, keywords included
+	String               // single quoted string
+	Number               // integer or float
+	Duration             // duration literal, e.g: 5m
+	Regex                // regular expression, e.g: /^cpu/
+	Param                // bound parameter, e.g: $host
+	Operator             // operators and punctuation
+)
+
+// Token is the single token of the query
+type Token struct {
+	Kind   Kind
+	Value  string // unquoted value, parameter name without $
+	Quoted bool   // identifier was double quoted
+	Pos    int    // offsets of the token in the query, in runes
+	End    int
+}
+
+// IsKeyword checks whether the token is the bare keyword, e.g: SELECT
+func (t Token) IsKeyword(keyword string) bool {
+	return t.Kind == Ident && !t.Quoted && strings.EqualFold(t.Value, keyword)
+}
+
+func (t Token) String() string {
+	switch t.Kind {
+	case String:
+		return "'" + strings.Replace(t.Value, "'", `\'`, -1) + "'"
+	case Regex:
+		return "/" + t.Value + "/"
+	case Param:
+		return "$" + t.Value
+	case Ident:
+		if t.Quoted {
+			return `"` + strings.Replace(t.Value, `"`, `\"`, -1) + `"`
+		}
+	}
+	return t.Value
+}
+
+// operators of two characters
+var operators = []string{"=~", "!~", "!=", "<>", "<=", ">=", "::"}
+
+// Tokenize splits the query into tokens, line comments are skipped,
+// block comments are rejected, as they can hide names of sources from rewrites of the shim
+func Tokenize(q string) ([]Token, error) {
+	var tokens []Token
+	r := []rune(q)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			// line comment
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			value, end, err := quoted(r, i)
+			if err != nil {
+				return nil, err
+			}
+			kind := String
+			if c == '"' {
+				kind = Ident
+			}
+			tokens = append(tokens, Token{Kind: kind, Value: value, Quoted: c == '"', Pos: i, End: end})
+			i = end
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			return nil, fmt.Errorf("block comments are not supported, found at %d", i)
+		case c == '/' && regexAllowed(tokens):
+			value, end, err := quoted(r, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: Regex, Value: value, Pos: i, End: end})
+			i = end
+		case c == '$':
+			end := word(r, i+1)
+			if end == i+1 {
+				return nil, fmt.Errorf("empty parameter name at %d", i)
+			}
+			tokens = append(tokens, Token{Kind: Param, Value: string(r[i+1 : end]), Pos: i, End: end})
+			i = end
+		case unicode.IsDigit(c) || c == '.' && i+1 < len(r) && unicode.IsDigit(r[i+1]):
+			end := i
+			for end < len(r) && (unicode.IsDigit(r[end]) || r[end] == '.') {
+				end++
+			}
+			kind := Number
+			if unit := word(r, end); unit > end {
+				// duration units, e.g: 10s, 1h, 500ms
+				kind, end = Duration, unit
+			}
+			tokens = append(tokens, Token{Kind: kind, Value: strings.ToLower(string(r[i:end])), Pos: i, End: end})
+			i = end
+		case isIdentRune(c):
+			end := word(r, i)
+			tokens = append(tokens, Token{Kind: Ident, Value: string(r[i:end]), Pos: i, End: end})
+			i = end
+		default:
+			op := string(c)
+			if i+1 < len(r) {
+				for _, o := range operators {
+					if string(r[i:i+2]) == o {
+						op = o
+						break
+					}
+				}
+			}
+			end := i + len([]rune(op))
+			tokens = append(tokens, Token{Kind: Operator, Value: op, Pos: i, End: end})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// quoted reads the literal enclosed by the quote character at start,
+// returns unescaped value and the index after the closing quote
+func quoted(r []rune, start int) (string, int, error) {
+	quote := r[start]
+	var b bytes.Buffer
+	for i := start + 1; i < len(r); i++ {
+		switch {
+		case r[i] == '\\' && i+1 < len(r) && (r[i+1] == quote || r[i+1] == '\\' && quote != '/'):
+			b.WriteRune(r[i+1])
+			i++
+		case r[i] == quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteRune(r[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c at %d", quote, start)
+}
+
+// regexAllowed checks whether '/' starts regex rather than division,
+// regex follows =~, !~ and FROM or the list of measurements, e.g: db.rp./^cpu/,
+// or it is the argument of the function, e.g: max(/^mem/)
+func regexAllowed(tokens []Token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	switch {
+	case last.Kind == Operator:
+		return last.Value == "=~" || last.Value == "!~" || last.Value == "," || last.Value == "." || last.Value == "("
+	case last.IsKeyword("FROM"):
+		return true
+	}
+	return false
+}
+
+// word returns the end of the identifier starting at start
+func word(r []rune, start int) int {
+	end := start
+	for end < len(r) && (isIdentRune(r[end]) || unicode.IsDigit(r[end])) {
+		end++
+	}
+	return end
+}
+
+func isIdentRune(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
+}
@@ -0,0 +1,503 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	testData := []struct {
+		q      string
+		tokens []Token
+	}{
+		{
+			q: `SELECT "value" FROM cpu WHERE host =~ /^web\/1/ AND time > now() - 5m`,
+			tokens: []Token{
+				{Kind: Ident, Value: "SELECT"}, {Kind: Ident, Value: "value", Quoted: true}, {Kind: Ident, Value: "FROM"}, {Kind: Ident, Value: "cpu"},
+				{Kind: Ident, Value: "WHERE"}, {Kind: Ident, Value: "host"}, {Kind: Operator, Value: "=~"}, {Kind: Regex, Value: "^web/1"},
+				{Kind: Ident, Value: "AND"}, {Kind: Ident, Value: "time"}, {Kind: Operator, Value: ">"}, {Kind: Ident, Value: "now"},
+				{Kind: Operator, Value: "("}, {Kind: Operator, Value: ")"}, {Kind: Operator, Value: "-"}, {Kind: Duration, Value: "5m"},
+			},
+		},
+		{
+			q: `select mean(v) / 2 from m where t = 'it\'s' -- comment`,
+			tokens: []Token{
+				{Kind: Ident, Value: "select"}, {Kind: Ident, Value: "mean"}, {Kind: Operator, Value: "("}, {Kind: Ident, Value: "v"},
+				{Kind: Operator, Value: ")"}, {Kind: Operator, Value: "/"}, {Kind: Number, Value: "2"}, {Kind: Ident, Value: "from"},
+				{Kind: Ident, Value: "m"}, {Kind: Ident, Value: "where"}, {Kind: Ident, Value: "t"}, {Kind: Operator, Value: "="},
+				{Kind: String, Value: "it's"},
+			},
+		},
+	}
+
+	for _, d := range testData {
+		tokens, err := Tokenize(d.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != len(d.tokens) {
+			t.Fatalf("want %v, got %v", d.tokens, tokens)
+		}
+		for i := range d.tokens {
+			if tokens[i].Kind != d.tokens[i].Kind || tokens[i].Value != d.tokens[i].Value || tokens[i].Quoted != d.tokens[i].Quoted {
+				t.Errorf("want %v, got %v", d.tokens[i], tokens[i])
+			}
+		}
+	}
+
+	if _, err := Tokenize("SELECT * FROM cpu WHERE host = 'web"); err == nil {
+		t.Error("want error of unterminated string, got nil")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := Compile("SELECT mean(value) FROM cpu WHERE host = $host AND time > $t GROUP BY time($interval)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		q      string
+		match  bool
+		params map[string]string
+	}{
+		{
+			q:      "select mean(value) from cpu where host = 'web-1' and time > now() - 1h group by time(5m)",
+			match:  true,
+			params: map[string]string{"host": "'web-1'", "t": "now ( ) - 1h", "interval": "5m"},
+		},
+		{
+			q:      `SELECT mean("value") FROM "cpu" WHERE host = 'db' AND time > 1500000000000000000 GROUP BY time(1m);`,
+			match:  true,
+			params: map[string]string{"host": "'db'", "t": "1500000000000000000", "interval": "1m"},
+		},
+		{
+			// injected condition
+			q:     "SELECT mean(value) FROM cpu WHERE host = 'a' OR host = 'b' AND time > now() - 1h GROUP BY time(5m)",
+			match: false,
+		},
+		{
+			// another measurement
+			q:     "SELECT mean(value) FROM mem WHERE host = 'a' AND time > now() - 1h GROUP BY time(5m)",
+			match: false,
+		},
+		{
+			// another statement
+			q:     "SELECT mean(value) FROM cpu WHERE host = 'a' AND time > now() - 1h GROUP BY time(5m); DROP DATABASE metrics",
+			match: false,
+		},
+		{
+			q:     "SELECT mean(value) FROM cpu WHERE host = 'a' AND time > now() - 1h",
+			match: false,
+		},
+		// parameters are single literals, not identifiers or expressions
+		{q: "SELECT mean(value) FROM cpu WHERE host = host AND time > now() - 1h GROUP BY time(5m)"},
+		{q: "SELECT mean(value) FROM cpu WHERE host = 'a' + x AND time > now() - 1h GROUP BY time(5m)"},
+		{q: `SELECT mean(value) FROM cpu WHERE host = "server" AND time > now() - 1h GROUP BY time(5m)`},
+		{q: "SELECT mean(value) FROM cpu WHERE host = 'a' AND time > now() - 1h - 1h GROUP BY time(5m)"},
+		{q: "SELECT mean(value) FROM cpu WHERE host = 'a' AND time > now() - value GROUP BY time(5m)"},
+		{q: "SELECT mean(value) FROM cpu WHERE host = 'a' AND time > now() GROUP BY time(5m)", match: true},
+	}
+
+	for _, d := range testData {
+		params, ok := tmpl.Match(d.q)
+		if ok != d.match {
+			t.Errorf("%s: want %v, got %v", d.q, d.match, ok)
+			continue
+		}
+		for name, value := range d.params {
+			if params[name] != value {
+				t.Errorf("want %s, got %s", value, params[name])
+			}
+		}
+	}
+
+	// the same parameter must have the same value
+	tmpl, err = Compile("SELECT * FROM cpu WHERE host = $h OR server = $h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tmpl.Match("SELECT * FROM cpu WHERE host = 'a' OR server = 'a'"); !ok {
+		t.Error("want match, got none")
+	}
+	if _, ok := tmpl.Match("SELECT * FROM cpu WHERE host = 'a' OR server = 'b'"); ok {
+		t.Error("want no match, got match")
+	}
+}
+
+func TestParse(t *testing.T) {
+	testData := []struct {
+		q          string
+		privileges [][]Privilege
+	}{
+		{"SELECT * FROM cpu", [][]Privilege{{Read}}},
+		{"select * into cpu_1h from cpu; show measurements;", [][]Privilege{{Read, Write}, {SchemaRead}}},
+		{"SHOW TAG KEYS FROM cpu; SHOW USERS", [][]Privilege{{SchemaRead}, {Admin}}},
+		{"DROP MEASUREMENT cpu; DELETE FROM cpu WHERE time < now() - 30d", [][]Privilege{{Delete}, {Delete}}},
+		{"CREATE RETENTION POLICY one_day ON metrics DURATION 1d REPLICATION 1", [][]Privilege{{SchemaWrite}}},
+		{"DROP CONTINUOUS QUERY cq ON metrics", [][]Privilege{{SchemaWrite}}},
+		{"DROP DATABASE metrics", [][]Privilege{{Admin}}},
+		{"DROP SHARD 1", [][]Privilege{{Admin}}},
+		{"CREATE USER bob WITH PASSWORD 'secret'", [][]Privilege{{Admin}}},
+		{"KILL QUERY 36", [][]Privilege{{Admin}}},
+		{"EXPLAIN ANALYZE SELECT * FROM cpu", [][]Privilege{{Read}}},
+		{"SELECT * FROM cpu; DROP SERIES FROM cpu", [][]Privilege{{Read}, {Delete}}},
+	}
+
+	for _, d := range testData {
+		statements, err := Parse(d.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statements) != len(d.privileges) {
+			t.Fatalf("%s: want %d statements, got %d", d.q, len(d.privileges), len(statements))
+		}
+		for i, stmt := range statements {
+			if len(stmt.Privileges) != len(d.privileges[i]) {
+				t.Errorf("%s: want %v, got %v", stmt.Text, d.privileges[i], stmt.Privileges)
+				continue
+			}
+			for j := range stmt.Privileges {
+				if stmt.Privileges[j] != d.privileges[i][j] {
+					t.Errorf("%s: want %v, got %v", stmt.Text, d.privileges[i], stmt.Privileges)
+				}
+			}
+		}
+	}
+
+	if _, err := Parse(" ; "); err == nil {
+		t.Error("want error of empty query, got nil")
+	}
+}
+
+func TestRename(t *testing.T) {
+	databases := map[string]string{"payments": "payments_prod"}
+	measurements := map[string]string{"cpu": "cpu_v2", "mem": "memory usage"}
+	rename := func(m map[string]string) func(string) string {
+		return func(name string) string {
+			if alias, ok := m[name]; ok {
+				return alias
+			}
+			return name
+		}
+	}
+
+	testData := []struct {
+		q        string
+		want     string
+		rewrites int
+		err      bool
+	}{
+		{
+			q:        "SELECT mean(value) FROM cpu WHERE time > now() - 1h GROUP BY time(5m)",
+			want:     "SELECT mean(value) FROM cpu_v2 WHERE time > now() - 1h GROUP BY time(5m)",
+			rewrites: 1,
+		},
+		{
+			q:        `SELECT * FROM payments.autogen."cpu", mem, /^disk/`,
+			want:     `SELECT * FROM payments_prod.autogen."cpu_v2", "memory usage", /^disk/`,
+			rewrites: 3,
+		},
+		{
+			q:        "SELECT * INTO payments..cpu FROM (SELECT * FROM cpu)",
+			want:     "SELECT * INTO payments_prod..cpu_v2 FROM (SELECT * FROM cpu_v2)",
+			rewrites: 2,
+		},
+		{
+			q:        "SHOW MEASUREMENTS ON payments; DROP MEASUREMENT cpu; SHOW TAG KEYS WITH MEASUREMENT = mem",
+			want:     `SHOW MEASUREMENTS ON payments_prod; DROP MEASUREMENT cpu_v2; SHOW TAG KEYS WITH MEASUREMENT = "memory usage"`,
+			rewrites: 3,
+		},
+		{
+			// fully qualified sources are renamed too
+			q:        `SELECT * FROM "payments"."autogen"."disk"; SHOW RETENTION POLICIES ON "payments"`,
+			want:     `SELECT * FROM "payments_prod"."autogen"."disk"; SHOW RETENTION POLICIES ON "payments_prod"`,
+			rewrites: 1,
+		},
+		{
+			q:        "SELECT value FROM disk WHERE host = 'cpu'",
+			want:     "SELECT value FROM disk WHERE host = 'cpu'",
+			rewrites: 0,
+		},
+		{
+			// sources after subqueries and regexes are renamed too
+			q:        "SELECT * FROM (SELECT * FROM cpu), payments..mem; SELECT * FROM payments.autogen./^disk/, cpu",
+			want:     `SELECT * FROM (SELECT * FROM cpu_v2), payments_prod.."memory usage"; SELECT * FROM payments_prod.autogen./^disk/, cpu_v2`,
+			rewrites: 3,
+		},
+		{
+			q:        "SELECT mean(value) INTO payments.autogen.:MEASUREMENT FROM /.*/ GROUP BY time(1h)",
+			want:     "SELECT mean(value) INTO payments_prod.autogen.:MEASUREMENT FROM /.*/ GROUP BY time(1h)",
+			rewrites: 1,
+		},
+		// sources that can not be read are errors, so they are never sent without rewrites
+		{q: `SELECT * FROM /* x */ "payments"."autogen"."cpu"`, err: true},
+		{q: `SELECT * FROM /^disk/ "payments".."cpu"`, err: true},
+		{q: `SELECT * FROM cpu 'payments'`, err: true},
+		{q: `SELECT * FROM a.b.c.d`, err: true},
+		{q: `SELECT * FROM (SELECT * FROM cpu`, err: true},
+	}
+
+	for _, d := range testData {
+		q, rewrites, err := Rename(d.q, rename(databases), rename(measurements))
+		if d.err {
+			if err == nil {
+				t.Errorf("%s: want error, got %s", d.q, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q != d.want {
+			t.Errorf("want %s, got %s", d.want, q)
+		}
+		if len(rewrites) != d.rewrites {
+			t.Errorf("want %d rewrites, got %v", d.rewrites, rewrites)
+		}
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	testData := []struct {
+		q    string
+		want []string
+		err  bool
+	}{
+		{q: "SELECT * FROM cpu WHERE host = 'db'"},
+		{q: `SELECT * FROM "billing".."invoices", metrics.autogen.cpu`, want: []string{"billing", "metrics"}},
+		{q: "SELECT * INTO archive..cpu FROM (SELECT * FROM billing..cpu)", want: []string{"archive", "billing"}},
+		{q: "SHOW MEASUREMENTS ON billing; DROP SERIES FROM billing..x", want: []string{"billing"}},
+		{q: "CREATE DATABASE a; DROP DATABASE b", want: []string{"a", "b"}},
+		{q: "SHOW MEASUREMENTS ON 'billing'", err: true},
+		{q: "SELECT * FROM /cpu/ billing..cpu", err: true},
+	}
+	for _, d := range testData {
+		databases, err := Databases(d.q)
+		if (err != nil) != d.err {
+			t.Errorf("%s: want error %v, got %v", d.q, d.err, err)
+			continue
+		}
+		if strings.Join(databases, ",") != strings.Join(d.want, ",") {
+			t.Errorf("%s: want %v, got %v", d.q, d.want, databases)
+		}
+	}
+}
+
+func TestHidden(t *testing.T) {
+	keys := []string{"email", "ip"}
+	testData := []struct {
+		q      string
+		hidden bool
+	}{
+		{"SELECT email, value FROM users WHERE ip = '10.0.0.1' GROUP BY email", false},
+		{`SELECT "email"::tag FROM users`, false},
+		{"SELECT email AS e FROM users", true},
+		{"SELECT email::tag AS e FROM users", true},
+		{"SELECT distinct(email) FROM users", true},
+		{"SELECT top(value, ip, 3) FROM users", true},
+		{"SELECT count(value) FROM users GROUP BY time(5m), ip", false},
+		{"SELECT e FROM (SELECT email AS e FROM users)", true},
+		{"SELECT last(*) FROM users", true},
+		{"SELECT max(/email/) FROM users", true},
+		{"SELECT mean(value * 2) FROM users", false},
+	}
+	for _, d := range testData {
+		if _, hidden := Hidden(d.q, keys); hidden != d.hidden {
+			t.Errorf("%s: want %v, got %v", d.q, d.hidden, hidden)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testData := []struct {
+		s    string
+		want time.Duration
+	}{
+		{"0", 0},
+		{"90m", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"2d", 48 * time.Hour},
+		{"4w", 28 * 24 * time.Hour},
+		{"168h0m0s", 168 * time.Hour},
+		{"500ms", 500 * time.Millisecond},
+	}
+	for _, d := range testData {
+		got, err := ParseDuration(d.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != d.want {
+			t.Errorf("%s: want %v, got %v", d.s, d.want, got)
+		}
+	}
+	if _, err := ParseDuration("1y"); err == nil {
+		t.Error("want error of unknown unit, got nil")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	// hourly data is kept for 30 days, daily data forever
+	choose := func(s Shape) string {
+		switch {
+		case s.Database != "metrics" || s.Regex:
+			return ""
+		case s.Interval%(24*time.Hour) == 0 && s.Start.IsZero():
+			return "daily"
+		case s.Interval%time.Hour == 0 && !s.Start.IsZero() && !s.Start.Before(now.Add(-30*24*time.Hour)):
+			return "hourly"
+		}
+		return ""
+	}
+
+	testData := []struct {
+		q    string
+		want string
+		rp   []string
+	}{
+		{
+			q:    "SELECT mean(value) FROM cpu WHERE time > now() - 7d GROUP BY time(1h)",
+			want: "SELECT mean(value) FROM hourly.cpu WHERE time > now() - 7d GROUP BY time(1h)",
+			rp:   []string{"hourly"},
+		},
+		{
+			q:    "SELECT mean(value) FROM cpu, mem WHERE time >= '2016-05-20T00:00:00Z' GROUP BY time(2h), host",
+			want: "SELECT mean(value) FROM hourly.cpu, hourly.mem WHERE time >= '2016-05-20T00:00:00Z' GROUP BY time(2h), host",
+			rp:   []string{"hourly"},
+		},
+		{
+			q:    "SELECT max(value) FROM metrics..cpu GROUP BY time(1d)",
+			want: "SELECT max(value) FROM metrics.daily.cpu GROUP BY time(1d)",
+			rp:   []string{"daily"},
+		},
+		{
+			q:    "SELECT mean(value) FROM cpu WHERE time > now() - 90d GROUP BY time(1h); SELECT max(value) FROM cpu GROUP BY time(7d)",
+			want: "SELECT mean(value) FROM cpu WHERE time > now() - 90d GROUP BY time(1h); SELECT max(value) FROM daily.cpu GROUP BY time(7d)",
+			rp:   []string{"daily"},
+		},
+		// raw points, explicit policies, INTO, subqueries, regexes and OR are not routed
+		{q: "SELECT value FROM cpu WHERE time > now() - 1h"},
+		{q: "SELECT mean(value) FROM autogen.cpu WHERE time > now() - 1d GROUP BY time(1h)"},
+		{q: "SELECT mean(value) INTO cpu_1h FROM cpu WHERE time > now() - 1d GROUP BY time(1h)"},
+		{q: "SELECT max(m) FROM (SELECT mean(value) AS m FROM cpu GROUP BY time(1h)) GROUP BY time(1d)"},
+		{q: "SELECT mean(value) FROM /cpu/ WHERE time > now() - 1d GROUP BY time(1h)"},
+		{q: "SELECT mean(value) FROM cpu WHERE time > now() - 1d OR host = 'a' GROUP BY time(1h)"},
+		{q: "SELECT mean(value) FROM other..cpu GROUP BY time(1d)"},
+		// only functions of one field are routed
+		{
+			q:    "SELECT derivative(max(value), 1h) AS d FROM cpu GROUP BY time(1d)",
+			want: "SELECT derivative(max(value), 1h) AS d FROM daily.cpu GROUP BY time(1d)",
+			rp:   []string{"daily"},
+		},
+		{q: "SELECT percentile(value, 95) FROM cpu GROUP BY time(1d)"},
+		{q: "SELECT mean(*) FROM cpu GROUP BY time(1d)"},
+		{q: "SELECT max(/usage/) FROM cpu GROUP BY time(1d)"},
+		{q: "SELECT mean(value), host FROM cpu GROUP BY time(1d)"},
+	}
+	for _, d := range testData {
+		if d.want == "" {
+			d.want = d.q
+		}
+		q, rp, err := Route(d.q, "metrics", now, choose)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q != d.want {
+			t.Errorf("want %s, got %s", d.want, q)
+		}
+		if strings.Join(rp, ",") != strings.Join(d.rp, ",") {
+			t.Errorf("%s: want %v, got %v", d.q, d.rp, rp)
+		}
+	}
+}
+
+func TestParseContinuousQuery(t *testing.T) {
+	testData := []struct {
+		q    string
+		want ContinuousQuery
+		ok   bool
+	}{
+		{
+			q:    "CREATE CONTINUOUS QUERY cq_1h ON metrics BEGIN SELECT mean(value) AS value INTO metrics.hourly.:MEASUREMENT FROM metrics.autogen./.*/ GROUP BY time(1h), * END",
+			want: ContinuousQuery{Database: "metrics", RetentionPolicy: "hourly", Interval: time.Hour, Aggregates: []Aggregate{{"mean", "value"}}},
+			ok:   true,
+		},
+		{
+			q: `CREATE CONTINUOUS QUERY cq_1d ON metrics RESAMPLE EVERY 1h BEGIN SELECT max(value) AS value, count(value) AS n, ` +
+				`2 * min(peak) AS peak INTO "daily".cpu FROM cpu GROUP BY time(1d), * END`,
+			want: ContinuousQuery{RetentionPolicy: "daily", Measurements: []string{"cpu"}, Interval: 24 * time.Hour, Aggregates: []Aggregate{{"max", "value"}}},
+			ok:   true,
+		},
+		// fields are renamed
+		{q: "CREATE CONTINUOUS QUERY cq ON metrics BEGIN SELECT mean(value) INTO hourly.:MEASUREMENT FROM cpu GROUP BY time(1h) END"},
+		{q: "CREATE CONTINUOUS QUERY cq ON metrics BEGIN SELECT mean(value) INTO hourly.cpu_mean FROM cpu GROUP BY time(1h) END"},
+		{q: "CREATE CONTINUOUS QUERY cq ON metrics BEGIN SELECT mean(value) INTO cpu_mean FROM cpu GROUP BY time(1h) END"},
+	}
+	for _, d := range testData {
+		cq, err := ParseContinuousQuery(d.q)
+		if (err == nil) != d.ok {
+			t.Errorf("%s: want ok %v, got %v", d.q, d.ok, err)
+			continue
+		}
+		if d.ok && fmt.Sprint(cq) != fmt.Sprint(d.want) {
+			t.Errorf("want %+v, got %+v", d.want, cq)
+		}
+	}
+}
+
+func TestConditions(t *testing.T) {
+	keys := []string{"email", "ip"}
+	testData := []struct {
+		q    string
+		want []string // operators of conditions
+	}{
+		{"SELECT email FROM users GROUP BY ip", nil},
+		{"SELECT count(value) FROM users WHERE email = 'a' AND host = 'b'", []string{"="}},
+		{"SELECT count(value) FROM users WHERE (email =~ /^a/ OR ip::tag != '10.0.0.1') GROUP BY email", []string{"=~", "!="}},
+		{"SELECT count(value) FROM users WHERE 'a' = email", []string{""}},
+		{"SELECT count(value) FROM users WHERE email = 'a' + host", []string{""}},
+		{"SELECT * FROM (SELECT * FROM users WHERE ip > '10') WHERE value > 1 GROUP BY email", []string{">"}},
+		{"SHOW TAG VALUES WITH KEY = email WHERE host = 'a'", nil},
+	}
+	for _, d := range testData {
+		conditions, err := Conditions(d.q, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var operators []string
+		for _, c := range conditions {
+			operators = append(operators, c.Operator)
+		}
+		if fmt.Sprint(operators) != fmt.Sprint(d.want) {
+			t.Errorf("%s: want %q, got %q", d.q, d.want, operators)
+		}
+	}
+
+	q := "SELECT count(value) FROM users WHERE email = 'f00d'"
+	conditions, _ := Conditions(q, keys)
+	if got := Replace(q, conditions, []string{"o'neil@example.com"}); got != `SELECT count(value) FROM users WHERE email = 'o\'neil@example.com'` {
+		t.Errorf("want the value replaced, got %s", got)
+	}
+}
+
+func TestRedactPasswords(t *testing.T) {
+	testData := []struct {
+		q    string
+		want string
+	}{
+		{"CREATE USER bob WITH PASSWORD 'secret'", "CREATE USER bob WITH PASSWORD [REDACTED]"},
+		{`SET PASSWORD FOR "bob" = 'it\'s'`, `SET PASSWORD FOR "bob" = [REDACTED]`},
+		{"create user bob with password 'a'; SELECT * FROM cpu WHERE host = 'web'", "create user bob with password [REDACTED]; SELECT * FROM cpu WHERE host = 'web'"},
+		{"SELECT * FROM cpu WHERE host = 'web'", "SELECT * FROM cpu WHERE host = 'web'"},
+		// unreadable queries are not logged
+		{"CREATE USER bob WITH PASSWORD 'secret", "[REDACTED]"},
+	}
+	for _, d := range testData {
+		if got := RedactPasswords(d.q); got != d.want {
+			t.Errorf("want %s, got %s", d.want, got)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var errUnknownSource = errors.New("Sources of the query can not be read")
+
+// edit replaces runes of the query between pos and end
+type edit struct {
+	pos, end int
+	text     string
+}
+
+type byPos []edit
+
+func (e byPos) Len() int           { return len(e) }
+func (e byPos) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byPos) Less(i, j int) bool { return e[i].pos < e[j].pos }
+
+// Rename replaces database and measurement names of the query by the given functions,
+// names in FROM, INTO, ON, CREATE/DROP DATABASE, DROP MEASUREMENT and WITH MEASUREMENT are renamed,
+// regex sources are kept as they are. Returns the query and the list of applied rewrites
+func Rename(q string, database, measurement func(string) string) (string, []string, error) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return q, nil, err
+	}
+
+	var edits []edit
+	var rewrites []string
+	seen := map[string]bool{}
+	rename := func(t *Token, kind string, f func(string) string) {
+		if t == nil || t.Kind != Ident {
+			return
+		}
+		name := f(t.Value)
+		if name == t.Value {
+			return
+		}
+		edits = append(edits, edit{t.Pos, t.End, quoteIdent(name, t.Quoted)})
+		if r := fmt.Sprintf("%s %s -> %s", kind, t.Value, name); !seen[r] {
+			seen[r] = true
+			rewrites = append(rewrites, r)
+		}
+	}
+
+	for i := range tokens {
+		t := tokens[i]
+		switch {
+		case t.IsKeyword("FROM") || t.IsKeyword("INTO"):
+			sources, err := sourceList(tokens, i+1)
+			if err != nil {
+				return q, nil, err
+			}
+			for _, parts := range sources {
+				if len(parts) == 3 {
+					rename(parts[0], "database", database)
+				}
+				rename(parts[len(parts)-1], "measurement", measurement)
+			}
+		case t.IsKeyword("ON") && i+1 < len(tokens):
+			rename(&tokens[i+1], "database", database)
+		case t.IsKeyword("DATABASE") && i > 0 && i+1 < len(tokens) &&
+			(tokens[i-1].IsKeyword("CREATE") || tokens[i-1].IsKeyword("DROP")):
+			rename(&tokens[i+1], "database", database)
+		case t.IsKeyword("MEASUREMENT") && i > 0 && i+1 < len(tokens) && tokens[i-1].IsKeyword("DROP"):
+			rename(&tokens[i+1], "measurement", measurement)
+		case t.IsKeyword("MEASUREMENT") && i > 0 && i+2 < len(tokens) && tokens[i-1].IsKeyword("WITH") &&
+			tokens[i+1].Kind == Operator && tokens[i+1].Value == "=":
+			rename(&tokens[i+2], "measurement", measurement)
+		}
+	}
+	if len(edits) == 0 {
+		return q, nil, nil
+	}
+
+	return apply(q, edits), rewrites, nil
+}
+
+// apply applies edits ordered by their offsets to the query,
+// edits are applied from the end, so offsets of the previous ones are kept
+func apply(q string, edits []edit) string {
+	sort.Sort(byPos(edits))
+	r := []rune(q)
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		r = append(r[:e.pos], append([]rune(e.text), r[e.end:]...)...)
+	}
+	return string(r)
+}
+
+// Databases returns names of databases referenced by FROM, INTO and ON clauses
+// and CREATE/DROP DATABASE statements of the query, the database of the request is not included.
+// Sources that can not be read are errors, so the caller can deny the query rather than miss a database
+func Databases(q string) ([]string, error) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	var databases []string
+	seen := map[string]bool{}
+	add := func(t *Token) error {
+		if t == nil || t.Kind != Ident || isKeyword(*t) {
+			return errUnknownSource
+		}
+		if !seen[t.Value] {
+			seen[t.Value] = true
+			databases = append(databases, t.Value)
+		}
+		return nil
+	}
+	for i := range tokens {
+		t := tokens[i]
+		var next *Token
+		if i+1 < len(tokens) {
+			next = &tokens[i+1]
+		}
+		switch {
+		case t.IsKeyword("FROM") || t.IsKeyword("INTO"):
+			sources, err := sourceList(tokens, i+1)
+			if err != nil {
+				return nil, err
+			}
+			for _, parts := range sources {
+				if len(parts) == 3 {
+					if err := add(parts[0]); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case t.IsKeyword("ON"):
+			if err := add(next); err != nil {
+				return nil, err
+			}
+		case t.IsKeyword("DATABASE") && i > 0 && (tokens[i-1].IsKeyword("CREATE") || tokens[i-1].IsKeyword("DROP")):
+			if err := add(next); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return databases, nil
+}
+
+// sourceList reads sources of FROM or INTO at start: [db.][rp.]measurement, [db.][rp.]/regex/,
+// [db.]rp.:MEASUREMENT or subquery, separated by commas. The last part of regex sources is nil,
+// subqueries are skipped, their sources are read by their own FROM.
+// The list must be followed by a keyword, ')', ';' or the end of the query,
+// so syntax that is not understood is an error rather than skipped names
+func sourceList(tokens []Token, start int) ([][]*Token, error) {
+	var sources [][]*Token
+	for i := start; ; i++ {
+		if i >= len(tokens) {
+			return nil, errUnknownSource
+		}
+		switch {
+		case tokens[i].Kind == Operator && tokens[i].Value == "(":
+			end := closingParen(tokens, i)
+			if end < 0 {
+				return nil, errUnknownSource
+			}
+			i = end + 1
+		case tokens[i].Kind == Regex:
+			sources = append(sources, []*Token{nil})
+			i++
+		case tokens[i].Kind == Ident && !isKeyword(tokens[i]):
+			parts, next := source(tokens, i)
+			if len(parts) > 3 {
+				return nil, errUnknownSource
+			}
+			if parts[len(parts)-1] == nil && next < len(tokens) {
+				switch {
+				case tokens[next].Kind == Regex:
+					next++
+				case tokens[next].Kind == Operator && tokens[next].Value == ":" &&
+					next+1 < len(tokens) && tokens[next+1].IsKeyword("MEASUREMENT"):
+					// back-reference of INTO
+					next += 2
+				default:
+					return nil, errUnknownSource
+				}
+			}
+			sources = append(sources, parts)
+			i = next
+		default:
+			return nil, errUnknownSource
+		}
+		if i < len(tokens) && tokens[i].Kind == Operator && tokens[i].Value == "," {
+			continue
+		}
+		if i == len(tokens) || isKeyword(tokens[i]) ||
+			tokens[i].Kind == Operator && (tokens[i].Value == ";" || tokens[i].Value == ")") {
+			return sources, nil
+		}
+		return nil, errUnknownSource
+	}
+}
+
+// closingParen returns the index of the parenthesis closing the one at start, -1 if there is none
+func closingParen(tokens []Token, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		if tokens[i].Kind != Operator {
+			continue
+		}
+		switch tokens[i].Value {
+		case "(":
+			depth++
+		case ")":
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// source reads the qualified name starting at start, parts are nil if they are omitted, e.g: db..cpu,
+// returns parts and the index of the next token
+func source(tokens []Token, start int) ([]*Token, int) {
+	var parts []*Token
+	i := start
+	if i < len(tokens) && (tokens[i].Kind == Regex || tokens[i].Kind == Operator) {
+		// regex or subquery
+		return nil, i + 1
+	}
+	for i < len(tokens) {
+		if tokens[i].Kind == Ident && !isKeyword(tokens[i]) {
+			parts = append(parts, &tokens[i])
+			i++
+		} else {
+			parts = append(parts, nil)
+		}
+		if i >= len(tokens) || tokens[i].Kind != Operator || tokens[i].Value != "." {
+			break
+		}
+		i++
+	}
+	return parts, i
+}
+
+// quoteIdent returns the identifier as it can be written in the query
+func quoteIdent(name string, quoted bool) string {
+	bare := name != "" && !keywords[strings.ToUpper(name)]
+	for i, c := range name {
+		if !(isIdentRune(c) || i > 0 && c >= '0' && c <= '9') {
+			bare = false
+		}
+	}
+	if bare && !quoted {
+		return name
+	}
+	return `"` + strings.Replace(name, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,315 @@
+package query
+
+import (
+	"errors"
+	"strings"
+)
+
+var errEmptyQuery = errors.New("Query does not contain statements")
+
+// Privilege is the coarse class of statements granted to groups
+type Privilege string
+
+// privileges of statements
+const (
+	Read        Privilege = "read"         // SELECT
+	Write       Privilege = "write"        // SELECT ... INTO
+	SchemaRead  Privilege = "schema-read"  // SHOW of measurements, tags, fields, series, retention policies, continuous queries
+	SchemaWrite Privilege = "schema-write" // CREATE, DROP and ALTER of retention policies and continuous queries, CREATE DATABASE
+	Delete      Privilege = "delete"       // DELETE, DROP SERIES, DROP MEASUREMENT
+	Admin       Privilege = "admin"        // users, grants, KILL QUERY, DROP DATABASE, DROP SHARD, server internals
+)
+
+// Privileges are all known privileges
+var Privileges = []Privilege{Read, Write, SchemaRead, SchemaWrite, Delete, Admin}
+
+// Statement is the single statement of the query
+type Statement struct {
+	Text       string      `json:"text"`
+	Command    string      `json:"command"`    // leading keywords, e.g: SELECT, SHOW MEASUREMENTS, DROP SERIES
+	Privileges []Privilege `json:"privileges"` // privileges required to run the statement
+}
+
+// Parse splits the query into statements and classifies them,
+// unknown statements require admin privilege
+func Parse(q string) ([]Statement, error) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	var statements []Statement
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].Kind == Operator && tokens[i].Value == ";") {
+			continue
+		}
+		if i > start {
+			stmt := tokens[start:i]
+			statements = append(statements, Statement{Text: join(stmt), Command: command(stmt), Privileges: classify(stmt)})
+		}
+		start = i + 1
+	}
+	if len(statements) == 0 {
+		return nil, errEmptyQuery
+	}
+	return statements, nil
+}
+
+// SHOW statements of server internals
+var adminShows = map[string]bool{
+	"USERS": true, "GRANTS": true, "QUERIES": true, "STATS": true,
+	"DIAGNOSTICS": true, "SHARDS": true, "SHARD": true, "SUBSCRIPTIONS": true,
+}
+
+// classify returns privileges required to run the statement
+func classify(stmt []Token) []Privilege {
+	first, second := keywordAt(stmt, 0), keywordAt(stmt, 1)
+	switch first {
+	case "SELECT":
+		for _, t := range stmt {
+			if t.IsKeyword("INTO") {
+				return []Privilege{Read, Write}
+			}
+		}
+		return []Privilege{Read}
+	case "EXPLAIN":
+		// EXPLAIN [ANALYZE] SELECT runs the query
+		rest := stmt[1:]
+		if second == "ANALYZE" {
+			rest = stmt[2:]
+		}
+		return classify(rest)
+	case "SHOW":
+		if adminShows[second] {
+			return []Privilege{Admin}
+		}
+		return []Privilege{SchemaRead}
+	case "DELETE":
+		return []Privilege{Delete}
+	case "DROP":
+		switch second {
+		case "SERIES", "MEASUREMENT":
+			return []Privilege{Delete}
+		case "RETENTION", "CONTINUOUS":
+			return []Privilege{SchemaWrite}
+		}
+		return []Privilege{Admin}
+	case "CREATE", "ALTER":
+		switch second {
+		case "DATABASE", "RETENTION", "CONTINUOUS":
+			return []Privilege{SchemaWrite}
+		}
+		return []Privilege{Admin}
+	}
+	// GRANT, REVOKE, SET PASSWORD, KILL QUERY and unknown statements
+	return []Privilege{Admin}
+}
+
+// command returns the leading keywords of the statement
+func command(stmt []Token) string {
+	first := keywordAt(stmt, 0)
+	switch first {
+	case "SHOW", "CREATE", "DROP", "ALTER":
+		if second := keywordAt(stmt, 1); second != "" {
+			return first + " " + second
+		}
+	}
+	return first
+}
+
+// keywordAt returns the upper case bare word at the index, empty if there is none
+func keywordAt(stmt []Token, i int) string {
+	if i >= len(stmt) || stmt[i].Kind != Ident || stmt[i].Quoted {
+		return ""
+	}
+	return strings.ToUpper(stmt[i].Value)
+}
+
+// Hidden returns the key that is renamed by AS or passed to a function in the query,
+// e.g: SELECT email AS e or SELECT distinct(email), results of such keys can not be found by column name.
+// Wildcards and regexes passed to functions, e.g: last(*) or max(/email/), hide every key
+func Hidden(q string, keys []string) (string, bool) {
+	if len(keys) == 0 {
+		return "", false
+	}
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return "", false
+	}
+	wanted := map[string]bool{}
+	for _, k := range keys {
+		wanted[k] = true
+	}
+	// calls counts open parentheses of function calls, e.g: top(value, email, 3)
+	var parens []bool
+	calls := 0
+	for i, t := range tokens {
+		if t.Kind == Operator && t.Value == "(" {
+			call := i > 0 && tokens[i-1].Kind == Ident && !isKeyword(tokens[i-1])
+			parens = append(parens, call)
+			if call {
+				calls++
+			}
+			continue
+		}
+		if t.Kind == Operator && t.Value == ")" && len(parens) > 0 {
+			if parens[len(parens)-1] {
+				calls--
+			}
+			parens = parens[:len(parens)-1]
+			continue
+		}
+		if calls > 0 && t.Kind == Regex {
+			return t.String(), true
+		}
+		if calls > 0 && t.Kind == Operator && t.Value == "*" && isArgument(tokens, i) {
+			return t.Value, true
+		}
+		if t.Kind != Ident || isKeyword(t) || !wanted[t.Value] {
+			continue
+		}
+		if calls > 0 {
+			return t.Value, true
+		}
+		// skip the cast, e.g: email::tag
+		next := i + 1
+		if next+1 < len(tokens) && tokens[next].Kind == Operator && tokens[next].Value == "::" {
+			next += 2
+		}
+		if next < len(tokens) && tokens[next].IsKeyword("AS") {
+			return t.Value, true
+		}
+	}
+	return "", false
+}
+
+// isArgument checks whether the token is the whole argument of the function, e.g: * of last(*),
+// rather than the operator of the expression, e.g: * of mean(value * 2)
+func isArgument(tokens []Token, i int) bool {
+	if i == 0 || i+1 >= len(tokens) || tokens[i-1].Kind != Operator || tokens[i+1].Kind != Operator {
+		return false
+	}
+	prev, next := tokens[i-1].Value, tokens[i+1].Value
+	return (prev == "(" || prev == ",") && (next == ")" || next == "," || next == "::")
+}
+
+// Condition is the use of the key in WHERE clause
+type Condition struct {
+	Key      string
+	Operator string // comparison operator of key = 'value' conditions, empty if the key is used in another way
+	Value    Token  // compared literal
+}
+
+// comparison operators of conditions
+var comparisons = map[string]bool{"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true, "=~": true, "!~": true}
+
+// keywords ending WHERE clause
+var clauses = map[string]bool{"GROUP": true, "ORDER": true, "LIMIT": true, "OFFSET": true, "SLIMIT": true, "SOFFSET": true}
+
+// Conditions returns uses of the keys in WHERE clauses of the query, including subqueries,
+// only "key op literal" uses, e.g: email = 'alice@example.com' or email::tag =~ /^a/, have the operator
+func Conditions(q string, keys []string) ([]Condition, error) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, k := range keys {
+		wanted[k] = true
+	}
+	var conditions []Condition
+	// depths of parentheses of open WHERE clauses
+	var where []int
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.IsKeyword("WHERE"):
+			where = append(where, depth)
+			continue
+		case t.Kind == Operator && t.Value == "(":
+			depth++
+			continue
+		case t.Kind == Operator && t.Value == ")":
+			depth--
+			for len(where) > 0 && where[len(where)-1] > depth {
+				where = where[:len(where)-1]
+			}
+			continue
+		case t.Kind == Operator && t.Value == ";":
+			where, depth = nil, 0
+			continue
+		}
+		if len(where) == 0 {
+			continue
+		}
+		if isKeyword(t) && clauses[strings.ToUpper(t.Value)] && where[len(where)-1] == depth {
+			where = where[:len(where)-1]
+			continue
+		}
+		if t.Kind != Ident || isKeyword(t) || !wanted[t.Value] {
+			continue
+		}
+		c := Condition{Key: t.Value}
+		next := i + 1
+		// skip the cast, e.g: email::tag
+		if next+1 < len(tokens) && tokens[next].Kind == Operator && tokens[next].Value == "::" {
+			next += 2
+		}
+		prev := i - 1
+		operand := prev < 0 || tokens[prev].Kind == Operator && (tokens[prev].Value == "(" || tokens[prev].Value == ",") ||
+			tokens[prev].IsKeyword("AND") || tokens[prev].IsKeyword("OR") || tokens[prev].IsKeyword("WHERE")
+		if operand && next+1 < len(tokens) && tokens[next].Kind == Operator && comparisons[tokens[next].Value] {
+			value := tokens[next+1]
+			end := next + 2
+			literal := value.Kind == String || value.Kind == Number || value.Kind == Regex
+			// the literal must be the whole operand, e.g: not email = 'a' + x
+			if literal && (end == len(tokens) || tokens[end].IsKeyword("AND") || tokens[end].IsKeyword("OR") ||
+				isKeyword(tokens[end]) && clauses[strings.ToUpper(tokens[end].Value)] ||
+				tokens[end].Kind == Operator && (tokens[end].Value == ")" || tokens[end].Value == ";")) {
+				c.Operator, c.Value = tokens[next].Value, value
+			}
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// Replace replaces literals of the conditions by string values in order, e.g: hashed values by raw ones
+func Replace(q string, conditions []Condition, values []string) string {
+	edits := make([]edit, len(conditions))
+	for i, c := range conditions {
+		edits[i] = edit{c.Value.Pos, c.Value.End, "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(values[i]) + "'"}
+	}
+	return apply(q, edits)
+}
+
+// redacted replaces passwords of logged queries
+const redacted = "[REDACTED]"
+
+// RedactPasswords replaces string literals following PASSWORD, e.g: of CREATE USER ... WITH PASSWORD
+// and SET PASSWORD FOR ... = statements, so the query can be logged.
+// The query that can not be read is redacted entirely if it mentions a password
+func RedactPasswords(q string) string {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		if strings.Contains(strings.ToUpper(q), "PASSWORD") {
+			return redacted
+		}
+		return q
+	}
+	var edits []edit
+	password := false
+	for _, t := range tokens {
+		switch {
+		case t.IsKeyword("PASSWORD"):
+			password = true
+		case t.Kind == Operator && t.Value == ";":
+			password = false
+		case password && t.Kind == String:
+			edits = append(edits, edit{t.Pos, t.End, redacted})
+			password = false
+		}
+	}
+	return apply(q, edits)
+}
@@ -0,0 +1,136 @@
+package query
+
+import (
+	"errors"
+	"strings"
+)
+
+var errEmptyTemplate = errors.New("Query template is empty")
+
+// keywords of InfluxQL, they are compared case insensitively
+// and can not be the value of the template parameter
+var keywords = map[string]bool{
+	"ALL": true, "ALTER": true, "AND": true, "ANY": true, "AS": true, "ASC": true, "BEGIN": true, "BY": true,
+	"CREATE": true, "DATABASE": true, "DATABASES": true, "DELETE": true, "DESC": true, "DROP": true,
+	"END": true, "EXPLAIN": true, "FIELD": true, "FILL": true, "FOR": true, "FROM": true, "GRANT": true,
+	"GROUP": true, "IN": true, "INTO": true, "KEY": true, "KEYS": true, "KILL": true, "LIMIT": true,
+	"MEASUREMENT": true, "MEASUREMENTS": true, "OFFSET": true, "ON": true, "OR": true,
+	"ORDER": true, "PASSWORD": true, "POLICY": true, "QUERIES": true, "QUERY": true,
+	"RETENTION": true, "REVOKE": true, "SELECT": true, "SERIES": true, "SET": true,
+	"SHOW": true, "SLIMIT": true, "SOFFSET": true, "TAG": true, "TO": true, "USER": true,
+	"USERS": true, "VALUES": true, "WHERE": true, "WITH": true,
+}
+
+func isKeyword(t Token) bool {
+	return t.Kind == Ident && !t.Quoted && keywords[strings.ToUpper(t.Value)]
+}
+
+// Template is the query shape with $name parameters, e.g:
+// SELECT mean(value) FROM cpu WHERE host = $host AND time > $t GROUP BY time($interval)
+// every parameter matches one literal of the query, e.g: 'web-1', 5, 5m, /^web/, now() - 1h
+type Template struct {
+	Text   string
+	tokens []Token
+}
+
+// Compile tokenizes the template
+func Compile(text string) (*Template, error) {
+	tokens, err := Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	tokens = trimSemicolons(tokens)
+	if len(tokens) == 0 {
+		return nil, errEmptyTemplate
+	}
+	return &Template{Text: text, tokens: tokens}, nil
+}
+
+// Match checks whether the whole query has the shape of the template,
+// returns values of the parameters, the same parameter must have the same value
+func (t *Template) Match(q string) (map[string]string, bool) {
+	tokens, err := Tokenize(q)
+	if err != nil {
+		return nil, false
+	}
+	params := map[string]string{}
+	if !match(t.tokens, trimSemicolons(tokens), params) {
+		return nil, false
+	}
+	return params, true
+}
+
+// match matches template tokens with query tokens,
+// parameters take the shortest literal that lets the rest match
+func match(tmpl, q []Token, params map[string]string) bool {
+	if len(tmpl) == 0 {
+		return len(q) == 0
+	}
+	if tmpl[0].Kind != Param {
+		return len(q) > 0 && equal(tmpl[0], q[0]) && match(tmpl[1:], q[1:], params)
+	}
+
+	name := tmpl[0].Value
+	for _, n := range literals(q) {
+		value := join(q[:n])
+		prev, bound := params[name]
+		if bound && prev != value {
+			continue
+		}
+		params[name] = value
+		if match(tmpl[1:], q[n:], params) {
+			return true
+		}
+		if !bound {
+			delete(params, name)
+		}
+	}
+	return false
+}
+
+// literals returns lengths of literals at the start of tokens, the value of the parameter is one literal:
+// 'web-1', 5, 5m, /^web/, now() or now() - 1h, not identifiers or expressions
+func literals(q []Token) []int {
+	if len(q) == 0 {
+		return nil
+	}
+	switch q[0].Kind {
+	case String, Number, Duration, Regex:
+		return []int{1}
+	}
+	if len(q) < 3 || !q[0].IsKeyword("now") || q[1].Kind != Operator || q[1].Value != "(" || q[2].Kind != Operator || q[2].Value != ")" {
+		return nil
+	}
+	if len(q) >= 5 && q[3].Kind == Operator && (q[3].Value == "+" || q[3].Value == "-") && q[4].Kind == Duration {
+		return []int{3, 5}
+	}
+	return []int{3}
+}
+
+// equal compares tokens, keywords are case insensitive and
+// identifiers are equal whether they are quoted or not
+func equal(a, b Token) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	if isKeyword(a) || isKeyword(b) {
+		return strings.EqualFold(a.Value, b.Value) && a.Quoted == b.Quoted
+	}
+	return a.Value == b.Value
+}
+
+// join returns tokens as the query text
+func join(tokens []Token) string {
+	s := make([]string, len(tokens))
+	for i, t := range tokens {
+		s[i] = t.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func trimSemicolons(tokens []Token) []Token {
+	for len(tokens) > 0 && tokens[len(tokens)-1].Kind == Operator && tokens[len(tokens)-1].Value == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
@@ -1,9 +1,51 @@
 package util
 
-import "strings"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
 
 // cleanQuery makes query comparable
 // it turns all strings to lowercase and trims all spaces
 func CleanQuery(q string) string {
 	return strings.Replace(strings.ToLower(strings.TrimSpace(q)), " ", "", -1)
 }
+
+// NormalizeQuery collapses all whitespaces of the query into single spaces
+func NormalizeQuery(q string) string {
+	return strings.Join(strings.Fields(q), " ")
+}
+
+// TLSVersion converts version string like "1.2" to tls package constant,
+// empty string means the default version
+func TLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version: %s", v)
+}
+
+// LoadCertPool reads PEM encoded certificates from the CA bundle file
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
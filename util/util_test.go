@@ -0,0 +1,92 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSVersion(t *testing.T) {
+	testData := []struct {
+		version string
+		want    uint16
+		err     bool
+	}{
+		{"", 0, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.1", tls.VersionTLS11, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.4", 0, true},
+		{"TLS1.2", 0, true},
+		{"ssl3", 0, true},
+	}
+	for _, d := range testData {
+		v, err := TLSVersion(d.version)
+		if (err != nil) != d.err || v != d.want {
+			t.Errorf("%q: want %v and error %v, got %v and %v", d.version, d.want, d.err, v, err)
+		}
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, empty := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		path  string
+		certs int
+		err   bool
+	}{
+		{ca, 1, false},
+		{empty, 0, true},
+		{filepath.Join(dir, "missing.pem"), 0, true},
+	}
+	for _, d := range testData {
+		pool, err := LoadCertPool(d.path)
+		if (err != nil) != d.err {
+			t.Errorf("%s: want error %v, got %v", d.path, d.err, err)
+			continue
+		}
+		if pool != nil && len(pool.Subjects()) != d.certs {
+			t.Errorf("%s: want %d certificates, got %d", d.path, d.certs, len(pool.Subjects()))
+		}
+	}
+}